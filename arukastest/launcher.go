@@ -0,0 +1,136 @@
+// +build !windows
+
+package arukastest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rarukas/rarukas/server"
+	"github.com/yamamoto-febc/go-arukas"
+)
+
+// RarukasServerLauncher is a Launcher that starts rarukas-server in-process for each service.
+// RARUKAS_PUBLIC_KEY and RARUKAS_COMMAND in the service's environment are passed to rarukas-server
+type RarukasServerLauncher struct {
+	// WorkDir is working directory of rarukas-server. If empty, use current directory
+	WorkDir string
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// Launch starts rarukas-server and waits until its SSH port is available
+func (l *RarukasServerLauncher) Launch(service *arukas.Service) ([]*arukas.PortMapping, error) {
+	cfg := &server.Config{
+		Command:         "/bin/sh",
+		HealthCheckAddr: "127.0.0.1",
+		SSHServerAddr:   "127.0.0.1",
+		WorkDir:         l.WorkDir,
+	}
+	for _, env := range service.Attributes.Environment {
+		switch env.Key {
+		case server.RarukasPublicKeyEnv:
+			cfg.PublicKey = env.Value
+		case server.RarukasAuthorizedKeysEnv:
+			cfg.AuthorizedKeys = env.Value
+		case server.RarukasTrustedUserCAKeysEnv:
+			cfg.TrustedUserCAKeys = env.Value
+		case server.RarukasRunIDEnv:
+			cfg.RunID = env.Value
+		case server.RarukasCommandEnv:
+			cfg.Command = env.Value
+		case server.RarukasAllowForwardingEnv:
+			cfg.AllowForwarding = env.Value == "true"
+		case server.RarukasAcceptEnvEnv:
+			cfg.AcceptEnv = strings.Split(env.Value, ",")
+		case server.RarukasHostKeyEnv:
+			cfg.HostKey = env.Value
+		}
+	}
+
+	var err error
+	if cfg.SSHServerPort, err = freePort(); err != nil {
+		return nil, err
+	}
+	if cfg.HealthCheckPort, err = freePort(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- server.Start(ctx, cfg)
+	}()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.SSHServerPort)
+	timeout := time.After(10 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close() // nolint
+			break
+		}
+		select {
+		case err := <-errChan:
+			cancel()
+			return nil, err
+		case <-timeout:
+			cancel()
+			return nil, fmt.Errorf("starting rarukas-server timed out")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	l.mu.Lock()
+	if l.cancels == nil {
+		l.cancels = map[string]context.CancelFunc{}
+	}
+	l.cancels[service.ID] = cancel
+	l.mu.Unlock()
+
+	var res []*arukas.PortMapping
+	for _, port := range service.Attributes.Ports {
+		var servicePort int
+		switch port.Number {
+		case server.RarukasDefaultSSHPort:
+			servicePort = cfg.SSHServerPort
+		case server.RarukasDefaultHTTPPort:
+			servicePort = cfg.HealthCheckPort
+		default:
+			continue
+		}
+		res = append(res, &arukas.PortMapping{
+			Host:          "127.0.0.1",
+			Protocol:      port.Protocol,
+			ContainerPort: port.Number,
+			ServicePort:   int32(servicePort),
+		})
+	}
+	return res, nil
+}
+
+// Stop stops rarukas-server
+func (l *RarukasServerLauncher) Stop(serviceID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cancel, ok := l.cancels[serviceID]; ok {
+		cancel()
+		delete(l.cancels, serviceID)
+	}
+	return nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close() // nolint
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,460 @@
+// Package arukastest provides a fake Arukas JSON API server for testing.
+package arukastest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/yamamoto-febc/go-arukas"
+)
+
+// Operation is kind of Arukas API operation. It is used to inject errors
+type Operation string
+
+const (
+	// OpListApps represents "GET /apps"
+	OpListApps Operation = "ListApps"
+	// OpReadApp represents "GET /apps/:id"
+	OpReadApp Operation = "ReadApp"
+	// OpCreateApp represents "POST /apps"
+	OpCreateApp Operation = "CreateApp"
+	// OpDeleteApp represents "DELETE /apps/:id"
+	OpDeleteApp Operation = "DeleteApp"
+	// OpListServices represents "GET /services"
+	OpListServices Operation = "ListServices"
+	// OpReadService represents "GET /services/:id"
+	OpReadService Operation = "ReadService"
+	// OpUpdateService represents "PATCH /services/:id"
+	OpUpdateService Operation = "UpdateService"
+	// OpPowerOn represents "POST /services/:id/power"
+	OpPowerOn Operation = "PowerOn"
+	// OpPowerOff represents "DELETE /services/:id/power"
+	OpPowerOff Operation = "PowerOff"
+)
+
+// StatusCreating represents the status of the service just after creating app
+const StatusCreating = "creating"
+
+// Launcher launches the container of the service
+type Launcher interface {
+	// Launch is called when the service is powered on. It returns actual port mappings of the container
+	Launch(service *arukas.Service) ([]*arukas.PortMapping, error)
+	// Stop is called when the service is powered off or deleted
+	Stop(serviceID string) error
+}
+
+// Server is a fake Arukas JSON API server.
+//
+// It tracks state of apps and services(creating -> stopped -> booting -> running).
+type Server struct {
+	*httptest.Server
+
+	// Token and Secret are credentials required to call API. If empty, credentials are not checked
+	Token  string
+	Secret string
+
+	// CreateDelay is duration of "creating" status after creating app
+	CreateDelay time.Duration
+	// BootDelay is duration of "booting" status after powering on
+	BootDelay time.Duration
+	// Launcher launches the container when the service is powered on. If nil, port mappings are dummy values
+	Launcher Launcher
+
+	mu       sync.Mutex
+	apps     map[string]*arukas.App
+	services map[string]*serviceState
+	errors   map[Operation]int
+}
+
+type serviceState struct {
+	service   *arukas.Service
+	changedAt time.Time
+}
+
+// NewServer starts and returns a new fake Arukas API server. The caller should call Close when finished
+func NewServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// NewUnstartedServer returns a new fake Arukas API server but doesn't start it.
+// The caller should call Start to start the server
+func NewUnstartedServer() *Server {
+	s := newServer()
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func newServer() *Server {
+	return &Server{
+		apps:     map[string]*arukas.App{},
+		services: map[string]*serviceState{},
+		errors:   map[Operation]int{},
+	}
+}
+
+// InjectError makes the operation fail with HTTP status code until ClearErrors is called
+func (s *Server) InjectError(op Operation, statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors[op] = statusCode
+}
+
+// ClearErrors clears injected errors
+func (s *Server) ClearErrors() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = map[Operation]int{}
+}
+
+// Apps returns current apps
+func (s *Server) Apps() []*arukas.App {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var apps []*arukas.App
+	for _, app := range s.apps {
+		apps = append(apps, app)
+	}
+	return apps
+}
+
+// ServiceStatus returns current status of the service
+func (s *Server) ServiceStatus(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.services[id]
+	if !ok {
+		return ""
+	}
+	s.advance(state)
+	return state.service.Attributes.Status
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" || s.Secret != "" {
+		token, secret, ok := r.BasicAuth()
+		if !ok || token != s.Token || secret != s.Secret {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/api")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "apps" && r.Method == http.MethodGet:
+		s.serve(w, OpListApps, s.listApps)
+	case len(parts) == 1 && parts[0] == "apps" && r.Method == http.MethodPost:
+		s.serve(w, OpCreateApp, func() (int, interface{}, error) { return s.createApp(r) })
+	case len(parts) == 2 && parts[0] == "apps" && r.Method == http.MethodGet:
+		s.serve(w, OpReadApp, func() (int, interface{}, error) { return s.readApp(parts[1]) })
+	case len(parts) == 2 && parts[0] == "apps" && r.Method == http.MethodDelete:
+		s.serve(w, OpDeleteApp, func() (int, interface{}, error) { return s.deleteApp(parts[1]) })
+	case len(parts) == 1 && parts[0] == "services" && r.Method == http.MethodGet:
+		s.serve(w, OpListServices, s.listServices)
+	case len(parts) == 2 && parts[0] == "services" && r.Method == http.MethodGet:
+		s.serve(w, OpReadService, func() (int, interface{}, error) { return s.readService(parts[1]) })
+	case len(parts) == 2 && parts[0] == "services" && r.Method == http.MethodPatch:
+		s.serve(w, OpUpdateService, func() (int, interface{}, error) { return s.updateService(parts[1], r) })
+	case len(parts) == 3 && parts[0] == "services" && parts[2] == "power" && r.Method == http.MethodPost:
+		s.serve(w, OpPowerOn, func() (int, interface{}, error) { return s.powerOn(parts[1]) })
+	case len(parts) == 3 && parts[0] == "services" && parts[2] == "power" && r.Method == http.MethodDelete:
+		s.serve(w, OpPowerOff, func() (int, interface{}, error) { return s.powerOff(parts[1]) })
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s is not found", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) serve(w http.ResponseWriter, op Operation, fn func() (int, interface{}, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if code, ok := s.errors[op]; ok {
+		writeError(w, code, fmt.Sprintf("injected error: %s", op))
+		return
+	}
+
+	code, body, err := fn()
+	if err != nil {
+		writeError(w, code, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(code)
+	if body != nil {
+		json.NewEncoder(w).Encode(body) // nolint
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{ // nolint
+		"errors": []map[string]string{
+			{
+				"status": fmt.Sprintf("%d", code),
+				"title":  msg,
+			},
+		},
+	})
+}
+
+func (s *Server) listApps() (int, interface{}, error) {
+	res := &arukas.AppListData{Data: []*arukas.App{}}
+	for _, app := range s.apps {
+		res.Data = append(res.Data, app)
+		state := s.services[app.ServiceID()]
+		s.advance(state)
+		res.Included = append(res.Included, state.service)
+	}
+	return http.StatusOK, res, nil
+}
+
+func (s *Server) createApp(r *http.Request) (int, interface{}, error) {
+	var req arukas.AppData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	if req.Data == nil || req.Data.Attributes == nil || req.Data.Attributes.Name == "" {
+		return http.StatusUnprocessableEntity, nil, fmt.Errorf("name is required")
+	}
+	if len(req.Included) == 0 {
+		return http.StatusUnprocessableEntity, nil, fmt.Errorf("service is required")
+	}
+
+	var service arukas.Service
+	data, err := json.Marshal(req.Included[0])
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	if err := json.Unmarshal(data, &service); err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	if service.Attributes == nil {
+		return http.StatusUnprocessableEntity, nil, fmt.Errorf("service attributes are required")
+	}
+
+	now := time.Now()
+	appID := uuid.New().String()
+	serviceID := uuid.New().String()
+
+	app := &arukas.App{
+		ID:   appID,
+		Type: arukas.TypeApps,
+		Attributes: &arukas.AppAttr{
+			Name:      req.Data.Attributes.Name,
+			CreatedAt: &now,
+			UpdatedAt: &now,
+		},
+		Relationships: &arukas.AppRelationship{
+			Services: &arukas.RelationshipDataList{
+				Data: []*arukas.Relationship{
+					{
+						ID:   serviceID,
+						Type: arukas.TypeServices,
+					},
+				},
+			},
+		},
+	}
+
+	service.ID = serviceID
+	service.Type = arukas.TypeServices
+	service.LinkID = 0
+	service.Attributes.AppID = appID
+	service.Attributes.Status = StatusCreating
+	service.Attributes.CreatedAt = &now
+	service.Attributes.UpdatedAt = &now
+	if service.Relationships == nil {
+		service.Relationships = &arukas.ServiceRelationship{}
+	}
+	service.Relationships.App = &arukas.RelationshipData{
+		Data: &arukas.Relationship{ID: appID, Type: arukas.TypeApps},
+	}
+
+	s.apps[appID] = app
+	s.services[serviceID] = &serviceState{service: &service, changedAt: now}
+
+	return http.StatusCreated, &arukas.AppData{
+		Data:     app,
+		Included: []interface{}{&service},
+	}, nil
+}
+
+func (s *Server) readApp(id string) (int, interface{}, error) {
+	app, ok := s.apps[id]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("app %q is not found", id)
+	}
+	state := s.services[app.ServiceID()]
+	s.advance(state)
+	return http.StatusOK, &arukas.AppData{
+		Data:     app,
+		Included: []interface{}{state.service},
+	}, nil
+}
+
+func (s *Server) deleteApp(id string) (int, interface{}, error) {
+	app, ok := s.apps[id]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("app %q is not found", id)
+	}
+	serviceID := app.ServiceID()
+	if err := s.stop(s.services[serviceID]); err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	delete(s.apps, id)
+	delete(s.services, serviceID)
+	return http.StatusNoContent, nil, nil
+}
+
+func (s *Server) listServices() (int, interface{}, error) {
+	res := &arukas.ServiceListData{Data: []*arukas.Service{}}
+	for _, state := range s.services {
+		s.advance(state)
+		res.Data = append(res.Data, state.service)
+	}
+	return http.StatusOK, res, nil
+}
+
+func (s *Server) readService(id string) (int, interface{}, error) {
+	state, ok := s.services[id]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("service %q is not found", id)
+	}
+	s.advance(state)
+	return http.StatusOK, &arukas.ServiceData{Data: state.service}, nil
+}
+
+func (s *Server) updateService(id string, r *http.Request) (int, interface{}, error) {
+	state, ok := s.services[id]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("service %q is not found", id)
+	}
+
+	var req arukas.ServiceData
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	if req.Data == nil || req.Data.Attributes == nil {
+		return http.StatusUnprocessableEntity, nil, fmt.Errorf("service attributes are required")
+	}
+
+	now := time.Now()
+	attr := state.service.Attributes
+	attr.Image = req.Data.Attributes.Image
+	attr.Instances = req.Data.Attributes.Instances
+	attr.Command = req.Data.Attributes.Command
+	attr.Ports = req.Data.Attributes.Ports
+	attr.Environment = req.Data.Attributes.Environment
+	attr.SubDomain = req.Data.Attributes.SubDomain
+	attr.UpdatedAt = &now
+	if req.Data.Relationships != nil && req.Data.Relationships.ServicePlan != nil {
+		state.service.Relationships.ServicePlan = req.Data.Relationships.ServicePlan
+	}
+
+	s.advance(state)
+	return http.StatusOK, &arukas.ServiceData{Data: state.service}, nil
+}
+
+func (s *Server) powerOn(id string) (int, interface{}, error) {
+	state, ok := s.services[id]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("service %q is not found", id)
+	}
+	s.advance(state)
+
+	attr := state.service.Attributes
+	switch attr.Status {
+	case arukas.StatusStopped:
+	case StatusCreating:
+		return http.StatusConflict, nil, fmt.Errorf("service %q is being created", id)
+	default:
+		return http.StatusConflict, nil, fmt.Errorf("service %q is already powered on", id)
+	}
+
+	portMappings := s.dummyPortMappings(state.service)
+	if s.Launcher != nil {
+		pm, err := s.Launcher.Launch(state.service)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		portMappings = pm
+	}
+
+	attr.PortMappings = [][]*arukas.PortMapping{portMappings}
+	s.setStatus(state, arukas.StatusBooting)
+	s.advance(state)
+	return http.StatusAccepted, &arukas.ServiceData{Data: state.service}, nil
+}
+
+func (s *Server) powerOff(id string) (int, interface{}, error) {
+	state, ok := s.services[id]
+	if !ok {
+		return http.StatusNotFound, nil, fmt.Errorf("service %q is not found", id)
+	}
+	if err := s.stop(state); err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	return http.StatusAccepted, &arukas.ServiceData{Data: state.service}, nil
+}
+
+func (s *Server) stop(state *serviceState) error {
+	s.advance(state)
+	switch state.service.Attributes.Status {
+	case arukas.StatusBooting, arukas.StatusRunning:
+		if s.Launcher != nil {
+			if err := s.Launcher.Stop(state.service.ID); err != nil {
+				return err
+			}
+		}
+		state.service.Attributes.PortMappings = nil
+		s.setStatus(state, arukas.StatusStopped)
+	}
+	return nil
+}
+
+func (s *Server) setStatus(state *serviceState, status string) {
+	now := time.Now()
+	state.service.Attributes.Status = status
+	state.service.Attributes.UpdatedAt = &now
+	state.changedAt = now
+}
+
+// advance updates status of the service according to elapsed time
+func (s *Server) advance(state *serviceState) {
+	elapsed := time.Since(state.changedAt)
+	switch state.service.Attributes.Status {
+	case StatusCreating:
+		if elapsed >= s.CreateDelay {
+			s.setStatus(state, arukas.StatusStopped)
+		}
+	case arukas.StatusBooting:
+		if elapsed >= s.BootDelay {
+			s.setStatus(state, arukas.StatusRunning)
+		}
+	}
+}
+
+func (s *Server) dummyPortMappings(service *arukas.Service) []*arukas.PortMapping {
+	var res []*arukas.PortMapping
+	for i, port := range service.Attributes.Ports {
+		res = append(res, &arukas.PortMapping{
+			Host:          "localhost",
+			Protocol:      port.Protocol,
+			ContainerPort: port.Number,
+			ServicePort:   int32(30000 + i),
+		})
+	}
+	return res
+}
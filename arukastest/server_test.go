@@ -0,0 +1,116 @@
+package arukastest
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yamamoto-febc/go-arukas"
+)
+
+func newTestClient(t *testing.T, s *Server) arukas.Client {
+	client, err := arukas.NewClient(&arukas.ClientParam{
+		APIBaseURL: s.URL + "/api",
+		Token:      "token",
+		Secret:     "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+var testRequestParam = &arukas.RequestParam{
+	Name:  "rarukas-test",
+	Image: "rarukas/rarukas-server:alpine",
+	Plan:  arukas.PlanFree,
+	Ports: []*arukas.Port{
+		{Protocol: "tcp", Number: 2222},
+	},
+	Instances: 1,
+}
+
+func TestServer(t *testing.T) {
+
+	s := NewServer()
+	defer s.Close()
+	s.Token = "token"
+	s.Secret = "secret"
+	s.CreateDelay = 200 * time.Millisecond
+
+	client := newTestClient(t, s)
+
+	app, err := client.CreateApp(testRequestParam)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceID := app.ServiceID()
+
+	t.Run("Service is being created", func(t *testing.T) {
+		service, err := client.ReadService(serviceID)
+		assert.NoError(t, err)
+		assert.Equal(t, StatusCreating, service.Status())
+		assert.Equal(t, app.AppID(), service.AppID())
+		assert.Equal(t, "rarukas/rarukas-server:alpine", service.Image())
+
+		err = client.PowerOn(serviceID)
+		assert.Error(t, err)
+	})
+
+	t.Run("Power on", func(t *testing.T) {
+		time.Sleep(s.CreateDelay)
+		assert.Equal(t, arukas.StatusStopped, s.ServiceStatus(serviceID))
+
+		err := client.PowerOn(serviceID)
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, client.WaitForState(ctx, serviceID, arukas.StatusRunning))
+
+		service, err := client.ReadService(serviceID)
+		assert.NoError(t, err)
+		assert.Len(t, service.PortMapping(), 1)
+		assert.EqualValues(t, 2222, service.PortMapping()[0].ContainerPort)
+	})
+
+	t.Run("Injected error", func(t *testing.T) {
+		s.InjectError(OpReadService, http.StatusInternalServerError)
+		_, err := client.ReadService(serviceID)
+		assert.Error(t, err)
+
+		s.ClearErrors()
+		_, err = client.ReadService(serviceID)
+		assert.NoError(t, err)
+	})
+
+	t.Run("Power off", func(t *testing.T) {
+		err := client.PowerOff(serviceID)
+		assert.NoError(t, err)
+		assert.Equal(t, arukas.StatusStopped, s.ServiceStatus(serviceID))
+	})
+
+	t.Run("Delete app", func(t *testing.T) {
+		err := client.DeleteApp(app.AppID())
+		assert.NoError(t, err)
+		assert.Empty(t, s.Apps())
+
+		_, err = client.ReadApp(app.AppID())
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid credentials", func(t *testing.T) {
+		client, err := arukas.NewClient(&arukas.ClientParam{
+			APIBaseURL: s.URL,
+			Token:      "token",
+			Secret:     "invalid",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.ListApps()
+		assert.Error(t, err)
+	})
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"errors"
@@ -23,12 +25,24 @@ var (
 )
 
 type config struct {
-	publicKey       string
-	command         string
-	healthCheckAddr string
-	healthCheckPort int
-	sshServerAddr   string
-	sshServerPort   int
+	publicKey          string
+	authorizedKeys     string
+	authorizedKeysFile string
+	allowUsers         []string
+	trustedUserCAKeys  string
+	trustedUserCAFile  string
+	runID              string
+	command            string
+	healthCheckAddr    string
+	healthCheckPort    int
+	sshServerAddr      string
+	sshServerPort      int
+	workDir            string
+	allowForwarding    bool
+	acceptEnv          []string
+	hostKey            string
+	hostKeyFile        string
+	serveSubsystem     string
 }
 
 var cfg = &config{}
@@ -39,6 +53,41 @@ var cliFlags = []cli.Flag{
 		EnvVars:     []string{server.RarukasPublicKeyEnv},
 		Destination: &cfg.publicKey,
 	},
+	&cli.StringFlag{
+		Name:        "authorized-keys",
+		Usage:       "Additional keys in authorized_keys format. Options command=, from= and environment= are supported",
+		EnvVars:     []string{server.RarukasAuthorizedKeysEnv},
+		Destination: &cfg.authorizedKeys,
+	},
+	&cli.StringFlag{
+		Name:        "authorized-keys-file",
+		Usage:       `authorized_keys file reloaded on SIGHUP. "%u" and "%h" are replaced with user name and home directory(e.g. "%h/.ssh/authorized_keys")`,
+		EnvVars:     []string{server.RarukasAuthorizedKeysFileEnv},
+		Destination: &cfg.authorizedKeysFile,
+	},
+	&cli.StringSliceFlag{
+		Name:    "allow-users",
+		Usage:   `SSH user allowed to connect. Commands run as local account of the same name. If empty, only "root" is allowed`,
+		EnvVars: []string{server.RarukasAllowUsersEnv},
+	},
+	&cli.StringFlag{
+		Name:        "trusted-user-ca-keys",
+		Usage:       "Public keys of SSH user CA in authorized_keys format. Certificates signed by them are accepted",
+		EnvVars:     []string{server.RarukasTrustedUserCAKeysEnv},
+		Destination: &cfg.trustedUserCAKeys,
+	},
+	&cli.StringFlag{
+		Name:        "trusted-user-ca-keys-file",
+		Usage:       "File of public keys of SSH user CA",
+		EnvVars:     []string{"RARUKAS_TRUSTED_USER_CA_KEYS_FILE"},
+		Destination: &cfg.trustedUserCAFile,
+	},
+	&cli.StringFlag{
+		Name:        "run-id",
+		Usage:       "ID of the run of rarukas. If specified, only certificates issued for the run are accepted",
+		EnvVars:     []string{server.RarukasRunIDEnv},
+		Destination: &cfg.runID,
+	},
 	&cli.StringFlag{
 		Name:        "command",
 		EnvVars:     []string{server.RarukasCommandEnv},
@@ -67,13 +116,45 @@ var cliFlags = []cli.Flag{
 		Value:       server.RarukasDefaultSSHPort,
 		Destination: &cfg.sshServerPort,
 	},
+	&cli.StringFlag{
+		Name:        "work-dir",
+		EnvVars:     []string{"RARUKAS_WORK_DIR"},
+		Destination: &cfg.workDir,
+	},
+	&cli.BoolFlag{
+		Name:        "allow-forwarding",
+		EnvVars:     []string{server.RarukasAllowForwardingEnv},
+		Destination: &cfg.allowForwarding,
+	},
+	&cli.StringSliceFlag{
+		Name:    "accept-env",
+		Usage:   `Pattern of environment variable names accepted from SSH clients. LANG, LC_*, TERM and RARUKAS_* are accepted by default, and names matching pattern starting with "!" are refused. LD_*, BASH_ENV, ENV, PATH and IFS are always refused`,
+		EnvVars: []string{server.RarukasAcceptEnvEnv},
+	},
+	&cli.StringFlag{
+		Name:        "host-key",
+		Usage:       "PEM encoded private host key. If neither --host-key nor --host-key-file is specified, a random key is generated",
+		EnvVars:     []string{server.RarukasHostKeyEnv},
+		Destination: &cfg.hostKey,
+	},
+	&cli.StringFlag{
+		Name:        "host-key-file",
+		Usage:       "Private host key file",
+		EnvVars:     []string{"RARUKAS_HOST_KEY_FILE"},
+		Destination: &cfg.hostKeyFile,
+	},
+	&cli.StringFlag{
+		Name:        server.ServeSubsystemFlag,
+		Hidden:      true,
+		Destination: &cfg.serveSubsystem,
+	},
 }
 
 func (o *config) Validate() error {
 	var err error
 
-	if o.publicKey == "" {
-		err = multierror.Append(err, errors.New("[Option] --public-key is required"))
+	if o.publicKey == "" && o.authorizedKeys == "" && o.authorizedKeysFile == "" && o.trustedUserCAKeys == "" && o.trustedUserCAFile == "" {
+		err = multierror.Append(err, errors.New("[Option] one of --public-key, --authorized-keys, --authorized-keys-file, --trusted-user-ca-keys or --trusted-user-ca-keys-file is required"))
 	}
 	if !(1 <= o.healthCheckPort && o.healthCheckPort <= 65535) {
 		err = multierror.Append(err, errors.New("[Option] --health-check-port is invalid"))
@@ -81,6 +162,23 @@ func (o *config) Validate() error {
 	if !(1 <= o.sshServerPort && o.sshServerPort <= 65535) {
 		err = multierror.Append(err, errors.New("[Option] --ssh-server-port is invalid"))
 	}
+	if o.hostKey != "" && o.hostKeyFile != "" {
+		err = multierror.Append(err, errors.New("[Option] --host-key and --host-key-file can't be specified together"))
+	}
+	if o.hostKeyFile != "" {
+		data, e := ioutil.ReadFile(o.hostKeyFile)
+		if e != nil {
+			err = multierror.Append(err, fmt.Errorf("[Option] --host-key-file is invalid: %s", e))
+		}
+		o.hostKey = string(data)
+	}
+	if o.trustedUserCAFile != "" {
+		data, e := ioutil.ReadFile(o.trustedUserCAFile)
+		if e != nil {
+			err = multierror.Append(err, fmt.Errorf("[Option] --trusted-user-ca-keys-file is invalid: %s", e))
+		}
+		o.trustedUserCAKeys += "\n" + string(data)
+	}
 	return err
 }
 
@@ -122,20 +220,43 @@ func cmdNotFound(c *cli.Context, command string) {
 
 func cmdMain(c *cli.Context) error {
 
+	if cfg.serveSubsystem != "" {
+		// rarukas-server runs itself to serve subsystem as the account of SSH user
+		return server.ServeSubsystem(cfg.serveSubsystem, cfg.workDir)
+	}
+
+	cfg.acceptEnv = c.StringSlice("accept-env")
+	cfg.allowUsers = c.StringSlice("allow-users")
 	err := cfg.Validate()
 	if err != nil {
 		return err
 	}
 
+	// settings such as the host key must not leak to commands run as SSH users
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, server.RarukasEnvPrefix) {
+			os.Unsetenv(strings.SplitN(kv, "=", 2)[0]) // nolint
+		}
+	}
+
 	log.Println("[INFO] Start rarukas-server")
 
 	serverConfig := &server.Config{
-		PublicKey:       cfg.publicKey,
-		Command:         cfg.command,
-		HealthCheckAddr: cfg.healthCheckAddr,
-		HealthCheckPort: cfg.healthCheckPort,
-		SSHServerAddr:   cfg.sshServerAddr,
-		SSHServerPort:   cfg.sshServerPort,
+		PublicKey:          cfg.publicKey,
+		AuthorizedKeys:     cfg.authorizedKeys,
+		AuthorizedKeysFile: cfg.authorizedKeysFile,
+		AllowUsers:         cfg.allowUsers,
+		TrustedUserCAKeys:  cfg.trustedUserCAKeys,
+		RunID:              cfg.runID,
+		Command:            cfg.command,
+		HealthCheckAddr:    cfg.healthCheckAddr,
+		HealthCheckPort:    cfg.healthCheckPort,
+		SSHServerAddr:      cfg.sshServerAddr,
+		SSHServerPort:      cfg.sshServerPort,
+		WorkDir:            cfg.workDir,
+		AllowForwarding:    cfg.allowForwarding,
+		AcceptEnv:          cfg.acceptEnv,
+		HostKey:            cfg.hostKey,
 	}
 
 	// Setup signal handler
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/rarukas/rarukas/runner"
+	"github.com/rarukas/rarukas/tarstream"
+	"gopkg.in/urfave/cli.v2"
+)
+
+var commands = []*cli.Command{
+	{
+		Name:      "run",
+		Usage:     "Run command on temporary rarukas-server (same as running without subcommand)",
+		ArgsUsage: "[command...]",
+		Flags:     cliFlags,
+		Action:    cmdMain,
+	},
+	{
+		Name:  "shell",
+		Usage: "Start interactive shell on temporary rarukas-server",
+		Flags: flagsByName(
+			"config", "profile", "provider", "local-server-bin",
+			"target", "target-private-key", "target-private-key-file", "target-work-dir", "target-known-hosts",
+			"token", "secret", "api-url", "debug", "public-key", "private-key",
+			"authorized-keys-file", "user-ca-key", "allow-forwarding",
+			"arukas-name", "arukas-plan", "image-type", "image-name",
+			"env", "env-file", "secret-env", "secret-file", "sync-dir", "sync", "download-only", "upload-only", "download-policy",
+			"exclude", "include", "download-exclude", "download-include", "download-merge", "stream",
+			"local-forward", "dynamic-forward", "remote-forward", "boot-timeout", "exec-timeout", "status-file",
+		),
+		Action: cmdShell,
+	},
+	{
+		Name:  "up",
+		Usage: "Start rarukas-server and keep it running as session",
+		Flags: flagsByName(
+			"config", "profile", "token", "secret", "api-url", "debug",
+			"public-key", "private-key", "arukas-name", "arukas-plan",
+			"image-type", "image-name", "allow-forwarding", "authorized-keys-file", "user-ca-key", "boot-timeout", "state-dir",
+		),
+		Action: cmdUp,
+	},
+	{
+		Name:      "exec",
+		Usage:     "Run command on rarukas-server of the session",
+		ArgsUsage: "[command...]",
+		Flags: flagsByName(
+			"config", "profile", "arukas-name", "state-dir",
+			"command-file", "job-file", "env", "env-file", "secret-env", "secret-file", "sync-dir", "sync", "download-only", "upload-only", "download-policy",
+			"exclude", "include", "download-exclude", "download-include", "download-merge", "stream",
+			"artifact", "artifact-dir", "artifact-archive", "artifact-missing", "dry-run", "tty",
+			"local-forward", "dynamic-forward", "remote-forward", "exec-timeout", "status-file",
+		),
+		Action: cmdExec,
+	},
+	{
+		Name:      "cp",
+		Usage:     "Copy files between local and rarukas-server of the session",
+		ArgsUsage: "[src] [dest] (prefix remote path with ':', e.g. 'rarukas cp foo.txt :dir')",
+		Flags:     flagsByName("config", "profile", "arukas-name", "state-dir", "exec-timeout"),
+		Action:    cmdCp,
+	},
+	{
+		Name:  "down",
+		Usage: "Delete rarukas-server of the session",
+		Flags: flagsByName(
+			"config", "profile", "token", "secret", "api-url", "debug",
+			"arukas-name", "state-dir", "force",
+		),
+		Action: cmdDown,
+	},
+	{
+		Name:   "ls",
+		Usage:  "List sessions",
+		Flags:  flagsByName("config", "profile", "state-dir"),
+		Action: cmdLs,
+	},
+	{
+		Name:      "ca",
+		Usage:     "Issue short-lived SSH user certificate accepted by rarukas-server of the session or the run",
+		ArgsUsage: "[public key file] (certificate is written to <name>-cert.pub like ssh-keygen)",
+		Flags: flagsByName(
+			"config", "profile", "arukas-name", "state-dir",
+			"ca-key", "run-id", "principal", "validity",
+		),
+		Action: cmdCA,
+	},
+}
+
+func cmdUp(c *cli.Context) error {
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+	if err := cfg.ValidateUp(); err != nil {
+		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
+		return err
+	}
+
+	store, err := cfg.sessionStore()
+	if err != nil {
+		return err
+	}
+	if _, err := store.Load(cfg.arukasName); err != runner.ErrSessionNotFound {
+		if err == nil {
+			err = fmt.Errorf("Session %q already exists", cfg.arukasName)
+		}
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+
+	arukasClient, err := newArukasClient()
+	if err != nil {
+		return err
+	}
+	runnerConfig := &runner.Config{
+		ArukasClient:      arukasClient,
+		ArukasName:        cfg.arukasName,
+		ArukasPlan:        cfg.arukasPlan,
+		RarukasImageType:  cfg.rarukasImageType,
+		ArukasImageName:   cfg.rarukasImageName,
+		PublicKey:         cfg.publicKey,
+		PrivateKey:        cfg.privateKey,
+		AuthorizedKeys:    cfg.authorizedKeys,
+		TrustedUserCAKeys: cfg.trustedUserCAKeys,
+		AllowForwarding:   cfg.allowForwarding,
+		BootTimeout:       cfg.bootTimeout,
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	session, err := runner.Up(ctx, runnerConfig)
+	if err != nil {
+		log.Printf("[ERROR] Starting session failed\n%s", err)
+		return err
+	}
+	if err := store.Save(session); err != nil {
+		log.Printf("[ERROR] Saving session failed\n%s", err)
+		if err := runner.Down(ctx, runnerConfig, session); err != nil {
+			log.Printf("[ERROR] Deleting rarukas-server failed\n%s", err)
+		}
+		return err
+	}
+
+	log.Printf("[INFO] Session %q is up(app: %s, address: %s:%d)", session.Name, session.AppID, session.Host, session.Port)
+	return nil
+}
+
+func cmdExec(c *cli.Context) error {
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+
+	cfg.commands = c.Args().Slice()
+	cfg.readSliceFlags(c)
+	if len(cfg.commands) == 0 && cfg.commandFile == "" && cfg.jobFile == "" {
+		return cli.ShowCommandHelp(c, c.Command.Name)
+	}
+	if err := cfg.ValidateExec(); err != nil {
+		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
+		return err
+	}
+	if len(cfg.secrets) > 0 {
+		log.SetOutput(runner.MaskSecrets(log.Writer(), cfg.secrets))
+	}
+
+	session, err := cfg.loadSession()
+	if err != nil {
+		return err
+	}
+
+	runnerConfig := &runner.Config{
+		ArukasName:            session.Name,
+		CommandFile:           cfg.commandFile,
+		SyncDir:               cfg.syncDir,
+		Syncs:                 cfg.syncs,
+		Env:                   cfg.env,
+		Secrets:               cfg.secrets,
+		UploadOnly:            cfg.uploadOnly,
+		DownloadOnly:          cfg.downloadOnly,
+		TTY:                   cfg.tty,
+		Excludes:              cfg.excludes,
+		Includes:              cfg.includes,
+		DownloadExcludes:      cfg.downloadExcludes,
+		DownloadIncludes:      cfg.downloadIncludes,
+		DownloadPolicy:        runner.DownloadPolicy(cfg.downloadPolicy),
+		MergeStrategy:         runner.MergeStrategy(cfg.downloadMerge),
+		Stream:                tarstream.Compression(cfg.stream),
+		Artifacts:             cfg.artifacts,
+		ArtifactDir:           cfg.artifactDir,
+		ArtifactArchive:       cfg.artifactArchive,
+		FailOnMissingArtifact: cfg.artifactMissing == artifactMissingError,
+		DryRun:                cfg.dryRun,
+		LocalForwards:         cfg.localForwards,
+		DynamicForwards:       cfg.dynamicForwards,
+		RemoteForwards:        cfg.remoteForwards,
+		ExecTimeout:           cfg.execTimeout,
+		Commands:              cfg.commands,
+		Job:                   cfg.job,
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if err := runner.Exec(ctx, runnerConfig, session); err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+	return nil
+}
+
+func cmdCp(c *cli.Context) error {
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+
+	if c.NArg() != 2 {
+		return cli.ShowCommandHelp(c, c.Command.Name)
+	}
+	src, dest := c.Args().Get(0), c.Args().Get(1)
+	srcIsRemote, destIsRemote := strings.HasPrefix(src, ":"), strings.HasPrefix(dest, ":")
+	if srcIsRemote == destIsRemote {
+		err := errors.New("[Argument] Either src or dest must be remote path starting with ':'")
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+	if err := cfg.validateRequired("arukas-name", cfg.arukasName); err != nil {
+		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
+		return err
+	}
+
+	session, err := cfg.loadSession()
+	if err != nil {
+		return err
+	}
+
+	runnerConfig := &runner.Config{
+		ArukasName:  session.Name,
+		ExecTimeout: cfg.execTimeout,
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if destIsRemote {
+		err = runner.CopyTo(ctx, runnerConfig, session, src, strings.TrimPrefix(dest, ":"))
+	} else {
+		err = runner.CopyFrom(ctx, runnerConfig, session, strings.TrimPrefix(src, ":"), dest)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Copying files failed\n%s", err)
+	}
+	return err
+}
+
+func cmdDown(c *cli.Context) error {
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+	if err := cfg.ValidateDown(); err != nil {
+		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
+		return err
+	}
+
+	store, err := cfg.sessionStore()
+	if err != nil {
+		return err
+	}
+	session, err := cfg.loadSession()
+	if err != nil {
+		return err
+	}
+
+	arukasClient, err := newArukasClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	err = runner.Down(ctx, &runner.Config{ArukasClient: arukasClient}, session)
+	if err != nil {
+		log.Printf("[ERROR] Deleting rarukas-server failed\n%s", err)
+		if !cfg.force {
+			return err
+		}
+		log.Printf("[INFO] Removing session %q because --force is specified", session.Name)
+	}
+
+	if err := store.Delete(session.Name); err != nil {
+		log.Printf("[ERROR] Removing session failed\n%s", err)
+		return err
+	}
+	if err == nil {
+		log.Printf("[INFO] Session %q is down", session.Name)
+	}
+	return err
+}
+
+func cmdLs(c *cli.Context) error {
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+
+	store, err := cfg.sessionStore()
+	if err != nil {
+		return err
+	}
+	sessions, err := store.List()
+	if err != nil {
+		log.Printf("[ERROR] Listing sessions failed\n%s", err)
+		return err
+	}
+
+	now := time.Now()
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tAPP-ID\tADDRESS\tPLAN\tIMAGE\tAGE\tEST.COST") // nolint
+	for _, s := range sessions {
+		image := s.ImageName
+		if image == "" {
+			image = s.ImageType
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s:%d\t%s\t%s\t%s\t%.0f JPY\n", // nolint
+			s.Name, s.AppID, s.Host, s.Port, s.Plan, image, s.Age(now).Round(time.Second), s.EstimatedCost(now))
+	}
+	w.Flush() // nolint
+	fmt.Print(buf.String())
+	return nil
+}
+
+func cmdCA(c *cli.Context) error {
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+	if c.Args().Len() != 1 {
+		return cli.ShowCommandHelp(c, c.Command.Name)
+	}
+	publicKeyFile := c.Args().First()
+	cfg.principals = c.StringSlice("principal")
+	if len(cfg.principals) == 0 {
+		cfg.principals = []string{"root"}
+	}
+	if err := cfg.ValidateCA(publicKeyFile); err != nil {
+		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
+		return err
+	}
+
+	runID := cfg.runID
+	if runID == "" {
+		session, err := cfg.loadSession()
+		if err != nil {
+			return err
+		}
+		if session.RunID == "" {
+			err := fmt.Errorf("Session %q doesn't trust SSH user CA. Start it with 'rarukas up --user-ca-key'", session.Name)
+			log.Printf("[ERROR] %s", err)
+			return err
+		}
+		runID = session.RunID
+	}
+
+	caKeyPath, err := homedir.Expand(cfg.caKey)
+	if err != nil {
+		log.Printf("[ERROR] %s", err)
+		return err
+	}
+	caKey, err := ioutil.ReadFile(caKeyPath)
+	if err != nil {
+		log.Printf("[ERROR] Reading CA key failed\n%s", err)
+		return err
+	}
+	publicKey, err := ioutil.ReadFile(publicKeyFile)
+	if err != nil {
+		log.Printf("[ERROR] Reading public key failed\n%s", err)
+		return err
+	}
+	cert, err := runner.IssueUserCert(&runner.UserCertParam{
+		CAKey:      string(caKey),
+		PublicKey:  string(publicKey),
+		Principals: cfg.principals,
+		RunID:      runID,
+		Validity:   cfg.validity,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Issuing certificate failed\n%s", err)
+		return err
+	}
+
+	certFile := strings.TrimSuffix(publicKeyFile, ".pub") + "-cert.pub"
+	if err := ioutil.WriteFile(certFile, cert, 0644); err != nil {
+		log.Printf("[ERROR] Writing certificate failed\n%s", err)
+		return err
+	}
+	log.Printf("[INFO] Certificate for run %q is written to %q(principals: %s, valid until %s)",
+		runID, certFile, strings.Join(cfg.principals, ","), time.Now().Add(cfg.validity).Format(time.RFC3339))
+	return nil
+}
+
+func (c *config) sessionStore() (*runner.SessionStore, error) {
+	dir, err := homedir.Expand(c.stateDir)
+	if err != nil {
+		err = c.optionErrorf("state-dir", "(%q) is invalid path", c.stateDir)
+		log.Printf("[ERROR] %s", err)
+		return nil, err
+	}
+	return runner.NewSessionStore(dir), nil
+}
+
+func (c *config) loadSession() (*runner.Session, error) {
+	store, err := c.sessionStore()
+	if err != nil {
+		return nil, err
+	}
+	session, err := store.Load(c.arukasName)
+	if err != nil {
+		if err == runner.ErrSessionNotFound {
+			err = fmt.Errorf("Session %q is not found in %q. Run 'rarukas up' first", c.arukasName, store.Dir)
+		}
+		log.Printf("[ERROR] %s", err)
+		return nil, err
+	}
+	return session, nil
+}
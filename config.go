@@ -6,18 +6,42 @@ import (
 	"errors"
 	"github.com/hashicorp/go-multierror"
 	"github.com/mitchellh/go-homedir"
+	"github.com/rarukas/rarukas/manifest"
 	"github.com/rarukas/rarukas/runner"
+	"github.com/rarukas/rarukas/tarstream"
 	"github.com/yamamoto-febc/go-arukas"
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/urfave/cli.v2"
+	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type config struct {
+	configFile string
+	profile    string
+	// sources has the source(flag/env/config file) of each option value
+	sources map[string]string
+	// fromConfigFile has options whose values are read from config file
+	fromConfigFile map[string]bool
+
+	provider       string
+	localServerBin string
+
+	target               string
+	targetPrivateKey     string
+	targetPrivateKeyFile string
+	targetWorkDir        string
+	targetKnownHosts     string
+
 	accessToken       string
 	accessTokenSecret string
+	apiURL            string
 	traceMode         bool
 
 	publicKey  string
@@ -31,17 +55,150 @@ type config struct {
 
 	commands     []string
 	commandFile  string
+	jobFile      string
+	job          *runner.Job
 	syncDir      string
 	downloadOnly bool
 	uploadOnly   bool
+	tty          bool
+
+	syncSpecs []string
+	syncs     []*runner.SyncMapping
+
+	envSpecs []string
+	envFiles []string
+	env      map[string]string
+
+	secretEnvSpecs  []string
+	secretFileSpecs []string
+	secrets         []*runner.Secret
+
+	downloadPolicy   string
+	excludes         []string
+	includes         []string
+	downloadExcludes []string
+	downloadIncludes []string
+	downloadMerge    string
+	stream           string
+	dryRun           bool
+
+	artifacts       []string
+	artifactDir     string
+	artifactArchive string
+	artifactMissing string
+
+	localForwardSpecs   []string
+	localForwards       []*runner.LocalForward
+	dynamicForwardSpecs []string
+	dynamicForwards     []*runner.DynamicForward
+	remoteForwardSpecs  []string
+	remoteForwards      []*runner.RemoteForward
+	allowForwarding     bool
 
 	bootTimeout time.Duration
 	execTimeout time.Duration
+
+	stateDir string
+	force    bool
+	// authorizedKeys is content of authorizedKeysFile
+	authorizedKeysFile string
+	authorizedKeys     string
+	// trustedUserCAKeys is content of userCAKey
+	userCAKey         string
+	trustedUserCAKeys string
+
+	// options of ca command
+	caKey      string
+	runID      string
+	principals []string
+	validity   time.Duration
+
+	parallel        int
+	matrixExprs     []string
+	matrix          *runner.Matrix
+	matrixResultDir string
+
+	// statusFile is path to write exit status of rarukas as JSON
+	statusFile string
 }
 
 var cfg = &config{}
 
+const (
+	providerArukas = "arukas"
+	providerLocal  = "local"
+	providerStatic = "static"
+)
+
+var validProviders = []string{providerArukas, providerLocal, providerStatic}
+
+const (
+	artifactMissingWarn  = "warn"
+	artifactMissingError = "error"
+)
+
+var validArtifactMissing = []string{artifactMissingWarn, artifactMissingError}
+
 var cliFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "config",
+		Usage:       fmt.Sprintf("Path to config file. If empty, search %s from current directory upward", strings.Join(configFileNames, "/")),
+		EnvVars:     []string{"RARUKAS_CONFIG"},
+		Destination: &cfg.configFile,
+	},
+	&cli.StringFlag{
+		Name:        "profile",
+		Usage:       "Name of profile in config file",
+		EnvVars:     []string{"RARUKAS_PROFILE"},
+		Destination: &cfg.profile,
+	},
+	&cli.StringFlag{
+		Name: "provider",
+		Usage: fmt.Sprintf("Provider of the host running rarukas-server [%s]",
+			strings.Join(validProviders, "/"),
+		),
+		EnvVars:     []string{"RARUKAS_PROVIDER"},
+		Value:       providerArukas,
+		Destination: &cfg.provider,
+	},
+	&cli.StringFlag{
+		Name:        "local-server-bin",
+		Usage:       "Path to rarukas-server binary used by local provider. If empty, start rarukas-server in-process",
+		EnvVars:     []string{"RARUKAS_LOCAL_SERVER_BIN"},
+		Destination: &cfg.localServerBin,
+	},
+	&cli.StringFlag{
+		Name:        "target",
+		Usage:       "Address(host:port) of existing rarukas-server. If specified, use static provider",
+		EnvVars:     []string{"RARUKAS_TARGET"},
+		Destination: &cfg.target,
+	},
+	&cli.StringFlag{
+		Name:        "target-private-key",
+		Usage:       "Private key for SSH auth to existing rarukas-server",
+		EnvVars:     []string{"RARUKAS_TARGET_PRIVATE_KEY"},
+		Destination: &cfg.targetPrivateKey,
+	},
+	&cli.StringFlag{
+		Name:        "target-private-key-file",
+		Usage:       "Private key file for SSH auth to existing rarukas-server",
+		EnvVars:     []string{"RARUKAS_TARGET_PRIVATE_KEY_FILE"},
+		Destination: &cfg.targetPrivateKeyFile,
+	},
+	&cli.StringFlag{
+		Name:        "target-work-dir",
+		Usage:       "Working directory on existing rarukas-server",
+		EnvVars:     []string{"RARUKAS_TARGET_WORK_DIR"},
+		Value:       runner.RarukasServerWorkDir,
+		Destination: &cfg.targetWorkDir,
+	},
+	&cli.StringFlag{
+		Name:        "target-known-hosts",
+		Usage:       "known_hosts file to verify host key of existing rarukas-server",
+		EnvVars:     []string{"RARUKAS_TARGET_KNOWN_HOSTS"},
+		Value:       "~/.ssh/known_hosts",
+		Destination: &cfg.targetKnownHosts,
+	},
 	&cli.StringFlag{
 		Name:        "token",
 		Usage:       "API Token of Arukas",
@@ -54,6 +211,12 @@ var cliFlags = []cli.Flag{
 		EnvVars:     []string{"ARUKAS_JSON_API_SECRET"},
 		Destination: &cfg.accessTokenSecret,
 	},
+	&cli.StringFlag{
+		Name:        "api-url",
+		Usage:       "URL of Arukas API. If empty, use default URL",
+		EnvVars:     []string{"ARUKAS_JSON_API_URL"},
+		Destination: &cfg.apiURL,
+	},
 	&cli.BoolFlag{
 		Name:        "debug",
 		Usage:       "Flag of debug-mode",
@@ -74,6 +237,23 @@ var cliFlags = []cli.Flag{
 		EnvVars:     []string{"RARUKAS_PRIVATE_KEY"},
 		Destination: &cfg.privateKey,
 	},
+	&cli.StringFlag{
+		Name:        "authorized-keys-file",
+		Usage:       "authorized_keys file of additional keys allowed to connect to rarukas-server(e.g. keys of teammates)",
+		EnvVars:     []string{"RARUKAS_AUTHORIZED_KEYS_FILE"},
+		Destination: &cfg.authorizedKeysFile,
+	},
+	&cli.StringFlag{
+		Name:        "user-ca-key",
+		Usage:       "Public key file of SSH user CA trusted by rarukas-server. Certificates issued by ca command for the run or the session are accepted",
+		EnvVars:     []string{"RARUKAS_USER_CA_KEY"},
+		Destination: &cfg.userCAKey,
+	},
+	&cli.BoolFlag{
+		Name:        "allow-forwarding",
+		Usage:       "Enable port forwarding on rarukas-server without port forwarding options. It is required to use them with exec command of the session",
+		Destination: &cfg.allowForwarding,
+	},
 	&cli.StringFlag{
 		Name:        "arukas-name",
 		Aliases:     []string{"name"},
@@ -116,12 +296,41 @@ var cliFlags = []cli.Flag{
 		EnvVars:     []string{"RARUKAS_COMMAND_FILE"},
 		Destination: &cfg.commandFile,
 	},
+	&cli.StringFlag{
+		Name:        "job-file",
+		Aliases:     []string{"j"},
+		Usage:       "Job file(YAML) that defines multiple steps to run on Arukas",
+		EnvVars:     []string{"RARUKAS_JOB_FILE"},
+		Destination: &cfg.jobFile,
+	},
+	&cli.StringSliceFlag{
+		Name:  "env",
+		Usage: "Environment variable passed to the command(KEY=VALUE, or KEY to pass the value of local environment). It can be specified multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name:  "env-file",
+		Usage: "File that has KEY=VALUE or KEY per line passed to the command as environment variables. It can be specified multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name: "secret-env",
+		Usage: "Secret environment variable passed to the command only over SSH and masked in output(NAME, or NAME=SOURCE). " +
+			"SOURCE is env:VAR, file:PATH or cmd:COMMAND(default: env:NAME). It can be specified multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name: "secret-file",
+		Usage: "Secret file written on tmpfs of rarukas-server and wiped after the command(NAME=SOURCE). NAME has the path to the file. " +
+			"SOURCE is env:VAR, file:PATH or cmd:COMMAND(default: file:PATH). It can be specified multiple times",
+	},
 	&cli.StringFlag{
 		Name:        "sync-dir",
 		Usage:       "Directory to synchronize Arukas working directory",
 		EnvVars:     []string{"RARUKAS_SYNC_DIR"},
 		Destination: &cfg.syncDir,
 	},
+	&cli.StringSliceFlag{
+		Name:  "sync",
+		Usage: "Mapping of local directory and directory on Arukas(local:remote[:mode], mode is up/down/both). Relative remote path is resolved from working directory. It can be specified multiple times",
+	},
 	&cli.BoolFlag{
 		Name:        "download-only",
 		Usage:       "Enable downloading only in synchronization with Arukas working directory",
@@ -134,6 +343,115 @@ var cliFlags = []cli.Flag{
 		EnvVars:     []string{"RARUKAS_UPLOAD_ONLY"},
 		Destination: &cfg.uploadOnly,
 	},
+	&cli.StringFlag{
+		Name: "download-policy",
+		Usage: fmt.Sprintf("When sync-dir and artifacts are downloaded [%s]. With always, they are downloaded even if the command failed, timed out or was interrupted",
+			strings.Join(runner.DownloadPolicies, "/"),
+		),
+		EnvVars:     []string{"RARUKAS_DOWNLOAD_POLICY"},
+		Value:       string(runner.DownloadOnSuccess),
+		Destination: &cfg.downloadPolicy,
+	},
+	&cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: fmt.Sprintf("Pattern(gitignore syntax) of files in sync-dir excluded from upload and download, in addition to %s. It can be specified multiple times", runner.IgnoreFileName),
+	},
+	&cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "Pattern(gitignore syntax) of files in sync-dir re-included after excluded. It can be specified multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name:  "download-exclude",
+		Usage: fmt.Sprintf("Pattern(gitignore syntax) of files excluded from download only, in addition to %s. It can be specified multiple times", runner.DownloadIgnoreFileName),
+	},
+	&cli.StringSliceFlag{
+		Name:  "download-include",
+		Usage: "Pattern(gitignore syntax) of files re-included in download after excluded. It can be specified multiple times",
+	},
+	&cli.StringFlag{
+		Name: "download-merge",
+		Usage: fmt.Sprintf("How to merge downloaded files into sync-dir [%s]. Replaced or deleted local files are backed up into %s/<timestamp>-<run ID> in sync-dir",
+			strings.Join(runner.MergeStrategies, "/"), runner.BackupDirName,
+		),
+		EnvVars:     []string{"RARUKAS_DOWNLOAD_MERGE"},
+		Value:       string(runner.MergeMirror),
+		Destination: &cfg.downloadMerge,
+	},
+	&cli.StringFlag{
+		Name: "stream",
+		Usage: fmt.Sprintf("Transfer files as a compressed tar stream over one SSH connection [%s]. If empty, files are transferred one by one with SFTP",
+			strings.Join(tarstream.Compressions, "/"),
+		),
+		EnvVars:     []string{"RARUKAS_STREAM"},
+		Destination: &cfg.stream,
+	},
+	&cli.StringSliceFlag{
+		Name:  "artifact",
+		Usage: "Glob(*, ?, ** and [...]) of files in workdir downloaded after the command finished, keeping their relative paths. It can be specified multiple times",
+	},
+	&cli.StringFlag{
+		Name:        "artifact-dir",
+		Usage:       "Directory to save artifacts. If both --artifact-dir and --artifact-archive are empty, current directory is used",
+		EnvVars:     []string{"RARUKAS_ARTIFACT_DIR"},
+		Destination: &cfg.artifactDir,
+	},
+	&cli.StringFlag{
+		Name:        "artifact-archive",
+		Usage:       fmt.Sprintf("Archive file to pack artifacts into [%s]", strings.Join(runner.ArtifactArchiveExts, "/")),
+		EnvVars:     []string{"RARUKAS_ARTIFACT_ARCHIVE"},
+		Destination: &cfg.artifactArchive,
+	},
+	&cli.StringFlag{
+		Name:        "artifact-missing",
+		Usage:       fmt.Sprintf("How to handle artifacts matching no file [%s]", strings.Join(validArtifactMissing, "/")),
+		EnvVars:     []string{"RARUKAS_ARTIFACT_MISSING"},
+		Value:       artifactMissingWarn,
+		Destination: &cfg.artifactMissing,
+	},
+	&cli.BoolFlag{
+		Name:        "dry-run",
+		Usage:       "Print files to be transferred with sync-dir and sync instead of running the command",
+		EnvVars:     []string{"RARUKAS_DRY_RUN"},
+		Destination: &cfg.dryRun,
+	},
+	&cli.BoolFlag{
+		Name:        "tty",
+		Aliases:     []string{"t"},
+		Usage:       "Allocate pseudo-TTY for interactive command. Local terminal is put in raw mode while running",
+		Destination: &cfg.tty,
+	},
+	&cli.StringSliceFlag{
+		Name:    "local-forward",
+		Aliases: []string{"L"},
+		Usage:   "Forward local port to host:port via rarukas-server while the command is running([bind_address:]port:host:hostport). It can be specified multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name:    "dynamic-forward",
+		Aliases: []string{"D"},
+		Usage:   "Listen SOCKS5 proxy on local port that connects via rarukas-server while the command is running([bind_address:]port). It can be specified multiple times",
+	},
+	&cli.StringSliceFlag{
+		Name:    "remote-forward",
+		Aliases: []string{"R"},
+		Usage:   "Forward port on rarukas-server to local host:port while the command is running([bind_address:]port:host:hostport). It can be specified multiple times",
+	},
+	&cli.IntFlag{
+		Name:        "parallel",
+		Usage:       "Number of Arukas apps to run the command in parallel",
+		EnvVars:     []string{"RARUKAS_PARALLEL"},
+		Value:       1,
+		Destination: &cfg.parallel,
+	},
+	&cli.StringSliceFlag{
+		Name:  "matrix",
+		Usage: "Combinations of image types and plans to run the command concurrently(e.g. type=alpine,debian). It can be specified multiple times",
+	},
+	&cli.StringFlag{
+		Name:        "matrix-result-dir",
+		Usage:       "Directory to write output and result of each matrix cell",
+		EnvVars:     []string{"RARUKAS_MATRIX_RESULT_DIR"},
+		Destination: &cfg.matrixResultDir,
+	},
 	&cli.DurationFlag{
 		Name:        "boot-timeout",
 		Usage:       "Timeout duration when waiting for container be running",
@@ -148,31 +466,293 @@ var cliFlags = []cli.Flag{
 		Destination: &cfg.execTimeout,
 		Value:       1 * time.Hour,
 	},
+	&cli.StringFlag{
+		Name:        "status-file",
+		Usage:       "Path to file to write exit status as JSON. It tells exit status of the command apart from failures of rarukas",
+		EnvVars:     []string{"RARUKAS_STATUS_FILE"},
+		Destination: &cfg.statusFile,
+	},
 }
 
+// Validate validates options of run command
 func (c *config) Validate() error {
-	var errs error
+	if c.target != "" {
+		c.provider = providerStatic
+	}
 
+	var validators []func() error
+	validators = append(validators, c.providerValidators()...)
+	validators = append(validators, c.serverAccessValidators()...)
+	validators = append(validators, c.commandValidators()...)
+	validators = append(validators, c.fanOutValidators()...)
+	return c.validate(validators...)
+}
+
+// ValidateUp validates options of up command
+func (c *config) ValidateUp() error {
+	// session is supported only on Arukas
+	c.provider = providerArukas
+	validators := append(c.providerValidators(), c.serverAccessValidators()...)
+	return c.validate(validators...)
+}
+
+// ValidateCA validates options of ca command
+func (c *config) ValidateCA(publicKeyFile string) error {
+	return c.validate(
+		func() error { return c.validateRequired("ca-key", c.caKey) },
+		func() error { return c.validateFilePath("ca-key", c.caKey) },
+		func() error {
+			if c.runID == "" {
+				return c.validateRequired("arukas-name", c.arukasName)
+			}
+			return nil
+		},
+		func() error {
+			if c.validity <= 0 {
+				return c.optionErrorf("validity", "(%s) must be positive", c.validity)
+			}
+			return nil
+		},
+		func() error {
+			if _, err := os.Stat(publicKeyFile); err != nil {
+				return fmt.Errorf("Public key file %q is invalid: %s", publicKeyFile, err)
+			}
+			return nil
+		},
+	)
+}
+
+// ValidateExec validates options of exec command
+func (c *config) ValidateExec() error {
 	validators := []func() error{
-		// required
+		func() error { return c.validateRequired("arukas-name", c.arukasName) },
+	}
+	validators = append(validators, c.commandValidators()...)
+	validators = append(validators, func() error {
+		if c.job != nil && c.job.Matrix != nil {
+			return errors.New("[Option] Matrix in --job-file can't be used with exec command")
+		}
+		return nil
+	})
+	return c.validate(validators...)
+}
+
+// ValidateDown validates options of down command
+func (c *config) ValidateDown() error {
+	return c.validate(
+		func() error { return c.validateRequired("arukas-name", c.arukasName) },
 		func() error { return c.validateRequired("token", c.accessToken) },
 		func() error { return c.validateRequired("secret", c.accessTokenSecret) },
-		func() error { return c.validateRequired("arukas-name", c.accessTokenSecret) },
-		func() error { return c.validateRequired("arukas-plan", c.accessTokenSecret) },
-		func() error { return c.validateRequired("arukas-os-type", c.accessTokenSecret) },
+		func() error { return c.validateURL("api-url", c.apiURL) },
+	)
+}
+
+// sessionFlags are flags used only by subcommands for session
+var sessionFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:        "state-dir",
+		Usage:       "Directory to save sessions created by up command",
+		EnvVars:     []string{"RARUKAS_STATE_DIR"},
+		Value:       "~/.rarukas/sessions",
+		Destination: &cfg.stateDir,
+	},
+	&cli.StringFlag{
+		Name:        "ca-key",
+		Usage:       "Private key file of SSH user CA to issue certificates",
+		EnvVars:     []string{"RARUKAS_CA_KEY"},
+		Destination: &cfg.caKey,
+	},
+	&cli.StringFlag{
+		Name:        "run-id",
+		Usage:       "ID of the run to issue certificates for. If empty, use run ID of the session",
+		Destination: &cfg.runID,
+	},
+	&cli.StringSliceFlag{
+		Name:  "principal",
+		Usage: `SSH user allowed to log in with the certificate. If empty, "root" is used`,
+	},
+	&cli.DurationFlag{
+		Name:        "validity",
+		Usage:       "Validity period of the certificate",
+		Value:       time.Hour,
+		Destination: &cfg.validity,
+	},
+	&cli.BoolFlag{
+		Name:        "force",
+		Usage:       "Remove the session even if deleting Arukas app failed",
+		Destination: &cfg.force,
+	},
+}
+
+// flagsByName returns flags which have specified names from cliFlags and sessionFlags
+func flagsByName(names ...string) []cli.Flag {
+	var flags []cli.Flag
+	for _, name := range names {
+		found := false
+		for _, f := range append(cliFlags, sessionFlags...) {
+			if f.Names()[0] == name {
+				flags = append(flags, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			panic(fmt.Sprintf("flag %q is not defined", name))
+		}
+	}
+	return flags
+}
+
+// readSliceFlags reads values of StringSliceFlags which don't support Destination
+func (c *config) readSliceFlags(ctx *cli.Context) {
+	c.matrixExprs = ctx.StringSlice("matrix")
+	c.syncSpecs = ctx.StringSlice("sync")
+	c.envSpecs = ctx.StringSlice("env")
+	c.envFiles = ctx.StringSlice("env-file")
+	c.secretEnvSpecs = ctx.StringSlice("secret-env")
+	c.secretFileSpecs = ctx.StringSlice("secret-file")
+	c.localForwardSpecs = ctx.StringSlice("local-forward")
+	c.dynamicForwardSpecs = ctx.StringSlice("dynamic-forward")
+	c.remoteForwardSpecs = ctx.StringSlice("remote-forward")
+	c.excludes = ctx.StringSlice("exclude")
+	c.includes = ctx.StringSlice("include")
+	c.downloadExcludes = ctx.StringSlice("download-exclude")
+	c.downloadIncludes = ctx.StringSlice("download-include")
+	c.artifacts = ctx.StringSlice("artifact")
+}
+
+func (c *config) hasForwards() bool {
+	return len(c.localForwardSpecs) > 0 || len(c.dynamicForwardSpecs) > 0 || len(c.remoteForwardSpecs) > 0
+}
+
+func (c *config) validate(validators ...func() error) error {
+	var errs error
+	for _, v := range validators {
+		err := v()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// providerValidators returns validators of the options about provider of rarukas-server
+func (c *config) providerValidators() []func() error {
+	return []func() error{
+		// required
+		func() error {
+			if c.provider != providerArukas {
+				return nil
+			}
+			return c.validateRequired("token", c.accessToken)
+		},
+		func() error {
+			if c.provider != providerArukas {
+				return nil
+			}
+			return c.validateRequired("secret", c.accessTokenSecret)
+		},
+		func() error { return c.validateRequired("arukas-name", c.arukasName) },
+		func() error { return c.validateRequired("arukas-plan", c.arukasPlan) },
+		func() error { return c.validateRequired("image-type", c.rarukasImageType) },
 		// valid word
+		func() error {
+			return c.validateStrInValues("provider", c.provider, validProviders...)
+		},
 		func() error {
 			return c.validateStrInValues("arukas-plan", c.arukasPlan, arukas.ValidPlans...)
 		},
 		func() error {
 			return c.validateStrInValues("image-type", c.rarukasImageType, runner.RarukasImageTypes...)
 		},
+		// file
+		func() error {
+			return c.validateFilePath("local-server-bin", c.localServerBin)
+		},
+		// static provider
+		func() error {
+			if c.provider != providerStatic {
+				return nil
+			}
+			return c.validateRequired("target", c.target)
+		},
+		func() error {
+			return c.validateHostPort("target", c.target)
+		},
+		func() error {
+			return c.validateURL("api-url", c.apiURL)
+		},
+		func() error {
+			return c.validateFilePath("target-private-key-file", c.targetPrivateKeyFile)
+		},
+		func() error {
+			if c.provider != providerStatic {
+				return nil
+			}
+			if c.targetPrivateKey == "" && c.targetPrivateKeyFile == "" {
+				return errors.New("[Option] --target-private-key or --target-private-key-file is required when --target is specified")
+			}
+			return nil
+		},
+		func() error {
+			if c.provider != providerStatic {
+				return nil
+			}
+			return c.validateFilePath("target-known-hosts", c.targetKnownHosts)
+		},
+	}
+}
+
+// serverAccessValidators returns validators of the options about keys and certificates accepted by rarukas-server
+func (c *config) serverAccessValidators() []func() error {
+	return []func() error{
+		func() error {
+			if c.provider == providerStatic && (c.authorizedKeysFile != "" || c.userCAKey != "" || c.allowForwarding) {
+				return errors.New("[Option] --authorized-keys-file, --user-ca-key and --allow-forwarding can't be specified with existing rarukas-server(--target)")
+			}
+			return nil
+		},
+		func() error {
+			if err := c.validateFilePath("authorized-keys-file", c.authorizedKeysFile); err != nil {
+				return err
+			}
+			return c.loadAuthorizedKeysFile()
+		},
+		func() error {
+			if err := c.validateFilePath("user-ca-key", c.userCAKey); err != nil {
+				return err
+			}
+			return c.loadUserCAKey()
+		},
+	}
+}
+
+// commandValidators returns validators of the options about command and synchronization
+func (c *config) commandValidators() []func() error {
+	return []func() error{
 		// file/dir
 		func() error {
 			return c.validateFilePath("command-file", c.commandFile)
 		},
 		func() error {
-			return c.validateDirPath("sync-dir", c.syncDir)
+			return c.validateDirPath("sync-dir", &c.syncDir)
+		},
+		func() error {
+			var errs error
+			c.syncs = nil
+			for _, spec := range c.syncSpecs {
+				m, err := runner.ParseSyncMapping(spec)
+				if err != nil {
+					errs = multierror.Append(errs, c.optionErrorf("sync", " is invalid: %s", err))
+					continue
+				}
+				if err := c.validateDirPath("sync", &m.LocalDir); err != nil {
+					errs = multierror.Append(errs, err)
+					continue
+				}
+				c.syncs = append(c.syncs, m)
+			}
+			return errs
 		},
 		func() error {
 			if c.commandFile != "" && len(c.commands) > 0 {
@@ -180,21 +760,222 @@ func (c *config) Validate() error {
 			}
 			return nil
 		},
+		// job file
+		func() error {
+			if c.jobFile == "" {
+				return nil
+			}
+			if c.commandFile != "" || len(c.commands) > 0 {
+				return errors.New("[Option] When --job-file is specified, neither --command-file nor command-line argument can be specified")
+			}
+			if err := c.validateFilePath("job-file", c.jobFile); err != nil {
+				return err
+			}
+			return c.loadJobFile()
+		},
+		// env: --env overrides --env-file
+		func() error {
+			var errs error
+			env := map[string]string{}
+			for _, envFile := range c.envFiles {
+				if err := c.validateFilePath("env-file", envFile); err != nil {
+					errs = multierror.Append(errs, err)
+					continue
+				}
+				path, _ := homedir.Expand(envFile)
+				values, err := runner.ReadEnvFile(path)
+				if err != nil {
+					errs = multierror.Append(errs, c.optionErrorf("env-file", "(%q) is invalid: %s", envFile, err))
+					continue
+				}
+				for key, value := range values {
+					env[key] = value
+				}
+			}
+			for _, spec := range c.envSpecs {
+				key, value, ok, err := runner.ParseEnv(spec)
+				if err != nil {
+					errs = multierror.Append(errs, c.optionErrorf("env", " is invalid: %s", err))
+					continue
+				}
+				if ok {
+					env[key] = value
+				}
+			}
+			if len(env) > 0 {
+				c.env = env
+			}
+			return errs
+		},
+		// secret-env, secret-file: resolve values from the sources before starting rarukas-server
+		c.loadSecrets,
+		func() error {
+			if err := c.validateStrInValues("download-policy", c.downloadPolicy, runner.DownloadPolicies...); err != nil {
+				return err
+			}
+			if c.downloadOnly && c.downloadPolicy == string(runner.DownloadNever) {
+				return errors.New("[Option] --download-only can't be used with --download-policy=never")
+			}
+			return nil
+		},
+		func() error {
+			return c.validateStrInValues("download-merge", c.downloadMerge, runner.MergeStrategies...)
+		},
+		func() error {
+			return c.validateStrInValues("stream", c.stream, tarstream.Compressions...)
+		},
+		// sync rules
+		func() error {
+			var errs error
+			names := []string{"exclude", "include", "download-exclude", "download-include"}
+			for i, patterns := range [][]string{c.excludes, c.includes, c.downloadExcludes, c.downloadIncludes} {
+				for _, p := range patterns {
+					if err := manifest.ValidatePattern(p); err != nil {
+						errs = multierror.Append(errs, c.optionErrorf(names[i], " is invalid: %s", err))
+					}
+				}
+			}
+			return errs
+		},
+		// artifacts
+		func() error {
+			var errs error
+			for _, glob := range c.artifacts {
+				if err := manifest.ValidateGlob(glob); err != nil {
+					errs = multierror.Append(errs, c.optionErrorf("artifact", " is invalid: %s", err))
+				}
+			}
+			return errs
+		},
+		func() error {
+			if c.artifactArchive == "" {
+				return nil
+			}
+			for _, ext := range runner.ArtifactArchiveExts {
+				if strings.HasSuffix(c.artifactArchive, ext) {
+					return nil
+				}
+			}
+			return c.optionErrorf("artifact-archive", "(%s) must end with %s", c.artifactArchive, strings.Join(runner.ArtifactArchiveExts, "/"))
+		},
+		func() error {
+			return c.validateStrInValues("artifact-missing", c.artifactMissing, validArtifactMissing...)
+		},
+		// port forwarding
+		func() error {
+			c.localForwards = nil
+			for _, spec := range c.localForwardSpecs {
+				f, err := runner.ParseLocalForward(spec)
+				if err != nil {
+					return c.optionErrorf("local-forward", " is invalid: %s", err)
+				}
+				c.localForwards = append(c.localForwards, f)
+			}
+			return nil
+		},
+		func() error {
+			c.dynamicForwards = nil
+			for _, spec := range c.dynamicForwardSpecs {
+				f, err := runner.ParseDynamicForward(spec)
+				if err != nil {
+					return c.optionErrorf("dynamic-forward", " is invalid: %s", err)
+				}
+				c.dynamicForwards = append(c.dynamicForwards, f)
+			}
+			return nil
+		},
+		func() error {
+			c.remoteForwards = nil
+			for _, spec := range c.remoteForwardSpecs {
+				f, err := runner.ParseRemoteForward(spec)
+				if err != nil {
+					return c.optionErrorf("remote-forward", " is invalid: %s", err)
+				}
+				c.remoteForwards = append(c.remoteForwards, f)
+			}
+			return nil
+		},
+		func() error {
+			return c.validateOutputFilePath("status-file", &c.statusFile)
+		},
+		// tty
+		func() error {
+			if !c.tty {
+				return nil
+			}
+			if c.jobFile != "" {
+				return errors.New("[Option] --tty can't be used with --job-file")
+			}
+			if !runner.IsTerminal(os.Stdin) {
+				return c.optionErrorf("tty", " requires terminal on stdin")
+			}
+			return nil
+		},
 	}
+}
 
-	for _, v := range validators {
-		err := v()
-		if err != nil {
-			errs = multierror.Append(errs, err)
-		}
+// fanOutValidators returns validators of the options about parallel and matrix
+func (c *config) fanOutValidators() []func() error {
+	return []func() error{
+		// parallel
+		func() error {
+			if c.parallel < 1 {
+				return c.optionErrorf("parallel", "(%d) must be greater than 0", c.parallel)
+			}
+			if c.parallel > 1 && c.provider == providerStatic {
+				return c.optionErrorf("parallel", " can't be used with --target")
+			}
+			if c.parallel > 1 && c.tty {
+				return c.optionErrorf("parallel", " can't be used with --tty")
+			}
+			if c.parallel > 1 && c.hasForwards() {
+				return c.optionErrorf("parallel", " can't be used with port forwarding options")
+			}
+			return nil
+		},
+		// matrix
+		func() error {
+			if len(c.matrixExprs) == 0 {
+				return nil
+			}
+			m, err := runner.ParseMatrix(c.matrixExprs)
+			if err != nil {
+				return c.optionErrorf("matrix", " is invalid: %s", err)
+			}
+			c.matrix = m
+			return nil
+		},
+		func() error {
+			return c.validateDirPath("matrix-result-dir", &c.matrixResultDir)
+		},
+		func() error {
+			m := c.matrix
+			if m == nil && c.job != nil {
+				m = c.job.Matrix
+			}
+			if m == nil {
+				return nil
+			}
+			switch {
+			case c.tty:
+				return errors.New("[Option] Matrix can't be used with --tty")
+			case c.hasForwards():
+				return errors.New("[Option] Matrix can't be used with port forwarding options")
+			case c.parallel > 1:
+				return errors.New("[Option] Matrix can't be used with --parallel")
+			case c.provider == providerStatic:
+				return errors.New("[Option] Matrix can't be used with --target")
+			case c.rarukasImageName != "" && len(m.Types) > 0:
+				return errors.New("[Option] Matrix with type can't be used with --image-name")
+			}
+			return nil
+		},
 	}
-
-	return errs
 }
 
 func (c *config) validateRequired(name, v string) error {
 	if v == "" {
-		return fmt.Errorf("[Option] --%s is required", name)
+		return c.optionErrorf(name, " is required")
 	}
 	return nil
 }
@@ -214,7 +995,34 @@ func (c *config) validateStrInValues(name, v string, values ...string) error {
 	if exists {
 		return nil
 	}
-	return fmt.Errorf("[Option] --%s must be in [%s]", name, strings.Join(values, "/"))
+	return c.optionErrorf(name, "(%q) must be in [%s]", v, strings.Join(values, "/"))
+}
+
+func (c *config) validateURL(name, v string) error {
+	if v == "" {
+		return nil
+	}
+
+	u, err := url.Parse(v)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return c.optionErrorf(name, "(%q) is invalid URL", v)
+	}
+	return nil
+}
+
+func (c *config) validateHostPort(name, v string) error {
+	if v == "" {
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(v)
+	if err != nil {
+		return c.optionErrorf(name, "(%q) is invalid address: %s", v, err)
+	}
+	if p, err := strconv.Atoi(port); err != nil || !(1 <= p && p <= 65535) {
+		return c.optionErrorf(name, "(%q) has invalid port", v)
+	}
+	return nil
 }
 
 func (c *config) validateFilePath(name, v string) error {
@@ -225,41 +1033,176 @@ func (c *config) validateFilePath(name, v string) error {
 
 	path, err := homedir.Expand(v)
 	if err != nil {
-		return fmt.Errorf("[Option] --%s(%q) is invalid path", name, v)
+		return c.optionErrorf(name, "(%q) is invalid path", v)
 	}
 
 	cleaned := filepath.Clean(path)
 	fi, err := os.Stat(cleaned)
 	if err != nil {
-		return fmt.Errorf("[Option] --%s(%q) is not exists", name, v)
+		return c.optionErrorf(name, "(%q) is not exists", v)
 	}
 
 	if fi.IsDir() {
-		return fmt.Errorf("[Option] --%s(%q) is directory", name, v)
+		return c.optionErrorf(name, "(%q) is directory", v)
 	}
 
 	if fi.Size() == 0 {
-		return fmt.Errorf("[Option] --%s(%q) is empty file", name, v)
+		return c.optionErrorf(name, "(%q) is empty file", v)
+	}
+	return nil
+}
+
+func (c *config) validateOutputFilePath(name string, p *string) error {
+	v := *p
+	if v == "" {
+		return nil
+	}
+
+	path, err := homedir.Expand(v)
+	if err != nil {
+		return c.optionErrorf(name, "(%q) is invalid path", v)
 	}
+
+	cleaned := filepath.Clean(path)
+	fi, err := os.Stat(cleaned)
+	if err == nil && fi.IsDir() {
+		return c.optionErrorf(name, "(%q) is directory", v)
+	}
+
+	*p = cleaned
 	return nil
 }
 
-func (c *config) validateDirPath(name, v string) error {
+func (c *config) validateDirPath(name string, p *string) error {
+	v := *p
 	if v == "" {
 		return nil
 	}
 
 	path, err := homedir.Expand(v)
 	if err != nil {
-		return fmt.Errorf("[Option] --%s(%q) is invalid path", name, v)
+		return c.optionErrorf(name, "(%q) is invalid path", v)
 	}
 
 	cleaned := filepath.Clean(path)
 	fi, err := os.Stat(cleaned)
 	if err == nil && !fi.IsDir() {
-		return fmt.Errorf("[Option] --%s(%q) is already exists file", name, v)
+		return c.optionErrorf(name, "(%q) is already exists file", v)
+	}
+
+	*p = cleaned
+	return nil
+}
+
+func (c *config) loadJobFile() error {
+	path, err := homedir.Expand(c.jobFile)
+	if err != nil {
+		return c.optionErrorf("job-file", "(%q) is invalid path", c.jobFile)
+	}
+	job, err := runner.LoadJobFile(path)
+	if err != nil {
+		return c.optionErrorf("job-file", "(%q) is invalid: %s", c.jobFile, err)
+	}
+	c.job = job
+	return nil
+}
+
+// loadSecrets resolves values of secret-env and secret-file from their sources.
+// Config file found by searching upward may be written by others, so it can't run local commands with "cmd:"
+func (c *config) loadSecrets() error {
+	var errs error
+	names := map[string]bool{}
+	for _, specs := range []struct {
+		name  string
+		file  bool
+		specs []string
+	}{
+		{name: "secret-env", specs: c.secretEnvSpecs},
+		{name: "secret-file", file: true, specs: c.secretFileSpecs},
+	} {
+		for _, spec := range specs.specs {
+			secret, err := runner.ParseSecret(spec, specs.file)
+			if err != nil {
+				errs = multierror.Append(errs, c.optionErrorf(specs.name, " is invalid: %s", err))
+				continue
+			}
+			if names[secret.Name] {
+				errs = multierror.Append(errs, c.optionErrorf(specs.name, " is invalid: %q is specified more than once", secret.Name))
+				continue
+			}
+			names[secret.Name] = true
+			if c.fromConfigFile[specs.name] && strings.HasPrefix(secret.Source, "cmd:") {
+				errs = multierror.Append(errs, c.optionErrorf(specs.name, " is invalid: secret %q can't be read from local command in config file", secret.Name))
+				continue
+			}
+			if err := secret.Resolve(); err != nil {
+				errs = multierror.Append(errs, c.optionErrorf(specs.name, " is invalid: %s", err))
+				continue
+			}
+			c.secrets = append(c.secrets, secret)
+		}
+	}
+	return errs
+}
+
+// loadAuthorizedKeysFile reads authorizedKeysFile, and checks its keys before rarukas-server rejects them on boot
+func (c *config) loadAuthorizedKeysFile() error {
+	if c.authorizedKeysFile == "" {
+		return nil
+	}
+	path, err := homedir.Expand(c.authorizedKeysFile)
+	if err != nil {
+		return c.optionErrorf("authorized-keys-file", "(%q) is invalid path", c.authorizedKeysFile)
 	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c.optionErrorf("authorized-keys-file", "(%q) is invalid: %s", c.authorizedKeysFile, err)
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			return c.optionErrorf("authorized-keys-file", "(%q) is invalid: line %d: %s", c.authorizedKeysFile, i+1, err)
+		}
+	}
+	c.authorizedKeys = string(data)
+	return nil
+}
 
-	c.syncDir = cleaned
+// loadUserCAKey reads public keys of SSH user CA trusted by rarukas-server from userCAKey
+func (c *config) loadUserCAKey() error {
+	if c.userCAKey == "" {
+		return nil
+	}
+	path, err := homedir.Expand(c.userCAKey)
+	if err != nil {
+		return c.optionErrorf("user-ca-key", "(%q) is invalid path", c.userCAKey)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c.optionErrorf("user-ca-key", "(%q) is invalid: %s", c.userCAKey, err)
+	}
+	if _, _, _, _, err := ssh.ParseAuthorizedKey(data); err != nil {
+		return c.optionErrorf("user-ca-key", "(%q) is not a public key: %s", c.userCAKey, err)
+	}
+	c.trustedUserCAKeys = string(data)
 	return nil
 }
+
+func (c *config) loadTargetPrivateKey() (string, error) {
+	if c.targetPrivateKey != "" {
+		return c.targetPrivateKey, nil
+	}
+
+	path, err := homedir.Expand(c.targetPrivateKeyFile)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
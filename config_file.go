@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mitchellh/go-homedir"
+	"gopkg.in/urfave/cli.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// configFileNames are names of config file. It is searched from current directory upward
+var configFileNames = []string{".rarukas.yml", ".rarukas.yaml"}
+
+// configFileIgnoreOptions are options that can't be specified in config file
+var configFileIgnoreOptions = []string{"config", "profile", "force", "help", "version", "init-completion"}
+
+// configFilePathOptions are options that have path value.
+// Relative path in config file is resolved from the directory of config file
+var configFilePathOptions = []string{"command-file", "job-file", "env-file", "sync-dir", "matrix-result-dir", "status-file", "artifact-dir", "artifact-archive", "state-dir", "local-server-bin", "target-private-key-file", "target-known-hosts", "authorized-keys-file", "user-ca-key", "ca-key"}
+
+// configFile represents contents of .rarukas.yml
+//
+//   image-type: alpine
+//   sync-dir: work
+//   profiles:
+//     terraform:
+//       image-type: sacloud
+//       exec-timeout: 30m
+type configFile struct {
+	path     string
+	Values   map[string]interface{}            `yaml:",inline"`
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// findConfigFile searches config file from dir upward. Returns empty string if not found
+func findConfigFile(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		for _, name := range configFileNames {
+			path := filepath.Join(dir, name)
+			if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+				return path, nil
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func readConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &configFile{}
+	if err := yaml.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("parsing config file %q failed: %s", path, err)
+	}
+
+	f.path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// loadConfigFile applies values in config file to options which aren't specified by flag or environment variables.
+//
+// Precedence order is as follows:
+//   command-line flags > environment variables > profile in config file > top-level of config file > default values
+func (c *config) loadConfigFile(ctx *cli.Context, flags []cli.Flag) error {
+	c.sources = map[string]string{}
+	c.fromConfigFile = map[string]bool{}
+
+	path := c.configFile
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		path, err = findConfigFile(wd)
+		if err != nil {
+			return err
+		}
+	} else {
+		expanded, err := homedir.Expand(path)
+		if err != nil {
+			return fmt.Errorf("[Option] --config(%q) is invalid path", path)
+		}
+		path = expanded
+	}
+
+	var file *configFile
+	if path != "" {
+		f, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		file = f
+	}
+
+	var profile map[string]interface{}
+	if c.profile != "" {
+		if file == nil {
+			return fmt.Errorf("[Option] --profile(%q) is specified, but config file(%s) is not found",
+				c.profile, strings.Join(configFileNames, " or "))
+		}
+		p, ok := file.Profiles[c.profile]
+		if !ok {
+			return fmt.Errorf("[Option] --profile(%q) is not defined in config file %q", c.profile, file.path)
+		}
+		profile = p
+	}
+
+	setByFlag := map[string]bool{}
+	for _, name := range ctx.LocalFlagNames() {
+		setByFlag[name] = true
+	}
+
+	// config file is shared among subcommands, so all options are known
+	knownNames := map[string]bool{}
+	for _, flag := range append(cliFlags, sessionFlags...) {
+		for _, name := range flag.Names() {
+			knownNames[name] = true
+		}
+	}
+
+	for _, flag := range flags {
+		names := flag.Names()
+		if containsString(configFileIgnoreOptions, names[0]) {
+			continue
+		}
+
+		// command-line flags
+		if containsAny(setByFlag, names) {
+			c.sources[names[0]] = "command-line flag"
+			continue
+		}
+
+		// environment variables
+		if env := flagEnvVar(flag); env != "" {
+			c.sources[names[0]] = fmt.Sprintf("environment variable $%s", env)
+			continue
+		}
+
+		if file == nil {
+			continue
+		}
+
+		// profile in config file, then top-level of config file
+		source := fmt.Sprintf("profile %q in %s", c.profile, file.path)
+		value, ok := lookupConfigValue(profile, names)
+		if !ok {
+			source = file.path
+			value, ok = lookupConfigValue(file.Values, names)
+		}
+		if !ok {
+			continue
+		}
+
+		c.sources[names[0]] = source
+		c.fromConfigFile[names[0]] = true
+		if err := c.setConfigValue(ctx, names[0], value, filepath.Dir(file.path)); err != nil {
+			return fmt.Errorf("[Option] --%s(%v) is invalid: %s (from %s)", names[0], value, err, source)
+		}
+	}
+
+	if file != nil {
+		var unknowns []string
+		for _, values := range []map[string]interface{}{file.Values, profile} {
+			for key := range values {
+				if !knownNames[key] || containsString(configFileIgnoreOptions, key) {
+					unknowns = append(unknowns, key)
+				}
+			}
+		}
+		if len(unknowns) > 0 {
+			sort.Strings(unknowns)
+			return fmt.Errorf("config file %q has unknown option(s): %s", file.path, strings.Join(unknowns, ", "))
+		}
+	}
+
+	return nil
+}
+
+func (c *config) setConfigValue(ctx *cli.Context, name string, value interface{}, baseDir string) error {
+	var values []string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+	case map[interface{}]interface{}:
+		return fmt.Errorf("map value is not supported")
+	default:
+		values = []string{fmt.Sprint(v)}
+	}
+
+	for _, v := range values {
+		if containsString(configFilePathOptions, name) {
+			v = resolveConfigPath(baseDir, v)
+		}
+		if err := ctx.Set(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optionErrorf returns validation error of option with the source of its value
+func (c *config) optionErrorf(name, format string, args ...interface{}) error {
+	msg := fmt.Sprintf("[Option] --%s%s", name, fmt.Sprintf(format, args...))
+	if source, ok := c.sources[name]; ok {
+		msg = fmt.Sprintf("%s (from %s)", msg, source)
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func resolveConfigPath(baseDir, path string) string {
+	if path == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "~") {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+func lookupConfigValue(values map[string]interface{}, names []string) (interface{}, bool) {
+	for _, name := range names {
+		if v, ok := values[name]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// flagEnvVar returns the name of environment variable which has value for the flag
+func flagEnvVar(flag cli.Flag) string {
+	v := reflect.Indirect(reflect.ValueOf(flag)).FieldByName("EnvVars")
+	if !v.IsValid() {
+		return ""
+	}
+	for _, env := range v.Interface().([]string) {
+		if os.Getenv(env) != "" {
+			return env
+		}
+	}
+	return ""
+}
+
+func containsAny(set map[string]bool, values []string) bool {
+	for _, v := range values {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
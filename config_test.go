@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSecrets(t *testing.T) {
+	t.Run("Local command from command-line flag", func(t *testing.T) {
+		c := &config{
+			secretEnvSpecs: []string{"TOKEN=cmd:echo s3cr3t"},
+			sources:        map[string]string{"secret-env": "command-line flag"},
+		}
+		if !assert.NoError(t, c.loadSecrets()) {
+			return
+		}
+		assert.Len(t, c.secrets, 1)
+	})
+
+	t.Run("Local command from config file", func(t *testing.T) {
+		c := &config{
+			secretFileSpecs: []string{"KUBECONFIG=cmd:cat ~/.kube/config"},
+			sources:         map[string]string{"secret-file": "/work/.rarukas.yml"},
+			fromConfigFile:  map[string]bool{"secret-file": true},
+		}
+		err := c.loadSecrets()
+		if !assert.Error(t, err) {
+			return
+		}
+		assert.Contains(t, err.Error(), `secret "KUBECONFIG" can't be read from local command in config file (from /work/.rarukas.yml)`)
+		assert.Empty(t, c.secrets)
+	})
+}
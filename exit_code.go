@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/rarukas/rarukas/runner"
+)
+
+// Exit codes of rarukas
+//
+// When the remote command exits with non-zero status, rarukas exits with the same status.
+// When the remote command is terminated by signal, rarukas exits with 128+[signal number].
+// When the command runs on parallel instances, rarukas exits with the highest exit code among the instances.
+// Otherwise, following codes are used.
+//
+// These codes are in the range of exit status of the remote command,
+// so the remote command exiting with e.g. 124 is indistinguishable from exec timeout by the exit code alone.
+// exitStatus written by --status-file tells them apart.
+const (
+	exitCodeOK                 = 0
+	exitCodeBootTimeout        = 121
+	exitCodeNoSSHPortMapping   = 122
+	exitCodeTransferFailed     = 123
+	exitCodeExecTimeout        = 124
+	exitCodeError              = 125
+	exitCodeInterrupted        = 130
+	exitCodeUnknownRemoteError = 255
+)
+
+// Results of exitStatus
+const (
+	exitResultOK               = "ok"
+	exitResultRemoteExit       = "remote-exit"
+	exitResultBootTimeout      = "boot-timeout"
+	exitResultNoSSHPortMapping = "no-ssh-port-mapping"
+	exitResultTransferFailed   = "transfer-failed"
+	exitResultExecTimeout      = "exec-timeout"
+	exitResultInterrupted      = "interrupted"
+	exitResultError            = "error"
+)
+
+// exitStatus is exit status of rarukas written to --status-file
+type exitStatus struct {
+	// ExitCode is exit code of rarukas
+	ExitCode int `json:"exit_code"`
+	// Result is exitResultRemoteExit if the remote command failed, or other exitResult* if rarukas itself failed
+	Result string `json:"result"`
+	// RemoteExitStatus is exit status of the remote command. It is set only if Result is exitResultRemoteExit
+	RemoteExitStatus *int `json:"remote_exit_status,omitempty"`
+	// RemoteSignal is name of the signal terminated the remote command(e.g. "TERM")
+	RemoteSignal string `json:"remote_signal,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func exitCode(err error) int {
+	return newExitStatus(err).ExitCode
+}
+
+func newExitStatus(err error) *exitStatus {
+	if err == nil {
+		return &exitStatus{ExitCode: exitCodeOK, Result: exitResultOK}
+	}
+
+	status := &exitStatus{ExitCode: exitCodeError, Result: exitResultError, Error: err.Error()}
+	switch e := err.(type) {
+	case *runner.RemoteExitError:
+		remoteStatus := e.Status
+		status.Result = exitResultRemoteExit
+		status.RemoteExitStatus = &remoteStatus
+		status.RemoteSignal = e.Signal
+		// when remote command was terminated by signal, status is 128+[signal number]
+		status.ExitCode = e.Status
+		if e.Status <= 0 || e.Status > 255 {
+			status.ExitCode = exitCodeUnknownRemoteError
+		}
+	case *runner.BootTimeoutError:
+		status.ExitCode, status.Result = exitCodeBootTimeout, exitResultBootTimeout
+	case *runner.ExecTimeoutError:
+		status.ExitCode, status.Result = exitCodeExecTimeout, exitResultExecTimeout
+	case *runner.TransferError, *runner.MissingArtifactError:
+		status.ExitCode, status.Result = exitCodeTransferFailed, exitResultTransferFailed
+	case *runner.ParallelError:
+		// status of the instance with the highest exit code
+		status = &exitStatus{ExitCode: exitCodeOK, Result: exitResultOK}
+		for _, err := range e.FailedErrors() {
+			if s := newExitStatus(err); s.ExitCode > status.ExitCode {
+				status = s
+			}
+		}
+		status.Error = err.Error()
+	}
+
+	switch err {
+	case runner.ErrNoSSHPortMapping:
+		status.ExitCode, status.Result = exitCodeNoSSHPortMapping, exitResultNoSSHPortMapping
+	case context.Canceled:
+		status.ExitCode, status.Result = exitCodeInterrupted, exitResultInterrupted
+	}
+	return status
+}
+
+// writeStatusFile writes exitStatus of err to path as JSON
+func writeStatusFile(path string, err error) error {
+	data, e := json.MarshalIndent(newExitStatus(err), "", "  ")
+	if e != nil {
+		return e
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
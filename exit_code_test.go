@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rarukas/rarukas/runner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewExitStatus(t *testing.T) {
+	status := func(n int) *int { return &n }
+
+	expects := []struct {
+		name   string
+		err    error
+		expect *exitStatus
+	}{
+		{
+			name:   "OK",
+			expect: &exitStatus{ExitCode: exitCodeOK, Result: exitResultOK},
+		},
+		{
+			name: "Remote command exited with reserved code",
+			err:  &runner.RemoteExitError{Status: exitCodeExecTimeout},
+			expect: &exitStatus{
+				ExitCode:         exitCodeExecTimeout,
+				Result:           exitResultRemoteExit,
+				RemoteExitStatus: status(exitCodeExecTimeout),
+				Error:            "Command on rarukas-server exited with status 124",
+			},
+		},
+		{
+			name: "Remote command terminated by signal",
+			err:  &runner.RemoteExitError{Status: 143, Signal: "TERM"},
+			expect: &exitStatus{
+				ExitCode:         143,
+				Result:           exitResultRemoteExit,
+				RemoteExitStatus: status(143),
+				RemoteSignal:     "TERM",
+				Error:            "Command on rarukas-server was terminated by signal[SIGTERM]",
+			},
+		},
+		{
+			name: "Exec timeout",
+			err:  &runner.ExecTimeoutError{Err: context.DeadlineExceeded},
+			expect: &exitStatus{
+				ExitCode: exitCodeExecTimeout,
+				Result:   exitResultExecTimeout,
+				Error:    (&runner.ExecTimeoutError{Err: context.DeadlineExceeded}).Error(),
+			},
+		},
+		{
+			name:   "Interrupted",
+			err:    context.Canceled,
+			expect: &exitStatus{ExitCode: exitCodeInterrupted, Result: exitResultInterrupted, Error: "context canceled"},
+		},
+		{
+			name:   "Other error",
+			err:    errors.New("failed"),
+			expect: &exitStatus{ExitCode: exitCodeError, Result: exitResultError, Error: "failed"},
+		},
+		{
+			name: "Parallel",
+			err: &runner.ParallelError{Results: []*runner.InstanceResult{
+				{Name: "rarukas-1", Err: &runner.RemoteExitError{Status: 3}},
+				{Name: "rarukas-2", Err: &runner.BootTimeoutError{Err: context.DeadlineExceeded}},
+				{Name: "rarukas-3"},
+			}},
+			expect: &exitStatus{
+				ExitCode: exitCodeBootTimeout,
+				Result:   exitResultBootTimeout,
+				Error:    "Execution failed on 2 of 3 instances",
+			},
+		},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.name, func(t *testing.T) {
+			assert.Equal(t, expect.expect, newExitStatus(expect.err))
+			assert.Equal(t, expect.expect.ExitCode, exitCode(expect.err))
+		})
+	}
+}
+
+func TestWriteStatusFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint
+
+	path := filepath.Join(dir, "status.json")
+	if !assert.NoError(t, writeStatusFile(path, &runner.RemoteExitError{Status: 3})) {
+		return
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status map[string]interface{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]interface{}{
+		"exit_code":          float64(3),
+		"result":             "remote-exit",
+		"remote_exit_status": float64(3),
+		"error":              "Command on rarukas-server exited with status 3",
+	}, status)
+}
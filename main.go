@@ -7,7 +7,9 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/mitchellh/go-homedir"
 	"github.com/rarukas/rarukas/runner"
+	"github.com/rarukas/rarukas/tarstream"
 	"github.com/rarukas/rarukas/version"
 	"github.com/yamamoto-febc/go-arukas"
 	"gopkg.in/urfave/cli.v2"
@@ -19,6 +21,9 @@ var (
 	appName      = "rarukas"
 	appUsage     = "CLI for running one-off commands on Arukas"
 	appCopyright = "Copyright (C) 2018 Kazumichi Yamamoto."
+
+	appDescription = `Exits with the exit status of the remote command, or with 121-125 or 130 when rarukas itself fails.
+   As the remote command can also exit with these codes, use --status-file to distinguish them.`
 )
 
 func main() {
@@ -27,6 +32,7 @@ func main() {
 	app := &cli.App{
 		Name:                  appName,
 		Usage:                 appUsage,
+		Description:           appDescription,
 		HelpName:              appName,
 		Copyright:             appCopyright,
 		EnableShellCompletion: true,
@@ -34,13 +40,22 @@ func main() {
 		CommandNotFound:       cmdNotFound,
 		Flags:                 cliFlags,
 		Action:                cmdMain,
+		Commands:              commands,
 	}
 	cli.InitCompletionFlag.Hidden = true
 
+	// errors are already logged by each command
 	err := app.Run(os.Args)
+	if cfg.statusFile != "" {
+		if werr := writeStatusFile(cfg.statusFile, err); werr != nil {
+			log.Printf("[ERROR] Writing status file failed\n%s", werr)
+			if err == nil {
+				err = werr
+			}
+		}
+	}
 	if err != nil {
-		log.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -58,67 +73,157 @@ func cmdNotFound(c *cli.Context, command string) {
 
 func cmdMain(c *cli.Context) error {
 
+	if err := cfg.loadConfigFile(c, cliFlags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
+		return err
+	}
+
 	cfg.commands = c.Args().Slice()
-	if len(cfg.commands) == 0 && cfg.commandFile == "" {
+	cfg.readSliceFlags(c)
+	if len(cfg.commands) == 0 && cfg.commandFile == "" && cfg.jobFile == "" {
 		return cli.ShowSubcommandHelp(c)
 	}
+	return runMain()
+}
 
-	err := cfg.Validate()
-	if err != nil {
-		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
+func cmdShell(c *cli.Context) error {
+
+	if err := cfg.loadConfigFile(c, c.Command.Flags); err != nil {
+		log.Printf("[ERROR] Loading config file failed\n%s", err)
 		return err
 	}
 
-	// prepare SAKURA cloud API client
-	arukasClient, err := arukas.NewClient(&arukas.ClientParam{
-		Token:    cfg.accessToken,
-		Secret:   cfg.accessTokenSecret,
-		Trace:    cfg.traceMode,
-		TraceOut: os.Stderr,
-	})
+	// run login shell of rarukas-server
+	cfg.readSliceFlags(c)
+	cfg.commands = nil
+	cfg.tty = true
+	return runMain()
+}
+
+func runMain() error {
+
+	err := cfg.Validate()
 	if err != nil {
-		fmt.Printf("[ERROR] Initializing Arukas API Client failed\n%s", err)
+		log.Printf("[ERROR] Initializing rarukas config failed\n%s", err)
 		return err
 	}
+	if len(cfg.secrets) > 0 {
+		log.SetOutput(runner.MaskSecrets(log.Writer(), cfg.secrets))
+	}
 
 	runnerConfig := &runner.Config{
-		ArukasClient:     arukasClient,
-		ArukasName:       cfg.arukasName,
-		ArukasPlan:       cfg.arukasPlan,
-		RarukasImageType: cfg.rarukasImageType,
-		ArukasImageName:  cfg.rarukasImageName,
-		PublicKey:        cfg.publicKey,
-		PrivateKey:       cfg.privateKey,
-		CommandFile:      cfg.commandFile,
-		SyncDir:          cfg.syncDir,
-		UploadOnly:       cfg.uploadOnly,
-		DownloadOnly:     cfg.downloadOnly,
-		BootTimeout:      cfg.bootTimeout,
-		ExecTimeout:      cfg.execTimeout,
-		Commands:         cfg.commands,
+		ArukasName:            cfg.arukasName,
+		ArukasPlan:            cfg.arukasPlan,
+		RarukasImageType:      cfg.rarukasImageType,
+		ArukasImageName:       cfg.rarukasImageName,
+		PublicKey:             cfg.publicKey,
+		PrivateKey:            cfg.privateKey,
+		AuthorizedKeys:        cfg.authorizedKeys,
+		TrustedUserCAKeys:     cfg.trustedUserCAKeys,
+		AllowForwarding:       cfg.allowForwarding,
+		CommandFile:           cfg.commandFile,
+		SyncDir:               cfg.syncDir,
+		Syncs:                 cfg.syncs,
+		Env:                   cfg.env,
+		Secrets:               cfg.secrets,
+		UploadOnly:            cfg.uploadOnly,
+		DownloadOnly:          cfg.downloadOnly,
+		TTY:                   cfg.tty,
+		Excludes:              cfg.excludes,
+		Includes:              cfg.includes,
+		DownloadExcludes:      cfg.downloadExcludes,
+		DownloadIncludes:      cfg.downloadIncludes,
+		DownloadPolicy:        runner.DownloadPolicy(cfg.downloadPolicy),
+		MergeStrategy:         runner.MergeStrategy(cfg.downloadMerge),
+		Stream:                tarstream.Compression(cfg.stream),
+		Artifacts:             cfg.artifacts,
+		ArtifactDir:           cfg.artifactDir,
+		ArtifactArchive:       cfg.artifactArchive,
+		FailOnMissingArtifact: cfg.artifactMissing == artifactMissingError,
+		DryRun:                cfg.dryRun,
+		LocalForwards:         cfg.localForwards,
+		DynamicForwards:       cfg.dynamicForwards,
+		RemoteForwards:        cfg.remoteForwards,
+		BootTimeout:           cfg.bootTimeout,
+		ExecTimeout:           cfg.execTimeout,
+		Commands:              cfg.commands,
+		Job:                   cfg.job,
+		Parallel:              cfg.parallel,
+		Matrix:                cfg.matrix,
+		MatrixResultDir:       cfg.matrixResultDir,
 	}
 
-	// Setup signal
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	switch cfg.provider {
+	case providerStatic:
+		privateKey, err := cfg.loadTargetPrivateKey()
+		if err != nil {
+			log.Printf("[ERROR] Reading private key for target failed\n%s", err)
+			return err
+		}
+		runnerConfig.PrivateKey = privateKey
+		runnerConfig.KnownHostsFile, _ = homedir.Expand(cfg.targetKnownHosts) // nolint -> already validated
+		runnerConfig.Provider = runner.NewStaticProvider(&runner.StaticProviderParam{
+			Addr:    cfg.target,
+			WorkDir: cfg.targetWorkDir,
+		})
+	case providerLocal:
+		runnerConfig.ProviderFactory = func(int) runner.Provider {
+			return runner.NewLocalProvider(&runner.LocalProviderParam{
+				ServerBin:   cfg.localServerBin,
+				BootTimeout: cfg.bootTimeout,
+			})
+		}
+	default:
+		arukasClient, err := newArukasClient()
+		if err != nil {
+			return err
+		}
+		runnerConfig.ArukasClient = arukasClient
+	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		signal := <-sigChan
-		log.Printf("[INFO] Signal[%s] received. Shutting down...\n", signal.String())
-		cancel()
-	}()
+	ctx, cancel := signalContext()
+	defer cancel()
 
 	// Run
+	// runner.Run returns after cleanup of Arukas app has finished
 	if err := runner.Run(ctx, runnerConfig); err != nil {
+		log.Printf("[ERROR] %s", err)
 		if err == ctx.Err() {
 			time.Sleep(time.Second * 3) // sleep for shutting down goroutines
-		} else {
-			log.Fatal(err)
 		}
+		return err
 	}
 
 	log.Println("[INFO] Shutdown complete")
 	return nil
 }
+
+// newArukasClient returns Arukas API client
+func newArukasClient() (arukas.Client, error) {
+	arukasClient, err := arukas.NewClient(&arukas.ClientParam{
+		APIBaseURL: cfg.apiURL,
+		Token:      cfg.accessToken,
+		Secret:     cfg.accessTokenSecret,
+		Trace:      cfg.traceMode,
+		TraceOut:   os.Stderr,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Initializing Arukas API Client failed\n%s", err)
+		return nil, err
+	}
+	return arukasClient, nil
+}
+
+// signalContext returns context that is canceled when SIGINT or SIGTERM is received
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		signal := <-sigChan
+		log.Printf("[INFO] Signal[%s] received. Shutting down...\n", signal.String())
+		cancel()
+	}()
+	return ctx, cancel
+}
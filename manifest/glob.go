@@ -0,0 +1,142 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ValidateGlob returns error if glob can't be used as artifact pattern.
+// Glob must be slash separated path relative to root, and must not contain ".."
+func ValidateGlob(glob string) error {
+	_, err := compileGlob(glob)
+	return err
+}
+
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	if glob == "" {
+		return nil, fmt.Errorf("glob is empty")
+	}
+	if path.IsAbs(glob) || filepath.IsAbs(glob) {
+		return nil, fmt.Errorf("glob %q must be relative path", glob)
+	}
+	for _, elem := range strings.Split(glob, "/") {
+		if elem == ".." {
+			return nil, fmt.Errorf("glob %q must not contain %q", glob, "..")
+		}
+	}
+	re, err := regexp.Compile("^" + globToRegexp(path.Clean(glob)) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("glob %q is invalid: %s", glob, err)
+	}
+	return re, nil
+}
+
+// Glob returns Manifest of files under root that match globs(*, ?, ** and [...]).
+// If directory matches, all files under it are included. Globs that match nothing are set to Manifest.Unmatched
+func Glob(root string, globs []string) (*Manifest, error) {
+	var patterns []*regexp.Regexp
+	for _, glob := range globs {
+		re, err := compileGlob(glob)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, re)
+	}
+
+	m := &Manifest{Entries: map[string]*Entry{}}
+	matched := make([]bool, len(globs))
+	match := func(rel string) bool {
+		found := false
+		for i, re := range patterns {
+			if re.MatchString(rel) {
+				matched[i] = true
+				found = true
+			}
+		}
+		return found
+	}
+
+	if _, err := os.Stat(root); err == nil {
+		// includedDir is directory matched by glob. Entries under it are included without matching
+		var includedDir string
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			rel = filepath.ToSlash(rel)
+
+			if fi.Mode()&os.ModeSymlink != 0 {
+				if fi, err = os.Stat(p); err != nil {
+					return err
+				}
+				if fi.IsDir() {
+					return nil
+				}
+			}
+
+			inIncludedDir := includedDir != "" && strings.HasPrefix(rel, includedDir+"/")
+			if !inIncludedDir {
+				includedDir = ""
+			}
+			included := match(rel) || inIncludedDir
+
+			switch {
+			case fi.IsDir():
+				if included {
+					if includedDir == "" {
+						includedDir = rel
+					}
+					m.Entries[rel] = &Entry{Path: rel, Dir: true, Mode: fi.Mode().Perm()}
+				}
+			case fi.Mode().IsRegular() && included:
+				hash, err := hashFile(p)
+				if err != nil {
+					return err
+				}
+				m.Entries[rel] = &Entry{Path: rel, Size: fi.Size(), Mode: fi.Mode().Perm(), Hash: hash}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, glob := range globs {
+		if !matched[i] {
+			m.Unmatched = append(m.Unmatched, glob)
+		}
+	}
+	return m, nil
+}
+
+// List returns all entries of m sorted by path. Parents come before children
+func (m *Manifest) List() []*Entry {
+	entries := make([]*Entry, 0, len(m.Entries))
+	for _, p := range m.paths() {
+		entries = append(entries, m.Entries[p])
+	}
+	return entries
+}
+
+// Files returns file entries of m sorted by path
+func (m *Manifest) Files() []*Entry {
+	var files []*Entry
+	for _, p := range m.paths() {
+		if e := m.Entries[p]; !e.Dir {
+			files = append(files, e)
+		}
+	}
+	return files
+}
@@ -0,0 +1,70 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlob(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	for _, name := range []string{
+		"terraform.tfstate",
+		"report.xml",
+		"build/app.tar.gz",
+		"build/app.log",
+		"build/sub/lib.tar.gz",
+		"docs/index.html",
+		"docs/css/style.css",
+	} {
+		p := filepath.Join(tmpDir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(name), 0644))
+	}
+
+	paths := func(m *Manifest) []string {
+		var paths []string
+		for _, e := range m.Files() {
+			paths = append(paths, e.Path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	t.Run("Files", func(t *testing.T) {
+		m, err := Glob(tmpDir, []string{"*.tfstate", "build/*.tar.gz", "report.xml", "missing.txt"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"build/app.tar.gz", "report.xml", "terraform.tfstate"}, paths(m))
+		assert.Equal(t, []string{"missing.txt"}, m.Unmatched)
+	})
+
+	t.Run("Double star", func(t *testing.T) {
+		m, err := Glob(tmpDir, []string{"build/**/*.tar.gz"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"build/app.tar.gz", "build/sub/lib.tar.gz"}, paths(m))
+	})
+
+	t.Run("Directory", func(t *testing.T) {
+		m, err := Glob(tmpDir, []string{"docs", "docs/index.html"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"docs/css/style.css", "docs/index.html"}, paths(m))
+		assert.Empty(t, m.Unmatched)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := Glob(tmpDir, []string{"../etc/passwd"})
+		assert.Error(t, err)
+		assert.Error(t, ValidateGlob("/etc/passwd"))
+		assert.Error(t, ValidateGlob(""))
+		assert.NoError(t, ValidateGlob("build/*.tar.gz"))
+	})
+}
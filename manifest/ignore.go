@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Rules is ordered list of gitignore-syntax patterns. If multiple patterns match, the last one takes precedence
+type Rules struct {
+	patterns []*pattern
+}
+
+type pattern struct {
+	source  string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// NewRules returns Rules that have patterns
+func NewRules(patterns ...string) *Rules {
+	r := &Rules{}
+	r.Add(patterns...)
+	return r
+}
+
+// LoadRules reads patterns from ignore file. If the file doesn't exist, it returns empty Rules
+func LoadRules(path string) (*Rules, error) {
+	r := &Rules{}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, err
+	}
+	defer f.Close() // nolint -> return value not checked
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r.Add(scanner.Text())
+	}
+	return r, scanner.Err()
+}
+
+// Add appends patterns. Blank lines, comments starting with "#" and invalid patterns are ignored
+func (r *Rules) Add(patterns ...string) {
+	for _, p := range patterns {
+		if parsed, err := parsePattern(p); err == nil && parsed != nil {
+			r.patterns = append(r.patterns, parsed)
+		}
+	}
+}
+
+// Include appends patterns that re-include matched paths(same as "!pattern")
+func (r *Rules) Include(patterns ...string) {
+	for _, p := range patterns {
+		r.Add("!" + strings.TrimPrefix(p, "!"))
+	}
+}
+
+// Append appends all patterns of other
+func (r *Rules) Append(other *Rules) {
+	if other != nil {
+		r.patterns = append(r.patterns, other.patterns...)
+	}
+}
+
+// Patterns returns source of patterns
+func (r *Rules) Patterns() []string {
+	if r == nil {
+		return nil
+	}
+	var patterns []string
+	for _, p := range r.patterns {
+		patterns = append(patterns, p.source)
+	}
+	return patterns
+}
+
+// Excluded returns true if slash separated relative path p is excluded by the rules
+func (r *Rules) Excluded(p string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	excluded := false
+	for _, pattern := range r.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(p) {
+			excluded = !pattern.negate
+		}
+	}
+	return excluded
+}
+
+// ValidatePattern returns error if pattern can't be parsed
+func ValidatePattern(source string) error {
+	_, err := parsePattern(source)
+	return err
+}
+
+func parsePattern(source string) (*pattern, error) {
+	line := strings.TrimRight(source, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	p := &pattern{source: line}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// "\#foo" or "\!foo"
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	// pattern that has slash at the beginning or middle is relative to the root, otherwise it matches at any level
+	prefix := "^(?:.*/)?"
+	if strings.Contains(line, "/") {
+		prefix = "^"
+		line = strings.TrimPrefix(line, "/")
+	}
+	re, err := regexp.Compile(prefix + globToRegexp(line) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("pattern %q is invalid: %s", source, err)
+	}
+	p.re = re
+	return p, nil
+}
+
+// globToRegexp converts gitignore glob(*, ?, **, [...]) to regular expression
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			buf.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				buf.WriteString(regexp.QuoteMeta(string(c)))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,91 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		expect   bool
+	}{
+		{patterns: []string{"*.log"}, path: "debug.log", expect: true},
+		{patterns: []string{"*.log"}, path: "dir/debug.log", expect: true},
+		{patterns: []string{"*.log"}, path: "debug.txt", expect: false},
+		{patterns: []string{"/debug.log"}, path: "dir/debug.log", expect: false},
+		{patterns: []string{"dir/*.log"}, path: "dir/debug.log", expect: true},
+		{patterns: []string{"dir/*.log"}, path: "dir/sub/debug.log", expect: false},
+		{patterns: []string{"build/"}, path: "build", isDir: true, expect: true},
+		{patterns: []string{"build/"}, path: "build", isDir: false, expect: false},
+		{patterns: []string{"**/cache"}, path: "a/b/cache", isDir: true, expect: true},
+		{patterns: []string{"logs/**"}, path: "logs/a/b.txt", expect: true},
+		{patterns: []string{"a/**/b"}, path: "a/b", expect: true},
+		{patterns: []string{"a/**/b"}, path: "a/x/y/b", expect: true},
+		{patterns: []string{"file?.txt"}, path: "file1.txt", expect: true},
+		{patterns: []string{"file[0-9].txt"}, path: "filea.txt", expect: false},
+		{patterns: []string{"file[!0-9].txt"}, path: "filea.txt", expect: true},
+		{patterns: []string{`\#file`}, path: "#file", expect: true},
+		{patterns: []string{"# comment", ""}, path: "# comment", expect: false},
+		{patterns: []string{"*.log", "!keep.log"}, path: "keep.log", expect: false},
+		{patterns: []string{"!keep.log", "*.log"}, path: "keep.log", expect: true},
+	}
+
+	for _, tc := range cases {
+		rules := NewRules(tc.patterns...)
+		assert.Equal(t, tc.expect, rules.Excluded(tc.path, tc.isDir), "patterns: %v, path: %s", tc.patterns, tc.path)
+	}
+
+	t.Run("Nil rules", func(t *testing.T) {
+		var rules *Rules
+		assert.False(t, rules.Excluded("foo", false))
+		assert.Empty(t, rules.Patterns())
+	})
+
+	t.Run("Include", func(t *testing.T) {
+		rules := NewRules("*.log")
+		rules.Include("keep.log")
+		assert.False(t, rules.Excluded("keep.log", false))
+		assert.Equal(t, []string{"*.log", "!keep.log"}, rules.Patterns())
+	})
+
+	t.Run("Invalid pattern", func(t *testing.T) {
+		assert.Error(t, ValidatePattern("file[z-a]"))
+		assert.NoError(t, ValidatePattern("*.log"))
+	})
+}
+
+func TestBuildWithRules(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(tmpDir, ".git"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, ".git", "HEAD"), []byte("ref"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "main.go"), []byte("main"), 0600))
+
+	rulesFile := filepath.Join(tmpDir, ".rarukasignore")
+	assert.NoError(t, ioutil.WriteFile(rulesFile, []byte(".git/\n.rarukasignore\n"), 0600))
+	rules, err := LoadRules(rulesFile)
+	assert.NoError(t, err)
+
+	m, err := Build(tmpDir, rules)
+	assert.NoError(t, err)
+	assert.Len(t, m.Entries, 1)
+	assert.Contains(t, m.Entries, "main.go")
+	assert.Equal(t, []string{".git", ".rarukasignore"}, m.Excluded)
+
+	t.Run("Not exists", func(t *testing.T) {
+		rules, err := LoadRules(filepath.Join(tmpDir, "not-exists"))
+		assert.NoError(t, err)
+		assert.Empty(t, rules.Patterns())
+	})
+}
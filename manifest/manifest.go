@@ -0,0 +1,219 @@
+// Package manifest provides content-hashed file list of directory, used for incremental synchronization
+// between local sync-dir and workdir of rarukas-server
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Entry is file or directory in Manifest
+type Entry struct {
+	// Path is slash separated path relative to root directory
+	Path string      `json:"path"`
+	Dir  bool        `json:"dir,omitempty"`
+	Size int64       `json:"size"`
+	Mode os.FileMode `json:"mode"`
+	// Hash is hex encoded SHA-256 of file content. Empty if Dir is true
+	Hash string `json:"hash,omitempty"`
+}
+
+// Manifest is list of files and directories under root directory. Root directory itself is not included
+type Manifest struct {
+	Entries map[string]*Entry `json:"entries"`
+	// Excluded are paths excluded by Rules. Entries under excluded directory are omitted
+	Excluded []string `json:"excluded,omitempty"`
+	// Unmatched are Request.Globs that match no file
+	Unmatched []string `json:"unmatched,omitempty"`
+}
+
+// Request is request of Manifest to rarukas-server
+type Request struct {
+	// Dir is directory on rarukas-server. Relative path is resolved from working directory of rarukas-server
+	Dir string `json:"dir"`
+	// Rules are gitignore-syntax patterns of files excluded from Manifest
+	Rules []string `json:"rules,omitempty"`
+	// Globs are patterns of files to be included in Manifest. They are used by glob subsystem instead of Rules
+	Globs []string `json:"globs,omitempty"`
+}
+
+// Build walks root and computes hashes of regular files. Paths excluded by rules are skipped.
+// Symbolic links to files are followed, and symbolic links to directories are skipped like file transfer does.
+// If root doesn't exist, it returns empty Manifest
+func Build(root string, rules *Rules) (*Manifest, error) {
+	m := &Manifest{Entries: map[string]*Entry{}}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return m, nil
+	}
+
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+		}
+
+		if rules.Excluded(rel, fi.IsDir()) {
+			m.Excluded = append(m.Excluded, rel)
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		switch {
+		case fi.IsDir():
+			m.Entries[rel] = &Entry{Path: rel, Dir: true, Mode: fi.Mode().Perm()}
+		case fi.Mode().IsRegular():
+			hash, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			m.Entries[rel] = &Entry{Path: rel, Size: fi.Size(), Mode: fi.Mode().Perm(), Hash: hash}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close() // nolint -> return value not checked
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("hashing %q failed: %s", p, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Diff is difference needed to make destination same as source
+type Diff struct {
+	// Dirs are directories only in source. Parents come before children
+	Dirs []*Entry
+	// Files are files only in source, or whose content differs from destination
+	Files []*Entry
+	// Deleted are entries only in destination. Entries under deleted directory are omitted
+	Deleted []*Entry
+	// Unchanged are files that have same content in source and destination
+	Unchanged []*Entry
+}
+
+// Compare returns Diff from dest to src.
+// If type of entry differs(e.g. file in src and directory in dest), the entry is deleted and created again
+func Compare(src, dest *Manifest) *Diff {
+	diff := &Diff{}
+	for _, p := range src.paths() {
+		s := src.Entries[p]
+		d, exists := dest.Entries[p]
+		if exists && d.Dir != s.Dir {
+			diff.Deleted = append(diff.Deleted, d)
+			exists = false
+		}
+		switch {
+		case s.Dir:
+			if !exists {
+				diff.Dirs = append(diff.Dirs, s)
+			}
+		case exists && d.Hash == s.Hash:
+			diff.Unchanged = append(diff.Unchanged, s)
+		default:
+			diff.Files = append(diff.Files, s)
+		}
+	}
+
+	for _, p := range dest.paths() {
+		if _, exists := src.Entries[p]; exists {
+			continue
+		}
+		if dest.hasParentIn(p, diff.Deleted) {
+			continue
+		}
+		diff.Deleted = append(diff.Deleted, dest.Entries[p])
+	}
+	return diff
+}
+
+// TransferSize returns total size of Files
+func (d *Diff) TransferSize() int64 {
+	return totalSize(d.Files)
+}
+
+// SkippedSize returns total size of Unchanged
+func (d *Diff) SkippedSize() int64 {
+	return totalSize(d.Unchanged)
+}
+
+// Summary returns human readable summary of d
+func (d *Diff) Summary() string {
+	return fmt.Sprintf("%d files(%s) transferred, %d entries deleted, %d files(%s) skipped as unchanged",
+		len(d.Files), FormatBytes(d.TransferSize()), len(d.Deleted), len(d.Unchanged), FormatBytes(d.SkippedSize()))
+}
+
+// paths returns sorted paths. Parents always come before children
+func (m *Manifest) paths() []string {
+	paths := make([]string, 0, len(m.Entries))
+	for p := range m.Entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (m *Manifest) hasParentIn(p string, entries []*Entry) bool {
+	for _, e := range entries {
+		if e.Dir && strings.HasPrefix(p, e.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func totalSize(entries []*Entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	return size
+}
+
+// FormatBytes formats size like "1.5 MB"
+func FormatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,97 @@
+package manifest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(tmpDir, "dir"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "dir", "foo.txt"), []byte("foo"), 0600))
+
+	m, err := Build(tmpDir, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*Entry{
+		"dir": {Path: "dir", Dir: true, Mode: 0755},
+		"dir/foo.txt": {
+			Path: "dir/foo.txt",
+			Size: 3,
+			Mode: 0600,
+			Hash: "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		},
+	}, m.Entries)
+
+	t.Run("Not exists", func(t *testing.T) {
+		m, err := Build(filepath.Join(tmpDir, "not-exists"), nil)
+		assert.NoError(t, err)
+		assert.Empty(t, m.Entries)
+	})
+}
+
+func TestCompare(t *testing.T) {
+	file := func(p, hash string, size int64) *Entry {
+		return &Entry{Path: p, Hash: hash, Size: size}
+	}
+	dir := func(p string) *Entry {
+		return &Entry{Path: p, Dir: true}
+	}
+	manifest := func(entries ...*Entry) *Manifest {
+		m := &Manifest{Entries: map[string]*Entry{}}
+		for _, e := range entries {
+			m.Entries[e.Path] = e
+		}
+		return m
+	}
+
+	src := manifest(
+		file("same.txt", "a", 10),
+		file("changed.txt", "b", 20),
+		file("added.txt", "c", 30),
+		dir("newdir"),
+		file("newdir/file.txt", "d", 40),
+		file("type", "e", 50),
+	)
+	dest := manifest(
+		file("same.txt", "a", 10),
+		file("changed.txt", "x", 25),
+		file("deleted.txt", "y", 5),
+		dir("olddir"),
+		file("olddir/file.txt", "z", 5),
+		dir("type"),
+		file("type/file.txt", "w", 5),
+	)
+
+	diff := Compare(src, dest)
+	assert.Equal(t, []*Entry{dir("newdir")}, diff.Dirs)
+	assert.Equal(t, []*Entry{
+		file("added.txt", "c", 30),
+		file("changed.txt", "b", 20),
+		file("newdir/file.txt", "d", 40),
+		file("type", "e", 50),
+	}, diff.Files)
+	assert.Equal(t, []*Entry{
+		dir("type"),
+		file("deleted.txt", "y", 5),
+		dir("olddir"),
+	}, diff.Deleted)
+	assert.Equal(t, []*Entry{file("same.txt", "a", 10)}, diff.Unchanged)
+	assert.Equal(t, int64(140), diff.TransferSize())
+	assert.Equal(t, int64(10), diff.SkippedSize())
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "0 B", FormatBytes(0))
+	assert.Equal(t, "1023 B", FormatBytes(1023))
+	assert.Equal(t, "1.5 KB", FormatBytes(1536))
+	assert.Equal(t, "300.0 MB", FormatBytes(300*1024*1024))
+}
@@ -0,0 +1,229 @@
+package runner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rarukas/rarukas/manifest"
+	"github.com/rarukas/rarukas/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// ArtifactArchiveExts are supported extensions of ArtifactArchive
+var ArtifactArchiveExts = []string{".tar.gz", ".tgz", ".zip"}
+
+func (c *Config) hasArtifacts() bool {
+	return len(c.Artifacts) > 0
+}
+
+// localArtifactDir returns directory to save artifacts. If empty, artifacts are only packed into archive
+func (c *Config) localArtifactDir() string {
+	dir := c.ArtifactDir
+	if dir == "" {
+		if c.ArtifactArchive != "" {
+			return ""
+		}
+		dir = "."
+	}
+	return filepath.Join(dir, c.artifactName)
+}
+
+// localArtifactArchive returns path of archive. Name of parallel instance is appended to base name(e.g. artifacts-rarukas-1.tar.gz)
+func (c *Config) localArtifactArchive() string {
+	if c.ArtifactArchive == "" || c.artifactName == "" {
+		return c.ArtifactArchive
+	}
+	for _, ext := range ArtifactArchiveExts {
+		if strings.HasSuffix(c.ArtifactArchive, ext) {
+			return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(c.ArtifactArchive, ext), c.artifactName, ext)
+		}
+	}
+	return c.ArtifactArchive + "-" + c.artifactName
+}
+
+// downloadArtifacts downloads files matching Artifacts in workdir of rarukas-server keeping their relative paths
+func (r *realRunner) downloadArtifacts(ctx context.Context, host string, port int) error {
+	downloadCtx, cancel := context.WithTimeout(ctx, r.cfg.ExecTimeout)
+	defer cancel()
+
+	var unmatched []string
+	err := r.withSSHConn(downloadCtx, host, port, func(client *ssh.Client) error {
+		req := &manifest.Request{Dir: r.cfg.remoteWorkDir(), Globs: r.cfg.Artifacts}
+		m, err := requestManifest(client, server.RarukasGlobSubsystem, req)
+		if err == errManifestNotSupported {
+			return errors.New("rarukas-server doesn't support artifacts")
+		}
+		if err != nil {
+			return err
+		}
+		unmatched = m.Unmatched
+		for _, glob := range unmatched {
+			log.Printf("[WARN] Artifact %q matched no file", glob)
+		}
+
+		localDir := r.cfg.localArtifactDir()
+		if localDir == "" {
+			tmpDir, err := ioutil.TempDir("", "rarukas-artifact_")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(tmpDir) // nolint -> return value not checked
+			localDir = tmpDir
+		}
+		transfer := newFileTransfer(client)
+		defer transfer.Close() // nolint -> return value not checked
+		if err := r.receiveEntries(client, transfer, r.cfg.remoteWorkDir(), localDir, m.List()); err != nil {
+			return err
+		}
+		files := m.Files()
+		log.Printf("[INFO] Downloaded %d artifacts(%s) to %q", len(files), manifest.FormatBytes(totalEntrySize(files)), localDir)
+
+		if archive := r.cfg.localArtifactArchive(); archive != "" {
+			if err := packArtifacts(archive, localDir, m); err != nil {
+				return fmt.Errorf("packing artifacts into %q failed: %s", archive, err)
+			}
+			log.Printf("[INFO] Packed %d artifacts into %q", len(files), archive)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(unmatched) > 0 && r.cfg.FailOnMissingArtifact {
+		return &MissingArtifactError{Globs: unmatched}
+	}
+	return nil
+}
+
+func totalEntrySize(entries []*manifest.Entry) int64 {
+	var size int64
+	for _, e := range entries {
+		size += e.Size
+	}
+	return size
+}
+
+// packArtifacts packs files of m in dir into archive. Format is determined by extension of archive
+func packArtifacts(archive, dir string, m *manifest.Manifest) error {
+	if err := os.MkdirAll(filepath.Dir(archive), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(archive, ".zip") {
+		err = packZip(f, dir, m)
+	} else {
+		err = packTarGz(f, dir, m)
+	}
+	if err != nil {
+		f.Close()          // nolint -> return value not checked
+		os.Remove(archive) // nolint -> return value not checked
+		return err
+	}
+	return f.Close()
+}
+
+func packTarGz(w io.Writer, dir string, m *manifest.Manifest) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	err := walkArtifacts(dir, m, func(e *manifest.Entry, fi os.FileInfo, r io.Reader) error {
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		header.Name = e.Path
+		if e.Dir {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if r != nil {
+			_, err = io.Copy(tw, r)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func packZip(w io.Writer, dir string, m *manifest.Manifest) error {
+	zw := zip.NewWriter(w)
+	err := walkArtifacts(dir, m, func(e *manifest.Entry, fi os.FileInfo, r io.Reader) error {
+		header, err := zip.FileInfoHeader(fi)
+		if err != nil {
+			return err
+		}
+		header.Name = e.Path
+		if e.Dir {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if r != nil {
+			_, err = io.Copy(fw, r)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// walkArtifacts calls fn for each entry of m in sorted order. r is nil if the entry is directory
+func walkArtifacts(dir string, m *manifest.Manifest, fn func(e *manifest.Entry, fi os.FileInfo, r io.Reader) error) error {
+	paths := make([]string, 0, len(m.Entries))
+	for p := range m.Entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		e := m.Entries[p]
+		local := filepath.Join(dir, filepath.FromSlash(p))
+		fi, err := os.Stat(local)
+		if err != nil {
+			return err
+		}
+		if e.Dir {
+			if err := fn(e, fi, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		err = fn(e, fi, f)
+		f.Close() // nolint -> return value not checked
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
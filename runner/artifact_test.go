@@ -0,0 +1,124 @@
+// +build !windows
+
+package runner
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownloadArtifacts(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	workDir := filepath.Join(tmpDir, "work")
+	writeFiles(t, workDir, map[string]string{
+		"terraform.tfstate": "state",
+		"build/app.tar.gz":  "app",
+		"build/app.log":     "log",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, addr := startTestServer(ctx, t, tmpDir)
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+
+	r.cfg.serverWorkDir = workDir
+	r.cfg.Artifacts = []string{"*.tfstate", "build/*.tar.gz", "report.xml"}
+
+	t.Run("Directory", func(t *testing.T) {
+		r.cfg.ArtifactDir = filepath.Join(tmpDir, "artifacts")
+
+		assert.NoError(t, r.downloadArtifacts(ctx, host, port))
+		assertFileContent(t, filepath.Join(tmpDir, "artifacts", "terraform.tfstate"), "state")
+		assertFileContent(t, filepath.Join(tmpDir, "artifacts", "build", "app.tar.gz"), "app")
+		assert.False(t, fileExists(filepath.Join(tmpDir, "artifacts", "build", "app.log")))
+	})
+
+	t.Run("Missing artifact", func(t *testing.T) {
+		r.cfg.FailOnMissingArtifact = true
+		defer func() { r.cfg.FailOnMissingArtifact = false }()
+
+		err := r.downloadArtifacts(ctx, host, port)
+		if assert.IsType(t, &MissingArtifactError{}, err) {
+			assert.Equal(t, []string{"report.xml"}, err.(*MissingArtifactError).Globs)
+		}
+	})
+
+	t.Run("tar.gz", func(t *testing.T) {
+		r.cfg.ArtifactDir = ""
+		r.cfg.ArtifactArchive = filepath.Join(tmpDir, "artifacts.tar.gz")
+
+		assert.NoError(t, r.downloadArtifacts(ctx, host, port))
+
+		f, err := os.Open(r.cfg.ArtifactArchive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close() // nolint
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gr)
+
+		var names []string
+		for {
+			header, err := tr.Next()
+			if err != nil {
+				break
+			}
+			names = append(names, header.Name)
+		}
+		assert.Equal(t, []string{"build/app.tar.gz", "terraform.tfstate"}, names)
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		r.cfg.ArtifactArchive = filepath.Join(tmpDir, "artifacts.zip")
+
+		assert.NoError(t, r.downloadArtifacts(ctx, host, port))
+
+		zr, err := zip.OpenReader(r.cfg.ArtifactArchive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close() // nolint
+
+		var names []string
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+		}
+		assert.Equal(t, []string{"build/app.tar.gz", "terraform.tfstate"}, names)
+	})
+}
+
+func TestLocalArtifactPaths(t *testing.T) {
+	cfg := &Config{}
+	assert.Equal(t, ".", cfg.localArtifactDir())
+
+	cfg = &Config{ArtifactArchive: "out/artifacts.tar.gz", artifactName: "rarukas-1"}
+	assert.Equal(t, "", cfg.localArtifactDir())
+	assert.Equal(t, "out/artifacts-rarukas-1.tar.gz", cfg.localArtifactArchive())
+
+	cfg = &Config{ArtifactDir: "out", artifactName: "rarukas-1"}
+	assert.Equal(t, filepath.Join("out", "rarukas-1"), cfg.localArtifactDir())
+}
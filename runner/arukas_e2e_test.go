@@ -0,0 +1,272 @@
+// +build !windows
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rarukas/rarukas/arukastest"
+	"github.com/rarukas/rarukas/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/yamamoto-febc/go-arukas"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRunWithFakeArukas(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	workDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir) // nolint
+
+	fake := arukastest.NewServer()
+	defer fake.Close()
+	fake.Launcher = &arukastest.RarukasServerLauncher{WorkDir: workDir}
+
+	client, err := arukas.NewClient(&arukas.ClientParam{
+		APIBaseURL: fake.URL,
+		Token:      "token",
+		Secret:     "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newConfig := func(out *bytes.Buffer) *Config {
+		return &Config{
+			ArukasClient:     client,
+			ArukasName:       "rarukas-test",
+			ArukasPlan:       arukas.PlanFree,
+			RarukasImageType: "alpine",
+			CommandFile:      "test/dir1/test1.bash",
+			BootTimeout:      10 * time.Second,
+			ExecTimeout:      10 * time.Second,
+			serverTmpDir:     workDir,
+			serverWorkDir:    workDir,
+			out:              out,
+			err:              ioutil.Discard,
+		}
+	}
+
+	t.Run("Run command and delete app", func(t *testing.T) {
+		stdOut := &bytes.Buffer{}
+		err := Run(ctx, newConfig(stdOut))
+		assert.NoError(t, err)
+		assert.Equal(t, "dir1\ntest1\n", stdOut.String())
+		assert.Empty(t, fake.Apps())
+	})
+
+	t.Run("Env is not stored in app definition", func(t *testing.T) {
+		launcher := &envRecordingLauncher{Launcher: fake.Launcher}
+		fake.Launcher = launcher
+		defer func() { fake.Launcher = launcher.Launcher }()
+
+		stdOut := &bytes.Buffer{}
+		cfg := newConfig(stdOut)
+		cfg.CommandFile = ""
+		cfg.Commands = []string{"echo $RARUKAS_TEST_SECRET $APP_STAGE"}
+		cfg.Env = map[string]string{"RARUKAS_TEST_SECRET": "it's secret", "APP_STAGE": "test"}
+
+		err := Run(ctx, cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "it's secret test\n", stdOut.String())
+		assert.NotEmpty(t, launcher.env)
+		acceptEnv := ""
+		for _, env := range launcher.env {
+			assert.NotContains(t, env.Value, "it's secret")
+			if env.Key == server.RarukasAcceptEnvEnv {
+				acceptEnv = env.Value
+			}
+		}
+		// rarukas-server accepts only names sent by the runner in addition to its defaults
+		assert.Equal(t, "APP_STAGE,RARUKAS_TEST_SECRET", acceptEnv)
+	})
+
+	t.Run("Secrets are masked and not stored in app definition", func(t *testing.T) {
+		launcher := &envRecordingLauncher{Launcher: fake.Launcher}
+		fake.Launcher = launcher
+		defer func() { fake.Launcher = launcher.Launcher }()
+
+		stdOut := &bytes.Buffer{}
+		cfg := newConfig(stdOut)
+		cfg.CommandFile = ""
+		cfg.Commands = []string{`echo "token=$RARUKAS_TEST_TOKEN"; cat $RARUKAS_TEST_KEY; echo $RARUKAS_TEST_KEY`}
+		cfg.Secrets = []*Secret{
+			{Name: "RARUKAS_TEST_TOKEN", value: "it's token"},
+			{Name: "RARUKAS_TEST_KEY", File: true, value: "it's key\n"},
+		}
+
+		err := Run(ctx, cfg)
+		assert.NoError(t, err)
+		lines := strings.Split(stdOut.String(), "\n")
+		assert.Len(t, lines, 4)
+		assert.Equal(t, []string{"token=***", "***"}, lines[:2])
+		assert.NotEmpty(t, launcher.env)
+		for _, env := range launcher.env {
+			assert.NotContains(t, env.Value, "it's")
+		}
+
+		// secret file is wiped after the session
+		_, err = os.Stat(lines[2])
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Delete app when powering on failed", func(t *testing.T) {
+		fake.InjectError(arukastest.OpPowerOn, http.StatusInternalServerError)
+		defer fake.ClearErrors()
+
+		err := Run(ctx, newConfig(&bytes.Buffer{}))
+		assert.Error(t, err)
+		assert.Empty(t, fake.Apps())
+	})
+}
+
+func TestSessionWithFakeArukas(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	workDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir) // nolint
+
+	fake := arukastest.NewServer()
+	defer fake.Close()
+	fake.Launcher = &arukastest.RarukasServerLauncher{WorkDir: workDir}
+
+	client, err := arukas.NewClient(&arukas.ClientParam{
+		APIBaseURL: fake.URL,
+		Token:      "token",
+		Secret:     "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	caPublicKey, caKey, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := Up(ctx, &Config{
+		ArukasClient:      client,
+		ArukasName:        "rarukas-test",
+		ArukasPlan:        arukas.PlanHobby,
+		RarukasImageType:  "alpine",
+		TrustedUserCAKeys: string(caPublicKey),
+		BootTimeout:       10 * time.Second,
+		serverTmpDir:      workDir,
+		serverWorkDir:     workDir,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "rarukas-test", session.Name)
+	assert.NotEmpty(t, session.AppID)
+	assert.NotEmpty(t, session.PrivateKey)
+	assert.NotEmpty(t, session.HostKey)
+	assert.NotEmpty(t, session.RunID)
+	assert.Len(t, fake.Apps(), 1)
+
+	newConfig := func(out *bytes.Buffer) *Config {
+		return &Config{
+			ArukasClient: client,
+			ExecTimeout:  10 * time.Second,
+			out:          out,
+			err:          ioutil.Discard,
+		}
+	}
+
+	t.Run("Exec commands on same server", func(t *testing.T) {
+		cfg := newConfig(&bytes.Buffer{})
+		cfg.Commands = []string{"echo foobar > exec.txt"}
+		assert.NoError(t, Exec(ctx, cfg, session))
+
+		stdOut := &bytes.Buffer{}
+		cfg = newConfig(stdOut)
+		cfg.Commands = []string{"cat exec.txt"}
+		assert.NoError(t, Exec(ctx, cfg, session))
+		assert.Equal(t, "foobar\n", stdOut.String())
+	})
+
+	t.Run("Copy files", func(t *testing.T) {
+		localDir, err := ioutil.TempDir("", "rarukas-test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(localDir) // nolint
+		src := filepath.Join(localDir, "upload.txt")
+		if err := ioutil.WriteFile(src, []byte("upload"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.NoError(t, CopyTo(ctx, newConfig(&bytes.Buffer{}), session, src, ""))
+		data, err := ioutil.ReadFile(filepath.Join(workDir, "upload.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "upload", string(data))
+
+		downloadDir := filepath.Join(localDir, "download")
+		assert.NoError(t, CopyFrom(ctx, newConfig(&bytes.Buffer{}), session, "exec.txt", downloadDir))
+		data, err = ioutil.ReadFile(filepath.Join(downloadDir, "exec.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "foobar\n", string(data))
+
+		// remote path with space is quoted in commands run on rarukas-server
+		writeFiles(t, filepath.Join(workDir, "dir with space"), map[string]string{"file.txt": "space"})
+		r := newSessionRunner(newConfig(&bytes.Buffer{}), session)
+		err = r.withSSHConn(ctx, session.Host, session.Port, func(client *ssh.Client) error {
+			isDir, err := remoteIsDir(client, session.remotePath("dir with space"))
+			assert.True(t, isDir)
+			return err
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("Certificate issued for the session", func(t *testing.T) {
+		addr := fmt.Sprintf("%s:%d", session.Host, session.Port)
+		client, err := dialWithCert(t, addr, session.HostKey, string(caKey), session.RunID)
+		if !assert.NoError(t, err) {
+			return
+		}
+		client.Close() // nolint
+
+		_, err = dialWithCert(t, addr, session.HostKey, string(caKey), "other-run")
+		assert.Error(t, err)
+	})
+
+	t.Run("Down deletes app", func(t *testing.T) {
+		assert.NoError(t, Down(ctx, newConfig(&bytes.Buffer{}), session))
+		assert.Empty(t, fake.Apps())
+	})
+}
+
+// envRecordingLauncher records environment variables in the service definition
+type envRecordingLauncher struct {
+	arukastest.Launcher
+	env []*arukas.Env
+}
+
+func (l *envRecordingLauncher) Launch(service *arukas.Service) ([]*arukas.PortMapping, error) {
+	l.env = append(l.env, service.Attributes.Environment...)
+	return l.Launcher.Launch(service)
+}
@@ -0,0 +1,94 @@
+package runner
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rarukas/rarukas/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// certClockSkew is allowance for clock of rarukas-server behind local clock
+const certClockSkew = time.Minute
+
+// UserCertParam is parameter of IssueUserCert
+type UserCertParam struct {
+	// CAKey is PEM encoded private key of SSH user CA
+	CAKey string
+	// PublicKey is the key to be certified in authorized_keys format
+	PublicKey string
+	// Principals are SSH users allowed to log in with the certificate
+	Principals []string
+	// RunID is ID of the run. rarukas-server of other runs refuses the certificate
+	RunID string
+	// Validity is how long the certificate is valid from now
+	Validity time.Duration
+}
+
+// NewRunID returns random ID of a run passed to rarukas-server trusting SSH user CA
+func NewRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IssueUserCert issues short-lived user certificate accepted only by rarukas-server of param.RunID.
+// It returns the certificate in authorized_keys format
+func IssueUserCert(param *UserCertParam) ([]byte, error) {
+	if param.RunID == "" {
+		return nil, errors.New("run ID is required")
+	}
+	if len(param.Principals) == 0 {
+		return nil, errors.New("principals are required")
+	}
+	if param.Validity <= 0 {
+		return nil, fmt.Errorf("validity %s is invalid", param.Validity)
+	}
+
+	ca, err := ssh.ParsePrivateKey([]byte(param.CAKey))
+	if err != nil {
+		return nil, fmt.Errorf("CA key is invalid: %s", err)
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(param.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("public key is invalid: %s", err)
+	}
+	if _, ok := key.(*ssh.Certificate); ok {
+		return nil, errors.New("public key is already a certificate")
+	}
+
+	serial := make([]byte, 8)
+	if _, err := rand.Read(serial); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		Serial:          binary.BigEndian.Uint64(serial),
+		CertType:        ssh.UserCert,
+		KeyId:           fmt.Sprintf("rarukas:%s:%s", param.RunID, strings.Join(param.Principals, ",")),
+		ValidPrincipals: param.Principals,
+		ValidAfter:      uint64(now.Add(-certClockSkew).Unix()),
+		ValidBefore:     uint64(now.Add(param.Validity).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{server.RarukasRunIDCriticalOption: param.RunID},
+			Extensions:      map[string]string{"permit-pty": "", "permit-port-forwarding": ""},
+		},
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, err
+	}
+
+	authorizedKey := ssh.MarshalAuthorizedKey(cert)
+	if comment != "" {
+		authorizedKey = append(authorizedKey[:len(authorizedKey)-1], []byte(" "+comment+"\n")...)
+	}
+	return authorizedKey, nil
+}
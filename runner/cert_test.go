@@ -0,0 +1,209 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rarukas/rarukas/server"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIssueUserCert(t *testing.T) {
+	caPublicKey, caKey, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userPublicKey, _, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newParam := func() *UserCertParam {
+		return &UserCertParam{
+			CAKey:      string(caKey),
+			PublicKey:  strings.TrimSpace(string(userPublicKey)) + " alice@example.com",
+			Principals: []string{"root", "alice"},
+			RunID:      "run1",
+			Validity:   time.Hour,
+		}
+	}
+
+	t.Run("Issue", func(t *testing.T) {
+		data, err := IssueUserCert(newParam())
+		if !assert.NoError(t, err) {
+			return
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey(data)
+		if !assert.NoError(t, err) {
+			return
+		}
+		cert, ok := key.(*ssh.Certificate)
+		if !assert.True(t, ok) {
+			return
+		}
+		ca, _, _, _, err := ssh.ParseAuthorizedKey(caPublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, "alice@example.com", comment)
+		assert.Equal(t, uint32(ssh.UserCert), cert.CertType)
+		assert.Equal(t, ca.Marshal(), cert.SignatureKey.Marshal())
+		assert.Equal(t, []string{"root", "alice"}, cert.ValidPrincipals)
+		assert.Equal(t, "run1", cert.CriticalOptions[server.RarukasRunIDCriticalOption])
+		assert.InDelta(t, time.Now().Add(time.Hour).Unix(), int64(cert.ValidBefore), 5)
+		assert.Contains(t, cert.Extensions, "permit-pty")
+	})
+
+	expects := []struct {
+		name   string
+		modify func(param *UserCertParam)
+	}{
+		{name: "No run ID", modify: func(param *UserCertParam) { param.RunID = "" }},
+		{name: "No principals", modify: func(param *UserCertParam) { param.Principals = nil }},
+		{name: "Invalid validity", modify: func(param *UserCertParam) { param.Validity = 0 }},
+		{name: "Invalid CA key", modify: func(param *UserCertParam) { param.CAKey = "invalid" }},
+		{name: "Invalid public key", modify: func(param *UserCertParam) { param.PublicKey = "invalid" }},
+	}
+	for _, expect := range expects {
+		t.Run(expect.name, func(t *testing.T) {
+			param := newParam()
+			expect.modify(param)
+			_, err := IssueUserCert(param)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestUserCertAuthentication(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	caPublicKey, caKey, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPublicKey, hostKey, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	workDir, err := ioutil.TempDir("", "rarukas-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir) // nolint
+
+	sshPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// rarukas-server trusts only the CA
+	go server.Start(ctx, &server.Config{ // nolint
+		TrustedUserCAKeys: string(caPublicKey),
+		RunID:             "run1",
+		SSHServerAddr:     "127.0.0.1",
+		SSHServerPort:     sshPort,
+		HealthCheckAddr:   "127.0.0.1",
+		HealthCheckPort:   hcPort,
+		Command:           "/bin/sh",
+		WorkDir:           workDir,
+		HostKey:           string(hostKey),
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", sshPort)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	runWithCert := func(runID string) (string, error) {
+		client, err := dialWithCert(t, addr, string(hostPublicKey), string(caKey), runID)
+		if err != nil {
+			return "", err
+		}
+		defer client.Close() // nolint
+		session, err := client.NewSession()
+		if err != nil {
+			return "", err
+		}
+		defer session.Close() // nolint
+		out, err := session.Output("echo cert-ok")
+		return string(out), err
+	}
+
+	t.Run("Certificate for the run", func(t *testing.T) {
+		out, err := runWithCert("run1")
+		assert.NoError(t, err)
+		assert.Equal(t, "cert-ok\n", out)
+	})
+	t.Run("Certificate for other run", func(t *testing.T) {
+		_, err := runWithCert("run2")
+		assert.Error(t, err)
+	})
+}
+
+// dialWithCert connects to rarukas-server as root with a new key certified by caKey for runID
+func dialWithCert(t *testing.T, addr, hostPublicKey, caKey, runID string) (*ssh.Client, error) {
+	userPublicKey, userKey, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := IssueUserCert(&UserCertParam{
+		CAKey:      caKey,
+		PublicKey:  string(userPublicKey),
+		Principals: []string{"root"},
+		RunID:      runID,
+		Validity:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSigner, err := ssh.ParsePrivateKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewCertSigner(key.(*ssh.Certificate), userSigner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKeyCallback, err := (&realRunner{cfg: &Config{hostPublicKey: hostPublicKey}}).hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "root",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         5 * time.Second,
+	})
+}
@@ -4,11 +4,37 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/rarukas/rarukas/tarstream"
 )
 
+// DownloadPolicy is when sync-dir and artifacts are downloaded from rarukas-server
+type DownloadPolicy string
+
+const (
+	// DownloadAlways downloads even if the command failed, timed out or was interrupted
+	DownloadAlways DownloadPolicy = "always"
+	// DownloadOnSuccess downloads only if the command succeeded
+	DownloadOnSuccess DownloadPolicy = "on-success"
+	// DownloadNever doesn't download anything
+	DownloadNever DownloadPolicy = "never"
+)
+
+// DownloadPolicies is valid values of DownloadPolicy
+var DownloadPolicies = []string{string(DownloadAlways), string(DownloadOnSuccess), string(DownloadNever)}
+
+// afterFailureDownloadTimeout is timeout of downloading after the command was interrupted
+const afterFailureDownloadTimeout = 2 * time.Minute
+
 // Config is configuration of rarukas cli runner
 type Config struct {
+	// Provider provisions rarukas-server. If nil, rarukas-server is started on Arukas
+	Provider Provider
+	// ProviderFactory creates Provider for each parallel instance. It is used when Provider is nil
+	ProviderFactory func(index int) Provider
+
 	ArukasClient ArukasClient
 	ArukasName   string
 	ArukasPlan   string
@@ -18,25 +44,128 @@ type Config struct {
 
 	PrivateKey string
 	PublicKey  string
+	// AuthorizedKeys are additional keys in authorized_keys format allowed to connect to rarukas-server(e.g. keys of teammates)
+	AuthorizedKeys string
+	// TrustedUserCAKeys are public keys of SSH user CA trusted by rarukas-server.
+	// If set, the runner generates ID of the run, and rarukas-server accepts certificates issued for it by IssueUserCert
+	TrustedUserCAKeys string
+	// KnownHostsFile is known_hosts file to verify host key of rarukas-server(e.g. existing server of static provider).
+	// If empty, rarukas-server uses ephemeral host key generated by the runner, and the runner pins it
+	KnownHostsFile string
 
 	CommandFile string
-	SyncDir     string
-	Commands    []string
+	// SyncDir is local directory synchronized with working directory of rarukas-server
+	SyncDir string
+	// Syncs are additional mappings of local and remote directories
+	Syncs    []*SyncMapping
+	Commands []string
+	// Job is multi-step job definition. If specified, Commands and CommandFile are ignored
+	Job *Job
+	// Env is environment variables passed to the command. They are sent as "env" requests of SSH,
+	// and never stored in the app definition
+	Env map[string]string
+	// Secrets are resolved secrets passed to the command only over SSH session. They are masked in output of the command
+	Secrets []*Secret
+
+	// Parallel is number of instances to run the command in parallel
+	Parallel int
+	// Matrix is combinations of image types and plans to run the command. If nil, use Job.Matrix
+	Matrix *Matrix
+	// MatrixResultDir is local directory to write output and result of each matrix cell
+	MatrixResultDir string
 
 	DownloadOnly bool
 	UploadOnly   bool
+	// DownloadPolicy is when sync-dir and artifacts are downloaded. If empty, DownloadOnSuccess is used
+	DownloadPolicy DownloadPolicy
+
+	// Excludes are gitignore-syntax patterns of files not to be uploaded. They are applied after IgnoreFileName in SyncDir
+	Excludes []string
+	// Includes are patterns of files to be uploaded even if they are excluded
+	Includes []string
+	// DownloadExcludes are patterns of files not to be downloaded. They are applied after upload rules and DownloadIgnoreFileName
+	DownloadExcludes []string
+	// DownloadIncludes are patterns of files to be downloaded even if they are excluded
+	DownloadIncludes []string
+	// MergeStrategy is how downloaded files are merged into SyncDir. If empty, MergeMirror is used
+	MergeStrategy MergeStrategy
+	// Stream is compression of tar stream used to transfer files over one SSH channel.
+	// If empty, files are transferred one by one with SFTP or scp
+	Stream tarstream.Compression
+	// Artifacts are globs of files in workdir of rarukas-server downloaded after the command finished
+	Artifacts []string
+	// ArtifactDir is local directory to save artifacts keeping their relative paths.
+	// If both ArtifactDir and ArtifactArchive are empty, current directory is used
+	ArtifactDir string
+	// ArtifactArchive is local tar.gz or zip file to pack artifacts into
+	ArtifactArchive string
+	// FailOnMissingArtifact makes Artifacts matching no file an error instead of a warning
+	FailOnMissingArtifact bool
+
+	// DryRun prints files to be transferred without running the command
+	DryRun bool
+
+	// TTY requests PTY for the command and puts local terminal in raw mode
+	TTY bool
+
+	// LocalForwards are forwarded while the command is running
+	LocalForwards []*LocalForward
+	// DynamicForwards are SOCKS5 proxies forwarded while the command is running
+	DynamicForwards []*DynamicForward
+	// RemoteForwards are forwarded from rarukas-server to local while the command is running
+	RemoteForwards []*RemoteForward
+	// AllowForwarding enables port forwarding on rarukas-server even if there is no forwards
+	AllowForwarding bool
 
 	BootTimeout time.Duration
 	ExecTimeout time.Duration
 
 	serverTmpDir  string
 	serverWorkDir string
+	// runID is ID of the run passed to rarukas-server trusting TrustedUserCAKeys
+	runID string
+	// acceptEnv are patterns of environment variable names accepted by rarukas-server. If nil, names of Env and Secrets are used
+	acceptEnv []string
+	// hostKey is PEM encoded ephemeral private host key passed to rarukas-server
+	hostKey string
+	// hostPublicKey is public key of hostKey in authorized_keys format. The runner accepts only this host key
+	hostPublicKey string
+	// downloadDir is local directory to download workdir into. If empty, use SyncDir
+	downloadDir string
+	// artifactName is name of parallel instance used to separate artifacts of each instance
+	artifactName string
+	// prefixWriters are outputs of parallel instance
+	prefixWriters []*prefixWriter
 
 	out io.Writer
 	err io.Writer
 	in  io.Reader
 }
 
+func (c *Config) downloadPolicy() DownloadPolicy {
+	if c.DownloadPolicy == "" {
+		return DownloadOnSuccess
+	}
+	return c.DownloadPolicy
+}
+
+func (c *Config) provider() Provider {
+	if c.Provider != nil {
+		return c.Provider
+	}
+	if c.ProviderFactory != nil {
+		return c.ProviderFactory(0)
+	}
+	return NewArukasProvider(&ArukasProviderParam{
+		Client:           c.ArukasClient,
+		Name:             c.ArukasName,
+		Plan:             c.ArukasPlan,
+		RarukasImageType: c.RarukasImageType,
+		ImageName:        c.ArukasImageName,
+		BootTimeout:      c.BootTimeout,
+	})
+}
+
 func (c *Config) hasCommandFile() bool {
 	return c.CommandFile != ""
 }
@@ -45,17 +174,55 @@ func (c *Config) hasSyncDir() bool {
 	return c.SyncDir != ""
 }
 
-func (c *Config) syncDirExists() bool {
-	if !c.hasSyncDir() {
-		return false
-	}
-	_, e := os.Stat(c.SyncDir)
-	return e == nil
-}
-
 func (c *Config) commandFileBase() string {
 	if c.CommandFile == "" {
 		return ""
 	}
 	return filepath.Base(c.CommandFile)
 }
+
+// remoteWorkDir returns working directory on rarukas-server
+func (c *Config) remoteWorkDir() string {
+	workDir := c.serverWorkDir
+	if workDir == "" {
+		workDir = RarukasServerWorkDir
+	}
+	if !strings.HasSuffix(workDir, "/") {
+		workDir += "/"
+	}
+	return workDir
+}
+
+func (c *Config) hasJob() bool {
+	return c.Job != nil
+}
+
+// remoteTmpDir returns temporary directory on rarukas-server without trailing slash
+func (c *Config) remoteTmpDir() string {
+	tmpDir := c.serverTmpDir
+	if tmpDir == "" {
+		tmpDir = RarukasServerTmpDir
+	}
+	return strings.TrimRight(tmpDir, "/")
+}
+
+func (c *Config) stdout() io.Writer {
+	if c.out == nil {
+		return os.Stdout
+	}
+	return c.out
+}
+
+func (c *Config) stderr() io.Writer {
+	if c.err == nil {
+		return os.Stderr
+	}
+	return c.err
+}
+
+func (c *Config) stdin() io.Reader {
+	if c.in == nil {
+		return os.Stdin
+	}
+	return c.in
+}
@@ -0,0 +1,116 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/rarukas/rarukas/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseEnv parses "KEY=VALUE" or "KEY". With "KEY", the value is inherited from local environment,
+// and ok is false if it isn't set. Names always refused by rarukas-server(e.g. PATH) are errors
+func ParseEnv(spec string) (key, value string, ok bool, err error) {
+	key = spec
+	if i := strings.Index(spec, "="); i >= 0 {
+		key, value, ok = spec[:i], spec[i+1:], true
+	} else {
+		value, ok = os.LookupEnv(key)
+	}
+	if !envNameRegexp.MatchString(key) {
+		return "", "", false, fmt.Errorf("%q is invalid name", key)
+	}
+	if server.RefusesEnv(key) {
+		return "", "", false, fmt.Errorf("%q is always refused by rarukas-server", key)
+	}
+	return key, value, ok, nil
+}
+
+// ReadEnvFile reads file that has "KEY=VALUE" or "KEY" per line like env-file of docker.
+// Empty lines and lines starting with "#" are ignored
+func ReadEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint -> return value not checked
+
+	env := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok, err := ParseEnv(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		if ok {
+			env[key] = value
+		}
+	}
+	return env, scanner.Err()
+}
+
+// serverAcceptEnv returns patterns of environment variable names accepted by rarukas-server started by the runner
+func (c *Config) serverAcceptEnv() []string {
+	if c.acceptEnv != nil {
+		return c.acceptEnv
+	}
+	names := sortedKeys(c.Env)
+	for _, secret := range c.Secrets {
+		names = append(names, secret.Name)
+	}
+	return names
+}
+
+// setSessionEnv sends env to rarukas-server as "env" requests.
+// It returns variables refused by the server(e.g. sshd without AcceptEnv) that must be exported by the command.
+// Variables always refused by rarukas-server(e.g. PATH) are dropped, neither sent nor exported
+func setSessionEnv(session *ssh.Session, env map[string]string) map[string]string {
+	refused := map[string]string{}
+	var dropped []string
+	for _, key := range sortedKeys(env) {
+		if server.RefusesEnv(key) {
+			dropped = append(dropped, key)
+			continue
+		}
+		if err := session.Setenv(key, env[key]); err != nil {
+			refused[key] = env[key]
+		}
+	}
+	if len(dropped) > 0 {
+		log.Printf("[WARN] Environment variables(%s) are always refused by rarukas-server, dropped them", strings.Join(dropped, ", "))
+	}
+	if len(refused) > 0 {
+		log.Printf("[WARN] rarukas-server refused environment variables(%s), exporting them in the command instead",
+			strings.Join(sortedKeys(refused), ", "))
+	}
+	return refused
+}
+
+// envExports returns shell statement that exports env
+func envExports(env map[string]string) string {
+	if len(env) == 0 {
+		return ""
+	}
+	var exports []string
+	for _, key := range sortedKeys(env) {
+		exports = append(exports, fmt.Sprintf("%s=%s", key, shellQuote(env[key])))
+	}
+	return fmt.Sprintf("export %s; ", strings.Join(exports, " "))
+}
+
+func sortedKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
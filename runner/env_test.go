@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEnv(t *testing.T) {
+	os.Setenv("RARUKAS_TEST_INHERITED", "inherited") // nolint
+	defer os.Unsetenv("RARUKAS_TEST_INHERITED")      // nolint
+
+	expects := []struct {
+		spec  string
+		key   string
+		value string
+		ok    bool
+		err   bool
+	}{
+		{spec: "FOO=bar", key: "FOO", value: "bar", ok: true},
+		{spec: "FOO=a=b", key: "FOO", value: "a=b", ok: true},
+		{spec: "FOO=", key: "FOO", value: "", ok: true},
+		{spec: "RARUKAS_TEST_INHERITED", key: "RARUKAS_TEST_INHERITED", value: "inherited", ok: true},
+		{spec: "RARUKAS_TEST_NOT_SET", key: "RARUKAS_TEST_NOT_SET", ok: false},
+		{spec: "1FOO=bar", err: true},
+		{spec: "=bar", err: true},
+		{spec: "PATH=/tmp", err: true},
+		{spec: "LD_PRELOAD=/tmp/evil.so", err: true},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.spec, func(t *testing.T) {
+			key, value, ok, err := ParseEnv(expect.spec)
+			if expect.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, expect.key, key)
+			assert.Equal(t, expect.value, value)
+			assert.Equal(t, expect.ok, ok)
+		})
+	}
+}
+
+func TestReadEnvFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	envFile := filepath.Join(tmpDir, ".env")
+	content := "# comment\n\nFOO=bar\n  BAZ=it's baz\nRARUKAS_TEST_NOT_SET\n"
+	if err := ioutil.WriteFile(envFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := ReadEnvFile(envFile)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"FOO": "bar", "BAZ": "it's baz"}, env)
+
+	if err := ioutil.WriteFile(envFile, []byte("FOO=bar\nexport BAZ=baz\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadEnvFile(envFile)
+	assert.EqualError(t, err, `line 2: "export BAZ" is invalid name`)
+}
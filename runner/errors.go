@@ -0,0 +1,73 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoSSHPortMapping is returned when the Arukas service doesn't expose the SSH port of rarukas-server
+var ErrNoSSHPortMapping = errors.New("Arukas service don't have SSH port_mapping")
+
+// RemoteExitError is returned when the command executed on rarukas-server exits with non-zero status
+type RemoteExitError struct {
+	// Status is exit status of remote command. If terminated by signal, it is 128+[signal number]
+	Status int
+	// Signal is name of the signal that terminated the remote command(e.g. "TERM"). Empty if exited normally
+	Signal string
+}
+
+func (e *RemoteExitError) Error() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("Command on rarukas-server was terminated by signal[SIG%s]", e.Signal)
+	}
+	return fmt.Sprintf("Command on rarukas-server exited with status %d", e.Status)
+}
+
+// BootTimeoutError is returned when waiting for bootup of rarukas-server timed out
+type BootTimeoutError struct {
+	Err error
+}
+
+func (e *BootTimeoutError) Error() string {
+	return fmt.Sprintf("Waiting for bootup of Arukas service timed out:\n\terror:%s", e.Err)
+}
+
+// ExecTimeoutError is returned when waiting for completion of command execution timed out
+type ExecTimeoutError struct {
+	Err error
+}
+
+func (e *ExecTimeoutError) Error() string {
+	return fmt.Sprintf("Waiting for completion of command execution on Arukas timed out:\n\terror:%s", e.Err)
+}
+
+// TransferError is returned when uploading/downloading files to/from rarukas-server failed
+type TransferError struct {
+	// Op is kind of transfer operation. "upload" or "download"
+	Op  string
+	Err error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("Transferring files(%s) failed:\n\terror:%s", e.Op, e.Err)
+}
+
+// DownloadConflictError is returned when files were changed on both local and rarukas-server during the run
+type DownloadConflictError struct {
+	// Paths are slash separated paths relative to sync-dir
+	Paths []string
+}
+
+func (e *DownloadConflictError) Error() string {
+	return fmt.Sprintf("Local files changed during the run conflict with files on rarukas-server: %s", strings.Join(e.Paths, ", "))
+}
+
+// MissingArtifactError is returned when artifact globs match no file on rarukas-server
+type MissingArtifactError struct {
+	Globs []string
+}
+
+func (e *MissingArtifactError) Error() string {
+	return fmt.Sprintf("Artifacts matched no file on rarukas-server: %s", strings.Join(e.Globs, ", "))
+}
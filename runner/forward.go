@@ -0,0 +1,312 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// EnvRemoteForwards is name of environment variable that has comma separated addresses of remote forwards
+	EnvRemoteForwards = "RARUKAS_REMOTE_FORWARDS"
+	// EnvRemoteForwardPrefix is prefix of environment variables that have address of each remote forward.
+	// Index starts from 1(e.g. RARUKAS_REMOTE_FORWARD_1)
+	EnvRemoteForwardPrefix = "RARUKAS_REMOTE_FORWARD_"
+
+	defaultForwardBindAddr = "127.0.0.1"
+)
+
+// LocalForward is local port forwarding(like ssh -L) through rarukas-server
+type LocalForward struct {
+	BindAddr   string
+	LocalPort  int
+	RemoteHost string
+	RemotePort int
+}
+
+// ParseLocalForward parses "[bind_address:]port:host:hostport"
+func ParseLocalForward(spec string) (*LocalForward, error) {
+	bindAddr, port, host, hostPort, err := parseForwardSpec(spec, false)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalForward{
+		BindAddr:   bindAddr,
+		LocalPort:  port,
+		RemoteHost: host,
+		RemotePort: hostPort,
+	}, nil
+}
+
+func (f *LocalForward) localAddr() string {
+	return net.JoinHostPort(f.BindAddr, strconv.Itoa(f.LocalPort))
+}
+
+func (f *LocalForward) remoteAddr() string {
+	return net.JoinHostPort(f.RemoteHost, strconv.Itoa(f.RemotePort))
+}
+
+// DynamicForward is dynamic port forwarding(like ssh -D) through rarukas-server. It works as SOCKS5 proxy
+type DynamicForward struct {
+	BindAddr string
+	Port     int
+}
+
+// ParseDynamicForward parses "[bind_address:]port"
+func ParseDynamicForward(spec string) (*DynamicForward, error) {
+	bindAddr := defaultForwardBindAddr
+	strPort := spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		bindAddr = spec[:i]
+		strPort = spec[i+1:]
+	}
+	port, err := parsePort(strPort)
+	if err != nil {
+		return nil, fmt.Errorf("%q has invalid port: %s", spec, err)
+	}
+	return &DynamicForward{BindAddr: bindAddr, Port: port}, nil
+}
+
+func (f *DynamicForward) localAddr() string {
+	return net.JoinHostPort(f.BindAddr, strconv.Itoa(f.Port))
+}
+
+// RemoteForward is remote port forwarding(like ssh -R) through rarukas-server
+type RemoteForward struct {
+	// BindAddr is address on rarukas-server. It must be loopback address
+	BindAddr string
+	// RemotePort is port on rarukas-server. If 0, rarukas-server allocates available port
+	RemotePort int
+	LocalHost  string
+	LocalPort  int
+}
+
+// ParseRemoteForward parses "[bind_address:]port:host:hostport". Port can be 0
+func ParseRemoteForward(spec string) (*RemoteForward, error) {
+	bindAddr, port, host, hostPort, err := parseForwardSpec(spec, true)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteForward{
+		BindAddr:   bindAddr,
+		RemotePort: port,
+		LocalHost:  host,
+		LocalPort:  hostPort,
+	}, nil
+}
+
+func (f *RemoteForward) remoteAddr() string {
+	return net.JoinHostPort(f.BindAddr, strconv.Itoa(f.RemotePort))
+}
+
+func (f *RemoteForward) localAddr() string {
+	return net.JoinHostPort(f.LocalHost, strconv.Itoa(f.LocalPort))
+}
+
+// parseForwardSpec parses "[bind_address:]port:host:hostport"
+func parseForwardSpec(spec string, allowZeroPort bool) (string, int, string, int, error) {
+	parts := strings.Split(spec, ":")
+	bindAddr := defaultForwardBindAddr
+	switch len(parts) {
+	case 3:
+	case 4:
+		bindAddr = parts[0]
+		parts = parts[1:]
+	default:
+		return "", 0, "", 0, fmt.Errorf("%q is invalid format. It must be in [bind_address:]port:host:hostport", spec)
+	}
+
+	port, err := parsePort(parts[0])
+	if allowZeroPort && parts[0] == "0" {
+		port, err = 0, nil
+	}
+	if err != nil {
+		return "", 0, "", 0, fmt.Errorf("%q has invalid port: %s", spec, err)
+	}
+	if parts[1] == "" {
+		return "", 0, "", 0, fmt.Errorf("%q has empty host", spec)
+	}
+	hostPort, err := parsePort(parts[2])
+	if err != nil {
+		return "", 0, "", 0, fmt.Errorf("%q has invalid hostport: %s", spec, err)
+	}
+	return bindAddr, port, parts[1], hostPort, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || 65535 < port {
+		return 0, fmt.Errorf("%d is out of range", port)
+	}
+	return port, nil
+}
+
+func (c *Config) hasForwards() bool {
+	return len(c.LocalForwards) > 0 || len(c.DynamicForwards) > 0 || len(c.RemoteForwards) > 0
+}
+
+// forwarder accepts local connections and forwards them through SSH connection
+type forwarder struct {
+	client    *ssh.Client
+	listeners []net.Listener
+	wg        sync.WaitGroup
+}
+
+// startForwards starts listening ports of LocalForwards, DynamicForwards and RemoteForwards.
+// Addresses of RemoteForwards are added to Env of the command.
+// Returned function stops forwarding. If there is no forwards, it does nothing
+func (r *realRunner) startForwards(host string, port int) (func(), error) {
+	if !r.cfg.hasForwards() {
+		return func() {}, nil
+	}
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{client: client}
+
+	for _, forward := range r.cfg.LocalForwards {
+		remoteAddr := forward.remoteAddr()
+		err := f.listen(forward.localAddr(), func(conn net.Conn) {
+			f.forward(conn, remoteAddr)
+		})
+		if err != nil {
+			f.stop()
+			return nil, err
+		}
+		log.Printf("[INFO] Forwarding %s to %s on rarukas-server", forward.localAddr(), remoteAddr)
+	}
+	for _, forward := range r.cfg.DynamicForwards {
+		err := f.listen(forward.localAddr(), func(conn net.Conn) {
+			f.forwardSOCKS(conn)
+		})
+		if err != nil {
+			f.stop()
+			return nil, err
+		}
+		log.Printf("[INFO] Listening SOCKS5 proxy on %s", forward.localAddr())
+	}
+
+	var remoteAddrs []string
+	env := map[string]string{}
+	for i, forward := range r.cfg.RemoteForwards {
+		localAddr := forward.localAddr()
+		listener, err := client.Listen("tcp", forward.remoteAddr())
+		if err != nil {
+			f.stop()
+			return nil, fmt.Errorf("remote forwarding on %s failed: %s", forward.remoteAddr(), err)
+		}
+		f.serve(listener, func(conn net.Conn) {
+			f.forwardToLocal(conn, localAddr)
+		})
+
+		remoteAddr := listener.Addr().String()
+		remoteAddrs = append(remoteAddrs, remoteAddr)
+		env[fmt.Sprintf("%s%d", EnvRemoteForwardPrefix, i+1)] = remoteAddr
+		log.Printf("[INFO] Forwarding %s on rarukas-server to %s", remoteAddr, localAddr)
+	}
+	if len(remoteAddrs) > 0 {
+		env[EnvRemoteForwards] = strings.Join(remoteAddrs, ",")
+		for k, v := range r.cfg.Env {
+			env[k] = v
+		}
+		r.cfg.Env = env
+	}
+
+	return f.stop, nil
+}
+
+func (f *forwarder) listen(addr string, handler func(conn net.Conn)) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	f.serve(listener, handler)
+	return nil
+}
+
+func (f *forwarder) serve(listener net.Listener, handler func(conn net.Conn)) {
+	f.listeners = append(f.listeners, listener)
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn)
+		}
+	}()
+}
+
+func (f *forwarder) forward(conn net.Conn, remoteAddr string) {
+	defer conn.Close() // nolint -> return value not checked
+
+	remote, err := f.client.Dial("tcp", remoteAddr)
+	if err != nil {
+		log.Printf("[ERROR] Forwarding to %s failed: %s", remoteAddr, err)
+		return
+	}
+	defer remote.Close() // nolint -> return value not checked
+	pipeConn(conn, remote)
+}
+
+func (f *forwarder) forwardToLocal(conn net.Conn, localAddr string) {
+	defer conn.Close() // nolint -> return value not checked
+
+	local, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		log.Printf("[ERROR] Forwarding to %s failed: %s", localAddr, err)
+		return
+	}
+	defer local.Close() // nolint -> return value not checked
+	pipeConn(conn, local)
+}
+
+func (f *forwarder) forwardSOCKS(conn net.Conn) {
+	defer conn.Close() // nolint -> return value not checked
+
+	remote, err := handshakeSOCKS(conn, f.client.Dial)
+	if err != nil {
+		log.Printf("[ERROR] SOCKS5 proxy failed: %s", err)
+		return
+	}
+	defer remote.Close() // nolint -> return value not checked
+	pipeConn(conn, remote)
+}
+
+// stop closes listeners and SSH connection. Forwarded connections are also closed
+func (f *forwarder) stop() {
+	for _, listener := range f.listeners {
+		listener.Close() // nolint -> return value not checked
+	}
+	f.client.Close() // nolint -> return value not checked
+	f.wg.Wait()
+}
+
+// pipeConn copies data between a and b until either of them is closed
+func pipeConn(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b) // nolint -> return value not checked
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a) // nolint -> return value not checked
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,229 @@
+// +build !windows
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLocalForward(t *testing.T) {
+	expects := []struct {
+		spec    string
+		forward *LocalForward
+		err     bool
+	}{
+		{
+			spec:    "8080:localhost:80",
+			forward: &LocalForward{BindAddr: "127.0.0.1", LocalPort: 8080, RemoteHost: "localhost", RemotePort: 80},
+		},
+		{
+			spec:    "0.0.0.0:8080:example.com:443",
+			forward: &LocalForward{BindAddr: "0.0.0.0", LocalPort: 8080, RemoteHost: "example.com", RemotePort: 443},
+		},
+		{spec: "8080", err: true},
+		{spec: "8080:localhost", err: true},
+		{spec: "foo:localhost:80", err: true},
+		{spec: "8080::80", err: true},
+		{spec: "8080:localhost:70000", err: true},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.spec, func(t *testing.T) {
+			forward, err := ParseLocalForward(expect.spec)
+			if expect.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, expect.forward, forward)
+		})
+	}
+}
+
+func TestParseDynamicForward(t *testing.T) {
+	forward, err := ParseDynamicForward("1080")
+	assert.NoError(t, err)
+	assert.Equal(t, &DynamicForward{BindAddr: "127.0.0.1", Port: 1080}, forward)
+
+	forward, err = ParseDynamicForward("0.0.0.0:1080")
+	assert.NoError(t, err)
+	assert.Equal(t, &DynamicForward{BindAddr: "0.0.0.0", Port: 1080}, forward)
+
+	_, err = ParseDynamicForward("localhost")
+	assert.Error(t, err)
+}
+
+func TestParseRemoteForward(t *testing.T) {
+	forward, err := ParseRemoteForward("5432:localhost:15432")
+	assert.NoError(t, err)
+	assert.Equal(t, &RemoteForward{BindAddr: "127.0.0.1", RemotePort: 5432, LocalHost: "localhost", LocalPort: 15432}, forward)
+
+	forward, err = ParseRemoteForward("0:db.local:5432")
+	assert.NoError(t, err)
+	assert.Equal(t, &RemoteForward{BindAddr: "127.0.0.1", RemotePort: 0, LocalHost: "db.local", LocalPort: 5432}, forward)
+
+	_, err = ParseRemoteForward("5432:localhost:0")
+	assert.Error(t, err)
+}
+
+func TestRemoteForwardWithLocalProvider(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // nolint
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("pong\n")) // nolint
+			conn.Close()                 // nolint
+		}
+	}()
+	localPort := listener.Addr().(*net.TCPAddr).Port
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+	commandFile := filepath.Join(tmpDir, "remote-forward.bash")
+	script := `host=${RARUKAS_REMOTE_FORWARD_1%:*}
+port=${RARUKAS_REMOTE_FORWARD_1##*:}
+cat < /dev/tcp/$host/$port
+`
+	if err := ioutil.WriteFile(commandFile, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	stdOut := &bytes.Buffer{}
+	cfg := &Config{
+		Provider: NewLocalProvider(&LocalProviderParam{
+			BootTimeout: 10 * time.Second,
+		}),
+		CommandFile: commandFile,
+		ExecTimeout: 10 * time.Second,
+		RemoteForwards: []*RemoteForward{
+			{BindAddr: "127.0.0.1", RemotePort: 0, LocalHost: "127.0.0.1", LocalPort: localPort},
+		},
+		out: stdOut,
+		err: ioutil.Discard,
+	}
+
+	assert.NoError(t, Run(ctx, cfg))
+	assert.Equal(t, "pong\n", stdOut.String())
+	assert.Regexp(t, `^127\.0\.0\.1:[0-9]+$`, cfg.Env[EnvRemoteForwards])
+	assert.Equal(t, cfg.Env[EnvRemoteForwards], cfg.Env[EnvRemoteForwardPrefix+"1"])
+}
+
+func TestForwardWithLocalProvider(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("forwarded")) // nolint
+	}))
+	defer target.Close()
+	targetURL, err := url.Parse(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetPort, err := strconv.Atoi(targetURL.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	socksPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cfg := &Config{
+		Provider: NewLocalProvider(&LocalProviderParam{
+			BootTimeout: 10 * time.Second,
+		}),
+		// keep running until forwarded ports are checked
+		Commands:    []string{"while [ ! -f done ]; do sleep 0.1; done"},
+		ExecTimeout: 20 * time.Second,
+		LocalForwards: []*LocalForward{
+			{BindAddr: "127.0.0.1", LocalPort: localPort, RemoteHost: "127.0.0.1", RemotePort: targetPort},
+		},
+		DynamicForwards: []*DynamicForward{
+			{BindAddr: "127.0.0.1", Port: socksPort},
+		},
+		out: &bytes.Buffer{},
+		err: ioutil.Discard,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- Run(ctx, cfg)
+	}()
+
+	t.Run("Local forward", func(t *testing.T) {
+		body, err := getWithRetry(ctx, http.DefaultClient, fmt.Sprintf("http://127.0.0.1:%d/", localPort))
+		assert.NoError(t, err)
+		assert.Equal(t, "forwarded", body)
+	})
+
+	t.Run("Dynamic forward", func(t *testing.T) {
+		proxyURL, _ := url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", socksPort))
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		body, err := getWithRetry(ctx, client, target.URL)
+		assert.NoError(t, err)
+		assert.Equal(t, "forwarded", body)
+	})
+
+	// finish the command
+	assert.NoError(t, ioutil.WriteFile(cfg.serverWorkDir+"/done", []byte{}, 0644))
+	assert.NoError(t, <-errChan)
+
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	assert.Error(t, err, "forwarding should be stopped after the command finished")
+}
+
+func getWithRetry(ctx context.Context, client *http.Client, url string) (string, error) {
+	for {
+		res, err := client.Get(url)
+		if err == nil {
+			defer res.Body.Close() // nolint
+			body, err := ioutil.ReadAll(res.Body)
+			return string(body), err
+		}
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// Job is a definition of ordered steps executed on one rarukas-server
+type Job struct {
+	// Matrix is combinations of image types and plans to run the job
+	Matrix *Matrix `yaml:"matrix"`
+	Steps  []*Step `yaml:"steps"`
+}
+
+// Step is a definition of one step of the Job
+type Step struct {
+	// Name is name of the step. It is used in status output
+	Name string `yaml:"name"`
+	// Command is shell command(s) to execute. Either Command or Script is required.
+	// Commands run with "set -e", so the step fails at the first failing line
+	Command string `yaml:"command"`
+	// Script is path to local script file to execute
+	Script string `yaml:"script"`
+	// WorkDir is working directory of the step. Relative path is resolved from the working directory of rarukas-server
+	WorkDir string `yaml:"workdir"`
+	// Env is environment variables of the step
+	Env map[string]string `yaml:"env"`
+	// Timeout is timeout duration of the step. If zero, only exec-timeout is applied
+	Timeout time.Duration `yaml:"timeout"`
+	// ContinueOnError is flag to continue the job even if the step failed
+	ContinueOnError bool `yaml:"continue-on-error"`
+	// AlwaysRun is flag to run the step even if previous step failed, exec-timeout expired or the job was interrupted.
+	// After exec-timeout or interruption, the step runs with alwaysRunTimeout
+	AlwaysRun bool `yaml:"always-run"`
+}
+
+// StepStatus is status of the step
+type StepStatus string
+
+const (
+	// StepSucceeded means the step exited with status 0
+	StepSucceeded StepStatus = "succeeded"
+	// StepFailed means the step exited with non-zero status or timed out
+	StepFailed StepStatus = "failed"
+	// StepSkipped means the step didn't run because previous step failed
+	StepSkipped StepStatus = "skipped"
+)
+
+// StepResult is result of the step execution
+type StepResult struct {
+	Name     string
+	Status   StepStatus
+	Duration time.Duration
+	Err      error
+}
+
+// alwaysRunTimeout is timeout duration of always-run steps after exec-timeout expired or the job was interrupted
+const alwaysRunTimeout = time.Minute
+
+var envNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LoadJobFile reads job definition from YAML file.
+// Relative script paths are resolved from the directory of the job file
+func LoadJobFile(path string) (*Job, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+	if err := yaml.UnmarshalStrict(data, job); err != nil {
+		return nil, fmt.Errorf("parsing job file %q failed: %s", path, err)
+	}
+
+	baseDir := filepath.Dir(path)
+	for _, step := range job.Steps {
+		if step.Script != "" && !filepath.IsAbs(step.Script) {
+			step.Script = filepath.Join(baseDir, step.Script)
+		}
+	}
+
+	if job.Matrix != nil {
+		if err := job.Matrix.Validate(); err != nil {
+			return nil, fmt.Errorf("job file %q has invalid matrix: %s", path, err)
+		}
+	}
+	if err := job.Validate(); err != nil {
+		return nil, fmt.Errorf("job file %q is invalid: %s", path, err)
+	}
+	return job, nil
+}
+
+// Validate validates the job definition
+func (j *Job) Validate() error {
+	if len(j.Steps) == 0 {
+		return errors.New("steps are empty")
+	}
+
+	names := map[string]bool{}
+	for i, step := range j.Steps {
+		if step.Name == "" {
+			return fmt.Errorf("steps[%d]: name is required", i)
+		}
+		if names[step.Name] {
+			return fmt.Errorf("steps[%d]: name %q is duplicated", i, step.Name)
+		}
+		names[step.Name] = true
+
+		if (step.Command == "") == (step.Script == "") {
+			return fmt.Errorf("step %q: either command or script is required", step.Name)
+		}
+		if step.Script != "" {
+			if fi, err := os.Stat(step.Script); err != nil || fi.IsDir() {
+				return fmt.Errorf("step %q: script %q is not exists", step.Name, step.Script)
+			}
+		}
+		if step.Timeout < 0 {
+			return fmt.Errorf("step %q: timeout must be positive", step.Name)
+		}
+		for key := range step.Env {
+			if !envNameRegexp.MatchString(key) {
+				return fmt.Errorf("step %q: env %q is invalid name", step.Name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// remoteScriptPath returns the path of the wrapper script of i-th step on rarukas-server
+func (j *Job) remoteScriptPath(tmpDir string, i int) string {
+	return fmt.Sprintf("%s/rarukas-step-%d.sh", strings.TrimRight(tmpDir, "/"), i+1)
+}
+
+// remoteStepScriptPath returns the path of the script file of i-th step on rarukas-server
+func (j *Job) remoteStepScriptPath(tmpDir string, i int) string {
+	return fmt.Sprintf("%s/rarukas-step-%d-%s", strings.TrimRight(tmpDir, "/"), i+1, filepath.Base(j.Steps[i].Script))
+}
+
+// wrapperScript builds the script that prepares workdir/env of the step and runs i-th step.
+// Env of Config is not written in the script, but sent to rarukas-server by runStep
+func (j *Job) wrapperScript(tmpDir string, i int) string {
+	step := j.Steps[i]
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintln(buf, "#!/bin/bash") // nolint
+	fmt.Fprintln(buf, "set -e")      // nolint
+	if step.WorkDir != "" {
+		fmt.Fprintf(buf, "cd %s\n", shellQuote(step.WorkDir)) // nolint
+	}
+
+	for _, key := range sortedKeys(step.Env) {
+		fmt.Fprintf(buf, "export %s=%s\n", key, shellQuote(step.Env[key])) // nolint
+	}
+
+	if step.Script != "" {
+		fmt.Fprintf(buf, "exec /bin/bash %s\n", shellQuote(j.remoteStepScriptPath(tmpDir, i))) // nolint
+		return buf.String()
+	}
+
+	// command stops at the first failing line, and reports the line relative to the command
+	offset := bytes.Count(buf.Bytes(), []byte("\n")) + 1
+	fmt.Fprintf(buf, "trap 'echo \"failed at line $((LINENO-%d)) with status $?: $BASH_COMMAND\" >&2' ERR\n", offset) // nolint
+	fmt.Fprintln(buf, step.Command)                                                                                   // nolint
+	return buf.String()
+}
+
+func (r *realRunner) runJob(ctx context.Context, host string, port int) error {
+	execCtx, cancel := context.WithTimeout(ctx, r.cfg.ExecTimeout)
+	defer cancel()
+
+	job := r.cfg.Job
+	tmpDir := r.cfg.remoteTmpDir()
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		return err
+	}
+	defer client.Close() // nolint -> return value not checked
+
+	if err := r.uploadJobScripts(execCtx, client, tmpDir); err != nil {
+		return transferError(ctx, "upload", err)
+	}
+
+	var results []*StepResult
+	var jobErr error
+	// interrupted is true after exec-timeout expired or ctx was canceled
+	interrupted := false
+	for i, step := range job.Steps {
+		result := &StepResult{Name: step.Name}
+		results = append(results, result)
+
+		if !interrupted && execCtx.Err() != nil {
+			interrupted = true
+			jobErr = interruptedError(ctx, execCtx)
+		}
+		if jobErr != nil && !step.AlwaysRun {
+			result.Status = StepSkipped
+			log.Printf("[INFO] Step[%d/%d] %q skipped\n", i+1, len(job.Steps), step.Name)
+			continue
+		}
+
+		log.Printf("[INFO] Step[%d/%d] %q started\n", i+1, len(job.Steps), step.Name)
+		start := time.Now()
+		var err error
+		if interrupted {
+			// always-run steps such as cleanup still run with short deadline
+			alwaysRunCtx, cancel := context.WithTimeout(context.Background(), alwaysRunTimeout)
+			err = r.runStep(alwaysRunCtx, alwaysRunCtx, client, step, fmt.Sprintf("/bin/bash %s", shellQuote(job.remoteScriptPath(tmpDir, i))))
+			cancel()
+		} else {
+			err = r.runStep(ctx, execCtx, client, step, fmt.Sprintf("/bin/bash %s", shellQuote(job.remoteScriptPath(tmpDir, i))))
+		}
+		result.Duration = time.Since(start)
+		result.Err = err
+
+		if err == nil {
+			result.Status = StepSucceeded
+			log.Printf("[INFO] Step[%d/%d] %q succeeded (%s)\n", i+1, len(job.Steps), step.Name, formatDuration(result.Duration))
+			continue
+		}
+
+		result.Status = StepFailed
+		log.Printf("[ERROR] Step[%d/%d] %q failed (%s): %s\n", i+1, len(job.Steps), step.Name, formatDuration(result.Duration), err)
+		switch {
+		case interrupted:
+			// jobErr is already the timeout or interruption
+		case execCtx.Err() != nil:
+			// timeout or interruption takes precedence over errors of previous steps
+			interrupted = true
+			jobErr = interruptedError(ctx, execCtx)
+		case !step.ContinueOnError && jobErr == nil:
+			jobErr = err
+		}
+	}
+
+	printStepResults(results)
+	return jobErr
+}
+
+// interruptedError returns ctx.Err() if ctx was canceled, or ExecTimeoutError if exec-timeout of execCtx expired
+func interruptedError(ctx, execCtx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &ExecTimeoutError{Err: execCtx.Err()}
+}
+
+func (r *realRunner) uploadJobScripts(ctx context.Context, client *ssh.Client, tmpDir string) error {
+	errChan := make(chan error, 1)
+	go func() {
+		transfer := newFileTransfer(client)
+		defer transfer.Close() // nolint -> return value not checked
+
+		job := r.cfg.Job
+		for i, step := range job.Steps {
+			if step.Script != "" {
+				if err := transfer.SendFile(step.Script, job.remoteStepScriptPath(tmpDir, i)); err != nil {
+					errChan <- err
+					return
+				}
+			}
+
+			script := job.wrapperScript(tmpDir, i)
+			if err := transfer.WriteFile(job.remoteScriptPath(tmpDir, i), []byte(script), 0644); err != nil {
+				errChan <- err
+				return
+			}
+		}
+		errChan <- nil
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runStep runs the command of the step in new session on client.
+// ctx is parent context of the job, and execCtx has exec-timeout
+func (r *realRunner) runStep(ctx, execCtx context.Context, client *ssh.Client, step *Step, cmd string) error {
+	stepCtx := execCtx
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		stepCtx, cancel = context.WithTimeout(execCtx, step.Timeout)
+		defer cancel()
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close() // nolint -> return value not checked
+
+	cmd, flush, err := r.prepareSession(session, cmd)
+	if err != nil {
+		return err
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		err := session.Run(cmd)
+		flush()
+		errChan <- err
+	}()
+
+	select {
+	case err := <-errChan:
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return &RemoteExitError{Status: exitErr.ExitStatus(), Signal: exitErr.Signal()}
+		}
+		return err
+	case <-stepCtx.Done():
+		session.Signal(ssh.SIGTERM) // nolint -> return value not checked
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if execCtx.Err() != nil {
+			return &ExecTimeoutError{Err: execCtx.Err()}
+		}
+		return &ExecTimeoutError{Err: fmt.Errorf("step %q timed out after %s", step.Name, step.Timeout)}
+	}
+}
+
+func printStepResults(results []*StepResult) {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tSTEP\tSTATUS\tDURATION") // nolint
+	for _, result := range results {
+		duration := "-"
+		if result.Status != StepSkipped {
+			duration = formatDuration(result.Duration)
+		}
+		fmt.Fprintf(w, "\t%s\t%s\t%s\n", result.Name, result.Status, duration) // nolint
+	}
+	w.Flush() // nolint
+	log.Printf("[INFO] Job summary:\n%s", buf.String())
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// shellQuote quotes s as one word of bash
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
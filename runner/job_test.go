@@ -0,0 +1,158 @@
+// +build !windows
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadJobFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint
+
+	writeJob := func(body string) string {
+		path := filepath.Join(dir, "job.yml")
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("Valid job", func(t *testing.T) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "apply.sh"), []byte("echo apply"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		job, err := LoadJobFile(writeJob(`
+steps:
+  - name: init
+    command: echo init
+    timeout: 1m
+    env:
+      FOO: bar
+  - name: apply
+    script: apply.sh
+    always-run: true
+`))
+		assert.NoError(t, err)
+		assert.Len(t, job.Steps, 2)
+		assert.Equal(t, time.Minute, job.Steps[0].Timeout)
+		assert.Equal(t, filepath.Join(dir, "apply.sh"), job.Steps[1].Script)
+		assert.True(t, job.Steps[1].AlwaysRun)
+	})
+
+	cases := map[string]string{
+		"Empty steps":         `steps: []`,
+		"Unknown key":         "steps:\n  - name: a\n    command: ls\n    foo: bar",
+		"Name is missing":     "steps:\n  - command: ls",
+		"Duplicated name":     "steps:\n  - name: a\n    command: ls\n  - name: a\n    command: ls",
+		"Command and script":  "steps:\n  - name: a\n    command: ls\n    script: apply.sh",
+		"Script not exists":   "steps:\n  - name: a\n    script: not-exists.sh",
+		"Invalid env name":    "steps:\n  - name: a\n    command: ls\n    env:\n      FOO-BAR: baz",
+		"Neither command nor": "steps:\n  - name: a",
+	}
+	for name, body := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadJobFile(writeJob(body))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestRunJob(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	stdErr := &bytes.Buffer{}
+	run := func(job *Job, execTimeout time.Duration) (string, error) {
+		stdOut := &bytes.Buffer{}
+		stdErr.Reset()
+		cfg := &Config{
+			Provider: NewLocalProvider(&LocalProviderParam{
+				BootTimeout: 10 * time.Second,
+			}),
+			Job:         job,
+			ExecTimeout: execTimeout,
+			out:         stdOut,
+			err:         stdErr,
+		}
+		err := Run(ctx, cfg)
+		return stdOut.String(), err
+	}
+
+	t.Run("All steps succeeded", func(t *testing.T) {
+		out, err := run(&Job{Steps: []*Step{
+			{Name: "first", Command: "mkdir sub && echo 'first' > sub/out.txt"},
+			{Name: "second", Command: "cat out.txt\necho $FOO", WorkDir: "sub", Env: map[string]string{"FOO": "it's bar"}},
+		}}, 20*time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "first\nit's bar\n", out)
+	})
+
+	t.Run("Failed step skips following steps except always-run", func(t *testing.T) {
+		out, err := run(&Job{Steps: []*Step{
+			{Name: "ignored", Command: "exit 1", ContinueOnError: true},
+			{Name: "fail", Command: "echo fail; exit 3"},
+			{Name: "skipped", Command: "echo skipped"},
+			{Name: "always", Command: "echo always", AlwaysRun: true},
+		}}, 20*time.Second)
+		assert.Equal(t, "fail\nalways\n", out)
+		if assert.IsType(t, &RemoteExitError{}, err) {
+			assert.Equal(t, 3, err.(*RemoteExitError).Status)
+		}
+	})
+
+	t.Run("Quoted arguments and paths with space", func(t *testing.T) {
+		defer setTmpDirWithSpace(t)()
+
+		out, err := run(&Job{Steps: []*Step{
+			{Name: "mkdir", Command: "mkdir 'dir with space'"},
+			{Name: "quoted", Command: `printf '%s|' "a b" 'c  d' "$(basename "$PWD")"`, WorkDir: "dir with space"},
+		}}, 20*time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "a b|c  d|dir with space|", out)
+	})
+
+	t.Run("Failed line stops the step", func(t *testing.T) {
+		out, err := run(&Job{Steps: []*Step{
+			{Name: "multi-line", Command: "echo init\nls /rarukas-not-exists\necho plan"},
+		}}, 20*time.Second)
+		assert.Equal(t, "init\n", out)
+		assert.Contains(t, stdErr.String(), "failed at line 2 with status 2: ls /rarukas-not-exists")
+		if assert.IsType(t, &RemoteExitError{}, err) {
+			assert.Equal(t, 2, err.(*RemoteExitError).Status)
+		}
+	})
+
+	t.Run("Step timeout", func(t *testing.T) {
+		_, err := run(&Job{Steps: []*Step{
+			{Name: "sleep", Command: "sleep 10", Timeout: 500 * time.Millisecond},
+		}}, 20*time.Second)
+		assert.IsType(t, &ExecTimeoutError{}, err)
+	})
+
+	t.Run("Exec timeout runs always-run steps", func(t *testing.T) {
+		out, err := run(&Job{Steps: []*Step{
+			{Name: "sleep", Command: "sleep 10"},
+			{Name: "skipped", Command: "echo skipped"},
+			{Name: "cleanup", Command: "echo cleanup", AlwaysRun: true},
+		}}, 2*time.Second)
+		assert.Equal(t, "cleanup\n", out)
+		assert.IsType(t, &ExecTimeoutError{}, err)
+	})
+}
@@ -0,0 +1,271 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/yamamoto-febc/go-arukas"
+)
+
+const (
+	// EnvMatrixType is name of environment variable that has image type of the matrix cell
+	EnvMatrixType = "RARUKAS_MATRIX_TYPE"
+	// EnvMatrixPlan is name of environment variable that has plan of the matrix cell
+	EnvMatrixPlan = "RARUKAS_MATRIX_PLAN"
+
+	matrixKeyType = "type"
+	matrixKeyPlan = "plan"
+)
+
+// Matrix is combinations of image types and plans to run the command
+type Matrix struct {
+	// Types is list of image types. If empty, use RarukasImageType of Config
+	Types []string `yaml:"type"`
+	// Plans is list of plans. If empty, use ArukasPlan of Config
+	Plans []string `yaml:"plan"`
+}
+
+// MatrixCell is one combination of the Matrix
+type MatrixCell struct {
+	Type string
+	Plan string
+}
+
+// ParseMatrix parses expressions like "type=alpine,debian" or "plan=free,hobby"
+func ParseMatrix(exprs []string) (*Matrix, error) {
+	m := &Matrix{}
+	for _, expr := range exprs {
+		kv := strings.SplitN(expr, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%q is invalid format. It must be in [key]=[value1],[value2]", expr)
+		}
+
+		var values []string
+		for _, v := range strings.Split(kv[1], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+
+		switch strings.TrimSpace(kv[0]) {
+		case matrixKeyType:
+			m.Types = append(m.Types, values...)
+		case matrixKeyPlan:
+			m.Plans = append(m.Plans, values...)
+		default:
+			return nil, fmt.Errorf("%q has invalid key. It must be in [%s/%s]", expr, matrixKeyType, matrixKeyPlan)
+		}
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Validate validates values of the matrix
+func (m *Matrix) Validate() error {
+	if len(m.Types) == 0 && len(m.Plans) == 0 {
+		return errors.New("matrix is empty")
+	}
+	if err := validateMatrixValues(matrixKeyType, m.Types, RarukasImageTypes); err != nil {
+		return err
+	}
+	return validateMatrixValues(matrixKeyPlan, m.Plans, arukas.ValidPlans)
+}
+
+func validateMatrixValues(key string, values, validValues []string) error {
+	exists := map[string]bool{}
+	for _, v := range values {
+		if !contains(validValues, v) {
+			return fmt.Errorf("%s %q must be in [%s]", key, v, strings.Join(validValues, "/"))
+		}
+		if exists[v] {
+			return fmt.Errorf("%s %q is duplicated", key, v)
+		}
+		exists[v] = true
+	}
+	return nil
+}
+
+// Cells returns all combinations of the matrix
+func (m *Matrix) Cells() []*MatrixCell {
+	types := m.Types
+	if len(types) == 0 {
+		types = []string{""}
+	}
+	plans := m.Plans
+	if len(plans) == 0 {
+		plans = []string{""}
+	}
+
+	var cells []*MatrixCell
+	for _, t := range types {
+		for _, p := range plans {
+			cells = append(cells, &MatrixCell{Type: t, Plan: p})
+		}
+	}
+	return cells
+}
+
+func (c *Config) matrix() *Matrix {
+	if c.Matrix != nil {
+		return c.Matrix
+	}
+	if c.Job != nil {
+		return c.Job.Matrix
+	}
+	return nil
+}
+
+func runMatrix(ctx context.Context, cfg *Config) error {
+	if cfg.Parallel > 1 {
+		return errors.New("Parallel can't be used with Matrix")
+	}
+	if err := prepareInstances(cfg); err != nil {
+		return err
+	}
+
+	if cfg.MatrixResultDir != "" {
+		if err := os.MkdirAll(cfg.MatrixResultDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	mu := &sync.Mutex{}
+	cells := cfg.matrix().Cells()
+	var instances []*Config
+	for i, cell := range cells {
+		instCfg := cfg.cellConfig(i, cell, mu)
+		if cfg.MatrixResultDir != "" {
+			f, err := os.Create(filepath.Join(cfg.MatrixResultDir, instCfg.ArukasName+".log"))
+			if err != nil {
+				return err
+			}
+			defer f.Close() // nolint
+			instCfg.out = io.MultiWriter(instCfg.out, f)
+			instCfg.err = io.MultiWriter(instCfg.err, f)
+		}
+		instances = append(instances, instCfg)
+	}
+
+	results := runInstances(ctx, instances)
+	printMatrixResults(instances, results)
+	if cfg.MatrixResultDir != "" {
+		if err := writeMatrixResults(filepath.Join(cfg.MatrixResultDir, "results.json"), instances, results); err != nil {
+			log.Printf("[ERROR] Writing matrix results failed: %s\n", err)
+		}
+	}
+	return instancesError(ctx, results)
+}
+
+// cellConfig returns copy of the Config for the matrix cell
+func (c *Config) cellConfig(i int, cell *MatrixCell, mu *sync.Mutex) *Config {
+	instCfg := *c
+	instCfg.Matrix = nil
+	instCfg.Job = nil
+	if c.Job != nil {
+		job := *c.Job
+		job.Matrix = nil
+		instCfg.Job = &job
+	}
+
+	names := []string{c.ArukasName}
+	instCfg.Env = map[string]string{}
+	for k, v := range c.Env {
+		instCfg.Env[k] = v
+	}
+	if cell.Type != "" {
+		instCfg.RarukasImageType = cell.Type
+		names = append(names, cell.Type)
+	}
+	if cell.Plan != "" {
+		instCfg.ArukasPlan = cell.Plan
+		names = append(names, cell.Plan)
+	}
+	instCfg.Env[EnvMatrixType] = instCfg.RarukasImageType
+	instCfg.Env[EnvMatrixPlan] = instCfg.ArukasPlan
+	instCfg.ArukasName = strings.Join(names, "-")
+
+	if c.ProviderFactory != nil {
+		instCfg.Provider = c.ProviderFactory(i)
+	}
+	instCfg.setupInstanceSyncs()
+	if c.hasArtifacts() {
+		instCfg.artifactName = instCfg.ArukasName
+	}
+
+	instCfg.setupInstanceOutput(c, mu)
+	return &instCfg
+}
+
+func matrixResult(result *InstanceResult) string {
+	if result.Err != nil {
+		return "FAIL"
+	}
+	return "PASS"
+}
+
+func printMatrixResults(instances []*Config, results []*InstanceResult) {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tCELL\tTYPE\tPLAN\tRESULT\tDURATION") // nolint
+	for i, result := range results {
+		fmt.Fprintf(w, "\t%s\t%s\t%s\t%s\t%s\n", // nolint
+			result.Name, instances[i].RarukasImageType, instances[i].ArukasPlan, matrixResult(result), formatDuration(result.Duration))
+	}
+	w.Flush() // nolint
+	log.Printf("[INFO] Matrix summary:\n%s", buf.String())
+}
+
+type matrixCellResult struct {
+	Cell     string `json:"cell"`
+	Type     string `json:"type"`
+	Plan     string `json:"plan"`
+	Result   string `json:"result"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+func writeMatrixResults(path string, instances []*Config, results []*InstanceResult) error {
+	var cellResults []*matrixCellResult
+	for i, result := range results {
+		r := &matrixCellResult{
+			Cell:     result.Name,
+			Type:     instances[i].RarukasImageType,
+			Plan:     instances[i].ArukasPlan,
+			Result:   matrixResult(result),
+			Duration: formatDuration(result.Duration),
+		}
+		if result.Err != nil {
+			r.Error = result.Err.Error()
+		}
+		cellResults = append(cellResults, r)
+	}
+
+	data, err := json.MarshalIndent(cellResults, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
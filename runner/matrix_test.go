@@ -0,0 +1,100 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMatrix(t *testing.T) {
+
+	t.Run("Valid expressions", func(t *testing.T) {
+		m, err := ParseMatrix([]string{"type=alpine, debian", "plan=free,hobby"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alpine", "debian"}, m.Types)
+		assert.Equal(t, []string{"free", "hobby"}, m.Plans)
+		assert.Equal(t, []*MatrixCell{
+			{Type: "alpine", Plan: "free"},
+			{Type: "alpine", Plan: "hobby"},
+			{Type: "debian", Plan: "free"},
+			{Type: "debian", Plan: "hobby"},
+		}, m.Cells())
+	})
+
+	t.Run("Only type", func(t *testing.T) {
+		m, err := ParseMatrix([]string{"type=alpine,centos"})
+		assert.NoError(t, err)
+		assert.Equal(t, []*MatrixCell{{Type: "alpine"}, {Type: "centos"}}, m.Cells())
+	})
+
+	for _, exprs := range [][]string{
+		{},
+		{"type"},
+		{"type="},
+		{"os=alpine"},
+		{"type=windows"},
+		{"plan=free,free"},
+	} {
+		_, err := ParseMatrix(exprs)
+		assert.Error(t, err, "%v", exprs)
+	}
+}
+
+func TestRunMatrix(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	resultDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(resultDir) // nolint
+
+	cfg := &Config{
+		ProviderFactory: func(int) Provider {
+			return NewLocalProvider(&LocalProviderParam{BootTimeout: 10 * time.Second})
+		},
+		ArukasName:       "test",
+		ArukasPlan:       "free",
+		RarukasImageType: "alpine",
+		Matrix:           &Matrix{Types: []string{"alpine", "debian"}},
+		MatrixResultDir:  resultDir,
+		Commands:         []string{`echo $RARUKAS_MATRIX_TYPE-$RARUKAS_MATRIX_PLAN; test $RARUKAS_MATRIX_TYPE = alpine`},
+		ExecTimeout:      20 * time.Second,
+		out:              ioutil.Discard,
+		err:              ioutil.Discard,
+	}
+
+	err = Run(ctx, cfg)
+	if assert.IsType(t, &ParallelError{}, err) {
+		assert.Len(t, err.(*ParallelError).FailedErrors(), 1)
+	}
+
+	for name, expect := range map[string]string{"test-alpine": "alpine-free\n", "test-debian": "debian-free\n"} {
+		data, err := ioutil.ReadFile(filepath.Join(resultDir, name+".log"))
+		assert.NoError(t, err)
+		assert.Equal(t, expect, string(data))
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(resultDir, "results.json"))
+	assert.NoError(t, err)
+	var results []*matrixCellResult
+	assert.NoError(t, json.Unmarshal(data, &results))
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, "PASS", results[0].Result)
+		assert.Equal(t, "FAIL", results[1].Result)
+		assert.Equal(t, "debian", results[1].Type)
+	}
+}
@@ -0,0 +1,390 @@
+package runner
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rarukas/rarukas/manifest"
+)
+
+// MergeStrategy is how downloaded files are merged into local sync-dir
+type MergeStrategy string
+
+const (
+	// MergeMirror makes local sync-dir same as workdir of rarukas-server. Local files that don't exist on rarukas-server are deleted
+	MergeMirror MergeStrategy = "mirror"
+	// MergeOverlay adds and updates local files only. No local file is deleted
+	MergeOverlay MergeStrategy = "overlay"
+	// MergeFailOnConflict works like MergeMirror, but keeps local files changed during the run,
+	// and fails without changing anything if they were also changed on rarukas-server
+	MergeFailOnConflict MergeStrategy = "fail-on-conflict"
+)
+
+// MergeStrategies is valid values of MergeStrategy
+var MergeStrategies = []string{string(MergeMirror), string(MergeOverlay), string(MergeFailOnConflict)}
+
+// BackupDirName is name of directory in local download directory that has backups of local files replaced or deleted by download.
+// It is never uploaded nor downloaded
+const BackupDirName = ".rarukas-backup"
+
+// backupTimeFormat is format of timestamp of backup directory in BackupDirName
+const backupTimeFormat = "20060102-150405"
+
+// backupRetention is number of backup directories kept in BackupDirName. Older ones are removed after download
+const backupRetention = 10
+
+// excludeBackupDir returns copy of rules that excludes BackupDirName at any level at the end
+func excludeBackupDir(rules *manifest.Rules) *manifest.Rules {
+	excluded := manifest.NewRules()
+	excluded.Append(rules)
+	excluded.Add(BackupDirName + "/")
+	return excluded
+}
+
+// mergeStrategy returns MergeStrategy of c. If empty, MergeMirror is returned
+func (c *Config) mergeStrategy() MergeStrategy {
+	if c.MergeStrategy == "" {
+		return MergeMirror
+	}
+	return c.MergeStrategy
+}
+
+// applyMergeStrategy removes entries from diff that must not be applied to local sync-dir by strategy
+func applyMergeStrategy(strategy MergeStrategy, diff *manifest.Diff, remote *manifest.Manifest) {
+	if strategy != MergeOverlay {
+		return
+	}
+	// local entries are deleted only if they are replaced by entries of different type
+	var deleted []*manifest.Entry
+	for _, e := range diff.Deleted {
+		if _, exists := remote.Entries[e.Path]; exists {
+			deleted = append(deleted, e)
+		}
+	}
+	diff.Deleted = deleted
+}
+
+// resolveConflicts compares local and remote with baselines taken before the run.
+// Entries changed only on local are removed from diff so that they are kept.
+// If entries are changed on both sides, it returns DownloadConflictError.
+// If remoteBase is nil(nothing was uploaded), all remote entries are treated as changed
+func resolveConflicts(diff *manifest.Diff, local, localBase, remote, remoteBase *manifest.Manifest) error {
+	var conflicts []string
+	keep := func(entries []*manifest.Entry) []*manifest.Entry {
+		var kept []*manifest.Entry
+		for _, e := range entries {
+			if !changedUnder(localBase, local, e.Path) {
+				kept = append(kept, e)
+				continue
+			}
+			if remoteBase == nil || changedUnder(remoteBase, remote, e.Path) {
+				conflicts = append(conflicts, e.Path)
+			}
+		}
+		return kept
+	}
+	diff.Deleted = keep(diff.Deleted)
+	diff.Files = keep(diff.Files)
+
+	if len(conflicts) > 0 {
+		return &DownloadConflictError{Paths: conflicts}
+	}
+	return nil
+}
+
+// changedUnder returns true if p or entries under p differ between a and b
+func changedUnder(a, b *manifest.Manifest, p string) bool {
+	differs := func(x, y *manifest.Manifest) bool {
+		for path, e := range x.Entries {
+			if path != p && !strings.HasPrefix(path, p+"/") {
+				continue
+			}
+			other, exists := y.Entries[path]
+			if !exists || other.Dir != e.Dir || other.Hash != e.Hash {
+				return true
+			}
+		}
+		return false
+	}
+	return differs(a, b) || differs(b, a)
+}
+
+// localMerger applies Diff to local directory. Downloaded files are staged in temporary directory at first,
+// and moved into local directory by rename after all files are downloaded.
+// Local files to be replaced or deleted are saved into backup directory named with timestamp and run ID
+type localMerger struct {
+	localDir   string
+	runID      string
+	backupRoot string
+	stagingDir string
+	backupDir  string
+	backedUp   int
+}
+
+// newLocalMerger returns localMerger of localDir. If runID is empty, random ID is used for backup directory
+func newLocalMerger(localDir, runID string) (*localMerger, error) {
+	if runID == "" {
+		id, err := NewRunID()
+		if err != nil {
+			return nil, err
+		}
+		runID = id
+	}
+	// staging directory is placed in localDir so that files can be moved by rename
+	root := filepath.Join(localDir, BackupDirName)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	stagingDir, err := ioutil.TempDir(root, ".staging-")
+	if err != nil {
+		return nil, err
+	}
+	return &localMerger{localDir: localDir, runID: runID, backupRoot: root, stagingDir: stagingDir}, nil
+}
+
+// stagingPath returns path to stage file that will be moved into p(slash separated path relative to localDir)
+func (m *localMerger) stagingPath(p string) string {
+	return filepath.Join(m.stagingDir, filepath.FromSlash(p))
+}
+
+// commit applies diff to local directory. Files of diff.Files must have been staged by staged(entry).
+// Local entries replaced by entries of different type are moved first, then staged files are moved in,
+// and entries only deleted are moved last. If any of them fails, all changes are undone
+func (m *localMerger) commit(diff *manifest.Diff, staged func(e *manifest.Entry) string) (err error) {
+	var undos []func() error
+	defer func() {
+		if err != nil {
+			m.rollback(undos)
+		}
+	}()
+	do := func(undo func() error, err error) error {
+		if undo != nil {
+			undos = append(undos, undo)
+		}
+		return err
+	}
+
+	// paths of new entries and their parents
+	created := map[string]bool{}
+	for _, e := range append(append([]*manifest.Entry{}, diff.Dirs...), diff.Files...) {
+		for p := e.Path; p != "." && p != "/"; p = path.Dir(p) {
+			created[p] = true
+		}
+	}
+	var deleted []*manifest.Entry
+	for _, e := range diff.Deleted {
+		if !created[e.Path] {
+			deleted = append(deleted, e)
+			continue
+		}
+		if err := do(m.backup(e.Path, true)); err != nil {
+			return err
+		}
+	}
+
+	if err := do(mkdirAll(m.localDir, 0755)); err != nil {
+		return err
+	}
+	for _, e := range diff.Dirs {
+		if err := do(mkdirAll(m.localPath(e.Path), e.Mode|0700)); err != nil {
+			return err
+		}
+	}
+	for _, e := range diff.Files {
+		if err := do(m.backup(e.Path, false)); err != nil {
+			return err
+		}
+		if err := do(rename(staged(e), m.localPath(e.Path))); err != nil {
+			return err
+		}
+	}
+	for _, e := range deleted {
+		if err := do(m.backup(e.Path, true)); err != nil {
+			return err
+		}
+	}
+
+	if m.backedUp > 0 {
+		log.Printf("[INFO] Backed up %d replaced or deleted entries to %q", m.backedUp, m.backupDir)
+		m.pruneBackups()
+	}
+	return nil
+}
+
+// rollback undoes changes of commit in reverse order. Backup directory is removed if all changes are undone
+func (m *localMerger) rollback(undos []func() error) {
+	failed := false
+	for i := len(undos) - 1; i >= 0; i-- {
+		if err := undos[i](); err != nil {
+			log.Printf("[ERROR] Undoing download failed: %s", err)
+			failed = true
+		}
+	}
+	if m.backupDir == "" {
+		return
+	}
+	if failed {
+		log.Printf("[ERROR] Local files may be left in %q", m.backupDir)
+		return
+	}
+	os.RemoveAll(m.backupDir) // nolint -> it has only empty directories
+	m.backupDir = ""
+	m.backedUp = 0
+}
+
+// pruneBackups removes backup directories except the last backupRetention ones
+func (m *localMerger) pruneBackups() {
+	entries, err := ioutil.ReadDir(m.backupRoot)
+	if err != nil {
+		log.Printf("[WARN] Reading %q failed: %s", m.backupRoot, err)
+		return
+	}
+	// names start with timestamp, and ReadDir sorts them by name
+	var dirs []string
+	for _, fi := range entries {
+		if fi.IsDir() && !strings.HasPrefix(fi.Name(), ".") {
+			dirs = append(dirs, fi.Name())
+		}
+	}
+	for len(dirs) > backupRetention {
+		if err := os.RemoveAll(filepath.Join(m.backupRoot, dirs[0])); err != nil {
+			log.Printf("[WARN] Removing old backup %q failed: %s", dirs[0], err)
+		}
+		dirs = dirs[1:]
+	}
+}
+
+// Close removes staging directory, and backup root directory if it is empty
+func (m *localMerger) Close() error {
+	if err := os.RemoveAll(m.stagingDir); err != nil {
+		return err
+	}
+	if m.backupDir == "" {
+		os.Remove(m.backupRoot) // nolint -> fails if other backups exist
+	}
+	return nil
+}
+
+func (m *localMerger) localPath(p string) string {
+	return filepath.Join(m.localDir, filepath.FromSlash(p))
+}
+
+// backup saves local file or directory p into backup directory if it exists, and returns func that restores it.
+// If move is true, p is moved. Otherwise p is kept by hard link or copy so that it can be replaced by rename atomically
+func (m *localMerger) backup(p string, move bool) (func() error, error) {
+	src := m.localPath(p)
+	fi, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.backupDir == "" {
+		dir := filepath.Join(m.backupRoot, time.Now().Format(backupTimeFormat)+"-"+m.runID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		m.backupDir = dir
+	}
+	dest := filepath.Join(m.backupDir, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return nil, err
+	}
+	m.backedUp++
+
+	restore := func() error {
+		return os.Rename(dest, src)
+	}
+	if move || fi.IsDir() {
+		return rename(src, dest)
+	}
+	if err := os.Link(src, dest); err == nil {
+		return restore, nil
+	}
+	if err := copyFile(src, dest, fi.Mode()); err != nil {
+		return nil, err
+	}
+	return restore, nil
+}
+
+// rename moves src to dest, and returns func that moves it back
+func rename(src, dest string) (func() error, error) {
+	if err := os.Rename(src, dest); err != nil {
+		return nil, err
+	}
+	return func() error {
+		return os.Rename(dest, src)
+	}, nil
+}
+
+// mkdirAll creates dir and its parents, and returns func that removes created ones
+func mkdirAll(dir string, mode os.FileMode) (func() error, error) {
+	var created []string
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := os.Lstat(p); err == nil || filepath.Dir(p) == p {
+			break
+		}
+		created = append(created, p)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return nil, err
+	}
+	if len(created) == 0 {
+		return nil, nil
+	}
+	return func() error {
+		for _, p := range created {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint -> return value not checked
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close() // nolint -> return value not checked
+		return err
+	}
+	return out.Close()
+}
+
+// takeLocalBaselines saves manifests of local download directories before the run for MergeFailOnConflict
+func (r *realRunner) takeLocalBaselines() error {
+	if r.cfg.mergeStrategy() != MergeFailOnConflict {
+		return nil
+	}
+	r.localBaselines = map[string]*manifest.Manifest{}
+	for _, m := range r.cfg.downloadMappings() {
+		rules, err := r.cfg.downloadRules(m.LocalDir)
+		if err != nil {
+			return err
+		}
+		baseline, err := manifest.Build(m.localDownloadDir(), excludeBackupDir(rules))
+		if err != nil {
+			return fmt.Errorf("reading %q failed: %s", m.localDownloadDir(), err)
+		}
+		r.localBaselines[m.localDownloadDir()] = baseline
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rarukas/rarukas/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncDownloadMerge(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	remoteDir := filepath.Join(tmpDir, "remote")
+	writeFiles(t, remoteDir, map[string]string{
+		"result.txt":   "result",
+		"changed.txt":  "remote",
+		"dir/file.txt": "file",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, addr := startTestServer(ctx, t, tmpDir)
+
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	setupLocal := func(t *testing.T, name string) string {
+		localDir := filepath.Join(tmpDir, name)
+		writeFiles(t, localDir, map[string]string{
+			"local-only.txt": "local",
+			"changed.txt":    "local",
+		})
+		return localDir
+	}
+
+	t.Run("Mirror", func(t *testing.T) {
+		localDir := setupLocal(t, "mirror")
+		r.cfg.MergeStrategy = MergeMirror
+
+		diff, err := r.syncDownload(client, remoteDir, localDir, nil)
+		assert.NoError(t, err)
+		assert.Len(t, diff.Deleted, 1)
+
+		assertFileContent(t, filepath.Join(localDir, "result.txt"), "result")
+		assertFileContent(t, filepath.Join(localDir, "changed.txt"), "remote")
+		assert.False(t, fileExists(filepath.Join(localDir, "local-only.txt")))
+
+		// replaced and deleted files are backed up
+		backups, err := filepath.Glob(filepath.Join(localDir, BackupDirName, "*"))
+		assert.NoError(t, err)
+		if assert.Len(t, backups, 1) {
+			assertFileContent(t, filepath.Join(backups[0], "local-only.txt"), "local")
+			assertFileContent(t, filepath.Join(backups[0], "changed.txt"), "local")
+		}
+
+		// staging directory is removed
+		staging, err := filepath.Glob(filepath.Join(localDir, BackupDirName, ".staging-*"))
+		assert.NoError(t, err)
+		assert.Empty(t, staging)
+	})
+
+	t.Run("Overlay", func(t *testing.T) {
+		localDir := setupLocal(t, "overlay")
+		r.cfg.MergeStrategy = MergeOverlay
+
+		diff, err := r.syncDownload(client, remoteDir, localDir, nil)
+		assert.NoError(t, err)
+		assert.Empty(t, diff.Deleted)
+
+		assertFileContent(t, filepath.Join(localDir, "result.txt"), "result")
+		assertFileContent(t, filepath.Join(localDir, "changed.txt"), "remote")
+		assertFileContent(t, filepath.Join(localDir, "local-only.txt"), "local")
+	})
+
+	t.Run("Fail on conflict", func(t *testing.T) {
+		localDir := setupLocal(t, "conflict")
+		r.cfg.MergeStrategy = MergeFailOnConflict
+
+		// changed.txt was changed on both sides during the run
+		r.localBaselines = map[string]*manifest.Manifest{localDir: buildManifest(t, map[string]string{"changed.txt": "base"})}
+		r.remoteBaselines = map[string]*manifest.Manifest{remoteDir: buildManifest(t, map[string]string{"changed.txt": "base"})}
+
+		_, err := r.syncDownload(client, remoteDir, localDir, nil)
+		if assert.IsType(t, &DownloadConflictError{}, err) {
+			assert.Equal(t, []string{"changed.txt"}, err.(*DownloadConflictError).Paths)
+		}
+		// nothing is changed
+		assert.False(t, fileExists(filepath.Join(localDir, "result.txt")))
+		assertFileContent(t, filepath.Join(localDir, "changed.txt"), "local")
+
+		// changed.txt was changed on local only
+		r.remoteBaselines[remoteDir] = buildManifest(t, map[string]string{"changed.txt": "remote"})
+
+		_, err = r.syncDownload(client, remoteDir, localDir, nil)
+		assert.NoError(t, err)
+		assertFileContent(t, filepath.Join(localDir, "result.txt"), "result")
+		assertFileContent(t, filepath.Join(localDir, "changed.txt"), "local")
+		// local-only.txt was created during the run
+		assertFileContent(t, filepath.Join(localDir, "local-only.txt"), "local")
+	})
+}
+
+func TestLocalMergerCommit(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	setup := func(t *testing.T, name string) (*localMerger, *manifest.Diff) {
+		localDir := filepath.Join(tmpDir, name)
+		writeFiles(t, localDir, map[string]string{
+			"changed.txt":  "local",
+			"deleted.txt":  "local",
+			"type-changed": "local",
+		})
+		m, err := newLocalMerger(localDir, "run1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeFiles(t, m.stagingDir, map[string]string{
+			"changed.txt":          "remote",
+			"type-changed/new.txt": "remote",
+			"new/file.txt":         "remote",
+		})
+		diff := &manifest.Diff{
+			Dirs:    []*manifest.Entry{{Path: "new", Dir: true, Mode: 0755}, {Path: "type-changed", Dir: true, Mode: 0755}},
+			Files:   []*manifest.Entry{{Path: "changed.txt"}, {Path: "new/file.txt"}, {Path: "type-changed/new.txt"}},
+			Deleted: []*manifest.Entry{{Path: "deleted.txt"}, {Path: "type-changed"}},
+		}
+		return m, diff
+	}
+
+	t.Run("Commit", func(t *testing.T) {
+		m, diff := setup(t, "commit")
+		defer m.Close() // nolint
+
+		err := m.commit(diff, func(e *manifest.Entry) string { return m.stagingPath(e.Path) })
+		assert.NoError(t, err)
+		assertFileContent(t, m.localPath("changed.txt"), "remote")
+		assertFileContent(t, m.localPath("new/file.txt"), "remote")
+		assertFileContent(t, m.localPath("type-changed/new.txt"), "remote")
+		assert.False(t, fileExists(m.localPath("deleted.txt")))
+
+		// backup directory is named with timestamp and run ID
+		assert.Regexp(t, `/[0-9]{8}-[0-9]{6}-run1$`, m.backupDir)
+		assertFileContent(t, filepath.Join(m.backupDir, "changed.txt"), "local")
+		assertFileContent(t, filepath.Join(m.backupDir, "deleted.txt"), "local")
+		assertFileContent(t, filepath.Join(m.backupDir, "type-changed"), "local")
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		m, diff := setup(t, "rollback")
+		defer m.Close() // nolint
+
+		// the last file isn't staged, so moving it fails after other changes
+		err := m.commit(diff, func(e *manifest.Entry) string {
+			if e.Path == "type-changed/new.txt" {
+				return m.stagingPath("not-staged.txt")
+			}
+			return m.stagingPath(e.Path)
+		})
+		assert.Error(t, err)
+
+		// everything is restored
+		assertFileContent(t, m.localPath("changed.txt"), "local")
+		assertFileContent(t, m.localPath("deleted.txt"), "local")
+		assertFileContent(t, m.localPath("type-changed"), "local")
+		assert.False(t, fileExists(m.localPath("new")))
+		assert.Empty(t, m.backupDir)
+		backups, err := filepath.Glob(filepath.Join(m.backupRoot, "[0-9]*"))
+		assert.NoError(t, err)
+		assert.Empty(t, backups)
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		m, diff := setup(t, "retention")
+		defer m.Close() // nolint
+
+		for i := 0; i < backupRetention; i++ {
+			writeFiles(t, filepath.Join(m.backupRoot, fmt.Sprintf("20180701-1200%02d-old", i)), map[string]string{"file.txt": "old"})
+		}
+		err := m.commit(diff, func(e *manifest.Entry) string { return m.stagingPath(e.Path) })
+		assert.NoError(t, err)
+
+		backups, err := filepath.Glob(filepath.Join(m.backupRoot, "[0-9]*"))
+		assert.NoError(t, err)
+		if assert.Len(t, backups, backupRetention) {
+			// the oldest one is removed
+			assert.Equal(t, "20180701-120001-old", filepath.Base(backups[0]))
+			assert.Equal(t, m.backupDir, backups[len(backups)-1])
+		}
+		// staging directory is kept until Close
+		assert.True(t, fileExists(m.stagingDir))
+	})
+}
+
+func buildManifest(t *testing.T, files map[string]string) *manifest.Manifest {
+	dir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint
+
+	writeFiles(t, dir, files)
+	m, err := manifest.Build(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
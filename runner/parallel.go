@@ -0,0 +1,221 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// EnvInstanceIndex is name of environment variable that has 0-based index of the instance
+	EnvInstanceIndex = "RARUKAS_INSTANCE_INDEX"
+	// EnvInstanceTotal is name of environment variable that has total number of the instances
+	EnvInstanceTotal = "RARUKAS_INSTANCE_TOTAL"
+)
+
+// InstanceResult is result of the execution on one of parallel instances
+type InstanceResult struct {
+	Index    int
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// ParallelError is returned when the execution on one or more parallel instances failed
+type ParallelError struct {
+	Results []*InstanceResult
+}
+
+func (e *ParallelError) Error() string {
+	failed := 0
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("Execution failed on %d of %d instances", failed, len(e.Results))
+}
+
+// FailedErrors returns errors of failed instances
+func (e *ParallelError) FailedErrors() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errs
+}
+
+func runParallel(ctx context.Context, cfg *Config) error {
+	if err := prepareInstances(cfg); err != nil {
+		return err
+	}
+
+	mu := &sync.Mutex{}
+	var instances []*Config
+	for i := 0; i < cfg.Parallel; i++ {
+		instances = append(instances, cfg.instanceConfig(i, mu))
+	}
+
+	results := runInstances(ctx, instances)
+	printInstanceResults(results)
+	return instancesError(ctx, results)
+}
+
+// prepareInstances validates cfg and setups key-pair shared among instances
+func prepareInstances(cfg *Config) error {
+	if cfg.Provider != nil && cfg.ProviderFactory == nil {
+		return errors.New("Provider can't be shared among parallel instances. Use ProviderFactory instead")
+	}
+
+	// all instances use same key-pair
+	r := &realRunner{cfg: cfg}
+	return r.setupKeyPair()
+}
+
+// runInstances runs each Config concurrently, and waits for all of them to complete
+func runInstances(ctx context.Context, instances []*Config) []*InstanceResult {
+	results := make([]*InstanceResult, len(instances))
+	wg := &sync.WaitGroup{}
+
+	for i, instCfg := range instances {
+		results[i] = &InstanceResult{Index: i, Name: instCfg.ArukasName}
+
+		wg.Add(1)
+		go func(result *InstanceResult, instCfg *Config) {
+			defer wg.Done()
+			defer instCfg.flush()
+
+			start := time.Now()
+			r := &realRunner{cfg: instCfg, provider: instCfg.provider()}
+			result.Err = r.run(ctx)
+			result.Duration = time.Since(start)
+
+			if result.Err != nil {
+				log.Printf("[ERROR] Instance[%s] failed: %s\n", result.Name, result.Err)
+			} else {
+				log.Printf("[INFO] Instance[%s] completed\n", result.Name)
+			}
+		}(results[i], instCfg)
+	}
+	wg.Wait()
+	return results
+}
+
+func instancesError(ctx context.Context, results []*InstanceResult) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			return &ParallelError{Results: results}
+		}
+	}
+	return nil
+}
+
+// instanceConfig returns copy of the Config for i-th parallel instance
+func (c *Config) instanceConfig(i int, mu *sync.Mutex) *Config {
+	instCfg := *c
+	instCfg.Parallel = 0
+	instCfg.ArukasName = fmt.Sprintf("%s-%d", c.ArukasName, i+1)
+
+	if c.ProviderFactory != nil {
+		instCfg.Provider = c.ProviderFactory(i)
+	}
+	instCfg.setupInstanceSyncs()
+	if c.hasArtifacts() {
+		instCfg.artifactName = instCfg.ArukasName
+	}
+
+	instCfg.Env = map[string]string{}
+	for k, v := range c.Env {
+		instCfg.Env[k] = v
+	}
+	instCfg.Env[EnvInstanceIndex] = strconv.Itoa(i)
+	instCfg.Env[EnvInstanceTotal] = strconv.Itoa(c.Parallel)
+
+	instCfg.setupInstanceOutput(c, mu)
+	return &instCfg
+}
+
+// setupInstanceOutput makes outputs of the instance prefixed with its name
+func (c *Config) setupInstanceOutput(parent *Config, mu *sync.Mutex) {
+	prefix := fmt.Sprintf("[%s] ", c.ArukasName)
+	c.prefixWriters = []*prefixWriter{
+		{w: parent.stdout(), prefix: prefix, mu: mu},
+		{w: parent.stderr(), prefix: prefix, mu: mu},
+	}
+	c.out = c.prefixWriters[0]
+	c.err = c.prefixWriters[1]
+	c.in = &bytes.Buffer{} // stdin can't be shared among instances
+}
+
+// flush flushes outputs of the instance
+func (c *Config) flush() {
+	for _, w := range c.prefixWriters {
+		w.Flush() // nolint
+	}
+}
+
+func printInstanceResults(results []*InstanceResult) {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\tINSTANCE\tSTATUS\tDURATION") // nolint
+	for _, result := range results {
+		status := "succeeded"
+		if result.Err != nil {
+			status = "failed"
+		}
+		fmt.Fprintf(w, "\t%s\t%s\t%s\n", result.Name, status, formatDuration(result.Duration)) // nolint
+	}
+	w.Flush() // nolint
+	log.Printf("[INFO] Parallel execution summary:\n%s", buf.String())
+}
+
+// prefixWriter writes each line with prefix. Writes of the writers sharing mu are not interleaved
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := fmt.Fprintf(p.w, "%s%s", p.prefix, p.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// Flush writes the rest of buffer that doesn't end with newline
+func (p *prefixWriter) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.buf) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.buf)
+	p.buf = nil
+	return err
+}
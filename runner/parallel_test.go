@@ -0,0 +1,102 @@
+// +build !windows
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunParallel(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	localProviderFactory := func(index int) Provider {
+		return NewLocalProvider(&LocalProviderParam{
+			BootTimeout: 10 * time.Second,
+		})
+	}
+
+	t.Run("Run on all instances", func(t *testing.T) {
+		syncDir, err := ioutil.TempDir("", "rarukas-test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(syncDir)              // nolint
+		defer os.RemoveAll(syncDir + "-results") // nolint
+
+		stdOut := &bytes.Buffer{}
+		cfg := &Config{
+			ProviderFactory: localProviderFactory,
+			ArukasName:      "test",
+			Commands:        []string{"echo $RARUKAS_INSTANCE_INDEX/$RARUKAS_INSTANCE_TOTAL > out.txt; cat out.txt"},
+			SyncDir:         syncDir,
+			Parallel:        3,
+			ExecTimeout:     20 * time.Second,
+			out:             stdOut,
+			err:             ioutil.Discard,
+		}
+
+		err = Run(ctx, cfg)
+		assert.NoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(stdOut.String()), "\n")
+		sort.Strings(lines)
+		assert.Equal(t, []string{"[test-1] 0/3", "[test-2] 1/3", "[test-3] 2/3"}, lines)
+
+		for name, expect := range map[string]string{"test-1": "0/3\n", "test-2": "1/3\n", "test-3": "2/3\n"} {
+			data, err := ioutil.ReadFile(filepath.Join(syncDir+"-results", name, "out.txt"))
+			assert.NoError(t, err)
+			assert.Equal(t, expect, string(data))
+		}
+
+		// results are not in sync-dir, so following runs don't upload them
+		files, err := ioutil.ReadDir(syncDir)
+		assert.NoError(t, err)
+		assert.Empty(t, files)
+	})
+
+	t.Run("Failed instance", func(t *testing.T) {
+		cfg := &Config{
+			ProviderFactory: localProviderFactory,
+			ArukasName:      "test",
+			Commands:        []string{"exit $RARUKAS_INSTANCE_INDEX"},
+			Parallel:        3,
+			ExecTimeout:     20 * time.Second,
+			out:             ioutil.Discard,
+			err:             ioutil.Discard,
+		}
+
+		err := Run(ctx, cfg)
+		if assert.IsType(t, &ParallelError{}, err) {
+			errs := err.(*ParallelError).FailedErrors()
+			assert.Len(t, errs, 2)
+		}
+	})
+}
+
+func TestPrefixWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &prefixWriter{w: out, prefix: "[p] ", mu: &sync.Mutex{}}
+
+	w.Write([]byte("foo\nba")) // nolint
+	w.Write([]byte("r\nbaz"))  // nolint
+	assert.Equal(t, "[p] foo\n[p] bar\n", out.String())
+
+	w.Flush() // nolint
+	assert.Equal(t, "[p] foo\n[p] bar\n[p] baz\n", out.String())
+}
@@ -0,0 +1,44 @@
+package runner
+
+import "context"
+
+// Provider provisions a host running rarukas-server
+type Provider interface {
+	// Provision starts rarukas-server and returns its SSH endpoint
+	Provision(ctx context.Context, spec *ServerSpec) (*Endpoint, error)
+	// Destroy tears down the provisioned host
+	Destroy() error
+}
+
+// ServerSpec is specification of rarukas-server to be provisioned
+type ServerSpec struct {
+	// PublicKey is public key allowed to connect to rarukas-server
+	PublicKey string
+	// AuthorizedKeys are additional keys in authorized_keys format allowed to connect to rarukas-server
+	AuthorizedKeys string
+	// TrustedUserCAKeys are public keys of SSH user CA trusted by rarukas-server
+	TrustedUserCAKeys string
+	// RunID is ID of the run. rarukas-server accepts only certificates issued for it
+	RunID string
+	// Command is the shell used to execute commands on rarukas-server
+	Command string
+	// AllowForwarding enables port forwarding on rarukas-server
+	AllowForwarding bool
+	// AcceptEnv are patterns of environment variable names accepted by rarukas-server in addition to its defaults
+	AcceptEnv []string
+	// HostKey is PEM encoded ephemeral private host key of rarukas-server. The runner pins its public key
+	HostKey string
+}
+
+// Endpoint is SSH endpoint of provisioned rarukas-server
+type Endpoint struct {
+	// ID is identifier of provisioned host(e.g. ID of Arukas app). It may be empty
+	ID   string
+	Host string
+	Port int
+
+	// WorkDir is working directory path on rarukas-server. If empty, RarukasServerWorkDir is used
+	WorkDir string
+	// TmpDir is tmp directory path on rarukas-server. If empty, RarukasServerTmpDir is used
+	TmpDir string
+}
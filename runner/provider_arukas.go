@@ -0,0 +1,201 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/rarukas/rarukas/server"
+	"github.com/yamamoto-febc/go-arukas"
+)
+
+// ArukasProviderParam is parameters of Arukas provider
+type ArukasProviderParam struct {
+	Client           ArukasClient
+	Name             string
+	Plan             string
+	RarukasImageType string
+	ImageName        string
+	BootTimeout      time.Duration
+	// AppID is ID of Arukas app created by other process. If specified, Destroy deletes it
+	AppID string
+}
+
+type arukasProvider struct {
+	param            *ArukasProviderParam
+	currentArukasApp *arukas.AppData
+}
+
+// NewArukasProvider returns Provider that runs rarukas-server as Arukas app
+func NewArukasProvider(param *ArukasProviderParam) Provider {
+	return &arukasProvider{param: param}
+}
+
+func (p *arukasProvider) Provision(ctx context.Context, spec *ServerSpec) (*Endpoint, error) {
+
+	log.Print("[INFO] Starting rarukas-server on Arukas...")
+
+	client := p.param.Client
+
+	imageName := fmt.Sprintf("%s:%s", RarukasBaseImage, p.param.RarukasImageType)
+	if p.param.ImageName != "" {
+		imageName = p.param.ImageName
+	}
+
+	param := &arukas.RequestParam{
+		Name:  p.param.Name,
+		Image: imageName,
+		Plan:  p.param.Plan,
+		Ports: []*arukas.Port{
+			{
+				Protocol: "tcp",
+				Number:   server.RarukasDefaultHTTPPort,
+			},
+			{
+				Protocol: "tcp",
+				Number:   server.RarukasDefaultSSHPort,
+			},
+		},
+		Environment: []*arukas.Env{
+			{
+				Key:   server.RarukasPublicKeyEnv,
+				Value: spec.PublicKey,
+			},
+			{
+				Key:   server.RarukasCommandEnv,
+				Value: spec.Command,
+			},
+			{
+				Key:   server.RarukasHostKeyEnv,
+				Value: spec.HostKey,
+			},
+		},
+		Instances: 1,
+	}
+	if spec.AuthorizedKeys != "" {
+		param.Environment = append(param.Environment, &arukas.Env{
+			Key:   server.RarukasAuthorizedKeysEnv,
+			Value: spec.AuthorizedKeys,
+		})
+	}
+	if spec.TrustedUserCAKeys != "" {
+		param.Environment = append(param.Environment, &arukas.Env{
+			Key:   server.RarukasTrustedUserCAKeysEnv,
+			Value: spec.TrustedUserCAKeys,
+		}, &arukas.Env{
+			Key:   server.RarukasRunIDEnv,
+			Value: spec.RunID,
+		})
+	}
+	if len(spec.AcceptEnv) > 0 {
+		param.Environment = append(param.Environment, &arukas.Env{
+			Key:   server.RarukasAcceptEnvEnv,
+			Value: strings.Join(spec.AcceptEnv, ","),
+		})
+	}
+	if spec.AllowForwarding {
+		param.Environment = append(param.Environment, &arukas.Env{
+			Key:   server.RarukasAllowForwardingEnv,
+			Value: "true",
+		})
+	}
+
+	app, err := client.CreateApp(param)
+	if err != nil {
+		return nil, err
+	}
+
+	p.currentArukasApp = app
+	serviceID := app.ServiceID()
+
+	// power on
+	if err = client.PowerOn(serviceID); err != nil {
+		p.cleanup()
+		return nil, err
+	}
+
+	// Wait until container is running...
+	ctx, cancel := context.WithTimeout(ctx, p.param.BootTimeout)
+	defer cancel()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- client.WaitForState(ctx, serviceID, arukas.StatusRunning)
+	}()
+
+	select {
+	case err = <-errChan:
+		if err != nil {
+			p.cleanup()
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, &BootTimeoutError{Err: err}
+			}
+			return nil, err
+		}
+	case <-ctx.Done():
+		p.cleanup()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &BootTimeoutError{Err: ctx.Err()}
+		}
+		return nil, ctx.Err()
+	}
+
+	// get service port_mapping
+	service, err := client.ReadService(serviceID)
+	if err != nil {
+		p.cleanup()
+		return nil, err
+	}
+
+	portMapping := service.PortMapping()
+	if len(portMapping) == 0 {
+		p.cleanup()
+		return nil, errors.New("Arukas service don't have port_mappings")
+	}
+
+	for _, pm := range portMapping {
+		if pm.ContainerPort == server.RarukasDefaultSSHPort {
+			return &Endpoint{
+				ID:   app.AppID(),
+				Host: pm.Host,
+				Port: int(pm.ServicePort),
+			}, nil
+		}
+	}
+
+	p.cleanup()
+	return nil, ErrNoSSHPortMapping
+}
+
+func (p *arukasProvider) Destroy() error {
+
+	var id string
+	switch {
+	case p.currentArukasApp != nil:
+		id = p.currentArukasApp.AppID()
+	case p.param.AppID != "":
+		id = p.param.AppID
+	default:
+		return nil
+	}
+
+	client := p.param.Client
+	if _, err := client.ReadApp(id); err != nil {
+		return err
+	}
+	if err := client.DeleteApp(id); err != nil {
+		return err
+	}
+	p.currentArukasApp = nil
+	p.param.AppID = ""
+	return nil
+}
+
+func (p *arukasProvider) cleanup() {
+	if err := p.Destroy(); err != nil {
+		log.Printf("[ERROR] Cleanup failed: %s\n", err)
+	}
+}
@@ -0,0 +1,213 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rarukas/rarukas/server"
+)
+
+// LocalProviderParam is parameters of local provider
+type LocalProviderParam struct {
+	// ServerBin is path to rarukas-server binary. If empty, rarukas-server is started in-process
+	ServerBin   string
+	BootTimeout time.Duration
+}
+
+type localProvider struct {
+	param   *LocalProviderParam
+	baseDir string
+	cancel  context.CancelFunc
+	cmd     *exec.Cmd
+	errChan chan error
+}
+
+// NewLocalProvider returns Provider that runs rarukas-server on local machine
+func NewLocalProvider(param *LocalProviderParam) Provider {
+	return &localProvider{param: param}
+}
+
+func (p *localProvider) Provision(ctx context.Context, spec *ServerSpec) (*Endpoint, error) {
+
+	log.Print("[INFO] Starting rarukas-server on local machine...")
+
+	baseDir, err := ioutil.TempDir("", "rarukas-local_")
+	if err != nil {
+		return nil, err
+	}
+	p.baseDir = baseDir
+
+	workDir := filepath.Join(baseDir, "workdir")
+	tmpDir := filepath.Join(baseDir, "tmp")
+	for _, dir := range []string{workDir, tmpDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			p.cleanup()
+			return nil, err
+		}
+	}
+
+	sshPort, err := freePort()
+	if err != nil {
+		p.cleanup()
+		return nil, err
+	}
+	hcPort, err := freePort()
+	if err != nil {
+		p.cleanup()
+		return nil, err
+	}
+
+	serverConfig := &server.Config{
+		PublicKey:         spec.PublicKey,
+		AuthorizedKeys:    spec.AuthorizedKeys,
+		TrustedUserCAKeys: spec.TrustedUserCAKeys,
+		RunID:             spec.RunID,
+		Command:           spec.Command,
+		HealthCheckAddr:   "127.0.0.1",
+		HealthCheckPort:   hcPort,
+		SSHServerAddr:     "127.0.0.1",
+		SSHServerPort:     sshPort,
+		WorkDir:           workDir,
+		AllowForwarding:   spec.AllowForwarding,
+		AcceptEnv:         spec.AcceptEnv,
+		HostKey:           spec.HostKey,
+	}
+
+	p.errChan = make(chan error, 1)
+	if p.param.ServerBin == "" {
+		serverCtx, cancel := context.WithCancel(context.Background())
+		p.cancel = cancel
+		go func() {
+			p.errChan <- startInProcessServer(serverCtx, serverConfig)
+		}()
+	} else {
+		if err := p.startServerProcess(serverConfig); err != nil {
+			p.cleanup()
+			return nil, err
+		}
+	}
+
+	// Wait until rarukas-server is available...
+	ctx, cancel := context.WithTimeout(ctx, p.param.BootTimeout)
+	defer cancel()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", sshPort)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close() // nolint
+			break
+		}
+
+		select {
+		case err := <-p.errChan:
+			// rarukas-server has already exited
+			if p.cancel != nil {
+				p.cancel()
+				p.cancel = nil
+			}
+			p.cmd = nil
+			p.cleanup()
+			if err == nil {
+				err = fmt.Errorf("rarukas-server exited unexpectedly")
+			}
+			return nil, err
+		case <-ctx.Done():
+			p.cleanup()
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, &BootTimeoutError{Err: ctx.Err()}
+			}
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	return &Endpoint{
+		Host:    "127.0.0.1",
+		Port:    sshPort,
+		WorkDir: workDir,
+		TmpDir:  tmpDir,
+	}, nil
+}
+
+func (p *localProvider) startServerProcess(cfg *server.Config) error {
+	cmd := exec.Command(p.param.ServerBin)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%s", server.RarukasPublicKeyEnv, cfg.PublicKey),
+		fmt.Sprintf("%s=%s", server.RarukasAuthorizedKeysEnv, cfg.AuthorizedKeys),
+		fmt.Sprintf("%s=%s", server.RarukasTrustedUserCAKeysEnv, cfg.TrustedUserCAKeys),
+		fmt.Sprintf("%s=%s", server.RarukasRunIDEnv, cfg.RunID),
+		fmt.Sprintf("%s=%s", server.RarukasCommandEnv, cfg.Command),
+		fmt.Sprintf("RARUKAS_HEALTH_CHECK_ADDR=%s", cfg.HealthCheckAddr),
+		fmt.Sprintf("RARUKAS_HEALTH_CHECK_PORT=%d", cfg.HealthCheckPort),
+		fmt.Sprintf("RARUKAS_SSH_SERVER_ADDR=%s", cfg.SSHServerAddr),
+		fmt.Sprintf("RARUKAS_SSH_SERVER_PORT=%d", cfg.SSHServerPort),
+		fmt.Sprintf("RARUKAS_WORK_DIR=%s", cfg.WorkDir),
+		fmt.Sprintf("%s=%t", server.RarukasAllowForwardingEnv, cfg.AllowForwarding),
+		fmt.Sprintf("%s=%s", server.RarukasAcceptEnvEnv, strings.Join(cfg.AcceptEnv, ",")),
+		fmt.Sprintf("%s=%s", server.RarukasHostKeyEnv, cfg.HostKey),
+	)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+
+	go func() {
+		p.errChan <- cmd.Wait()
+	}()
+	return nil
+}
+
+func (p *localProvider) Destroy() error {
+	if p.cancel != nil {
+		p.cancel()
+		p.cancel = nil
+		<-p.errChan
+	}
+
+	if p.cmd != nil {
+		if err := p.cmd.Process.Signal(os.Interrupt); err != nil {
+			p.cmd.Process.Kill() // nolint
+		}
+		select {
+		case <-p.errChan:
+		case <-time.After(10 * time.Second):
+			p.cmd.Process.Kill() // nolint
+			<-p.errChan
+		}
+		p.cmd = nil
+	}
+
+	if p.baseDir != "" {
+		if err := os.RemoveAll(p.baseDir); err != nil {
+			return err
+		}
+		p.baseDir = ""
+	}
+	return nil
+}
+
+func (p *localProvider) cleanup() {
+	if err := p.Destroy(); err != nil {
+		log.Printf("[ERROR] Cleanup failed: %s\n", err)
+	}
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close() // nolint
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,13 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+
+	"github.com/rarukas/rarukas/server"
+)
+
+func startInProcessServer(ctx context.Context, cfg *server.Config) error {
+	return server.Start(ctx, cfg)
+}
@@ -0,0 +1,12 @@
+package runner
+
+import (
+	"context"
+	"errors"
+
+	"github.com/rarukas/rarukas/server"
+)
+
+func startInProcessServer(ctx context.Context, cfg *server.Config) error {
+	return errors.New("Starting rarukas-server in-process is not supported on Windows. Please specify rarukas-server binary")
+}
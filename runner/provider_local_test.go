@@ -0,0 +1,214 @@
+// +build !windows
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalProvider(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t.Run("Run command-file", func(t *testing.T) {
+		stdOut := &bytes.Buffer{}
+		cfg := &Config{
+			Provider: NewLocalProvider(&LocalProviderParam{
+				BootTimeout: 10 * time.Second,
+			}),
+			CommandFile: "test/dir1/test1.bash",
+			ExecTimeout: 10 * time.Second,
+			out:         stdOut,
+			err:         ioutil.Discard,
+		}
+
+		err := Run(ctx, cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "dir1\ntest1\n", stdOut.String())
+	})
+
+	t.Run("Run command with quoted arguments", func(t *testing.T) {
+		stdOut := &bytes.Buffer{}
+		cfg := &Config{
+			Provider: NewLocalProvider(&LocalProviderParam{
+				BootTimeout: 10 * time.Second,
+			}),
+			Commands:    []string{"printf", "'%s|'", `"a b"`, "'c  d'", `"it's"`},
+			ExecTimeout: 10 * time.Second,
+			out:         stdOut,
+			err:         ioutil.Discard,
+		}
+
+		err := Run(ctx, cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "a b|c  d|it's|", stdOut.String())
+	})
+
+	t.Run("Run command-file in directory with space", func(t *testing.T) {
+		defer setTmpDirWithSpace(t)()
+
+		stdOut := &bytes.Buffer{}
+		cfg := &Config{
+			Provider: NewLocalProvider(&LocalProviderParam{
+				BootTimeout: 10 * time.Second,
+			}),
+			CommandFile: "test/dir1/test1.bash",
+			ExecTimeout: 10 * time.Second,
+			out:         stdOut,
+			err:         ioutil.Discard,
+		}
+
+		err := Run(ctx, cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "dir1\ntest1\n", stdOut.String())
+	})
+
+	t.Run("Run command with sync-dir", func(t *testing.T) {
+		syncDir, err := ioutil.TempDir("", "rarukas-test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(syncDir) // nolint
+		if err := ioutil.WriteFile(filepath.Join(syncDir, "input.txt"), []byte("foobar"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := &Config{
+			Provider: NewLocalProvider(&LocalProviderParam{
+				BootTimeout: 10 * time.Second,
+			}),
+			Commands:    []string{"cat input.txt > output.txt"},
+			SyncDir:     syncDir,
+			ExecTimeout: 10 * time.Second,
+			out:         ioutil.Discard,
+			err:         ioutil.Discard,
+		}
+
+		err = Run(ctx, cfg)
+		assert.NoError(t, err)
+
+		output, err := ioutil.ReadFile(filepath.Join(syncDir, "output.txt"))
+		assert.NoError(t, err)
+		assert.Equal(t, "foobar", string(output))
+	})
+
+	t.Run("Run command with sync mappings", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmpDir) // nolint
+
+		srcDir, outDir := filepath.Join(tmpDir, "src"), filepath.Join(tmpDir, "out")
+		writeFiles(t, srcDir, map[string]string{"input.txt": "foobar"})
+
+		cfg := &Config{
+			Provider: NewLocalProvider(&LocalProviderParam{
+				BootTimeout: 10 * time.Second,
+			}),
+			Commands: []string{"mkdir -p out && cat src/input.txt > out/output.txt && cp src/input.txt src/result.txt"},
+			Syncs: []*SyncMapping{
+				{LocalDir: srcDir, RemoteDir: "src", Mode: SyncUpload},
+				{LocalDir: outDir, RemoteDir: "out", Mode: SyncDownload},
+			},
+			ExecTimeout: 10 * time.Second,
+			out:         ioutil.Discard,
+			err:         ioutil.Discard,
+		}
+
+		err = Run(ctx, cfg)
+		assert.NoError(t, err)
+
+		assertFileContent(t, filepath.Join(outDir, "output.txt"), "foobar")
+		// upload only
+		assert.False(t, fileExists(filepath.Join(srcDir, "result.txt")))
+	})
+
+	t.Run("Download policy", func(t *testing.T) {
+		cases := []struct {
+			policy   DownloadPolicy
+			commands []string
+			expect   bool
+		}{
+			{policy: DownloadOnSuccess, commands: []string{"echo foo > output.txt; exit 1"}, expect: false},
+			{policy: DownloadAlways, commands: []string{"echo foo > output.txt; exit 1"}, expect: true},
+			{policy: DownloadAlways, commands: []string{"echo foo > output.txt; sleep 10"}, expect: true},
+			{policy: DownloadNever, commands: []string{"echo foo > output.txt"}, expect: false},
+		}
+
+		for _, tc := range cases {
+			syncDir, err := ioutil.TempDir("", "rarukas-test_")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(syncDir) // nolint
+
+			cfg := &Config{
+				Provider: NewLocalProvider(&LocalProviderParam{
+					BootTimeout: 10 * time.Second,
+				}),
+				Commands:       tc.commands,
+				SyncDir:        syncDir,
+				DownloadPolicy: tc.policy,
+				ExecTimeout:    2 * time.Second,
+				out:            ioutil.Discard,
+				err:            ioutil.Discard,
+			}
+
+			Run(ctx, cfg) // nolint
+			_, err = os.Stat(filepath.Join(syncDir, "output.txt"))
+			assert.Equal(t, tc.expect, err == nil, "policy: %s, commands: %s", tc.policy, tc.commands)
+		}
+	})
+
+	t.Run("Destroy removes local working directory", func(t *testing.T) {
+		p := NewLocalProvider(&LocalProviderParam{
+			BootTimeout: 10 * time.Second,
+		})
+		r := &realRunner{cfg: &Config{}, provider: p}
+		r.setupKeyPair()
+
+		endpoint, err := p.Provision(ctx, &ServerSpec{PublicKey: r.cfg.PublicKey, Command: "/bin/sh", HostKey: r.cfg.hostKey})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "127.0.0.1", endpoint.Host)
+		assert.NotEmpty(t, endpoint.Port)
+		assert.DirExists(t, endpoint.WorkDir)
+
+		assert.NoError(t, p.Destroy())
+		_, err = os.Stat(endpoint.WorkDir)
+		assert.True(t, os.IsNotExist(err))
+	})
+}
+
+// setTmpDirWithSpace makes local provider create directories of rarukas-server under a path with space.
+// It returns func to restore TMPDIR
+func setTmpDirWithSpace(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "rarukas test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig, ok := os.LookupEnv("TMPDIR")
+	os.Setenv("TMPDIR", dir) // nolint
+	return func() {
+		if ok {
+			os.Setenv("TMPDIR", orig) // nolint
+		} else {
+			os.Unsetenv("TMPDIR") // nolint
+		}
+		os.RemoveAll(dir) // nolint
+	}
+}
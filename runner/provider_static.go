@@ -0,0 +1,54 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+)
+
+// StaticProviderParam is parameters of static provider
+type StaticProviderParam struct {
+	// Addr is address(host:port) of existing rarukas-server
+	Addr string
+	// WorkDir is working directory path on rarukas-server. If empty, RarukasServerWorkDir is used
+	WorkDir string
+	// TmpDir is tmp directory path on rarukas-server. If empty, RarukasServerTmpDir is used
+	TmpDir string
+}
+
+type staticProvider struct {
+	param *StaticProviderParam
+}
+
+// NewStaticProvider returns Provider that uses existing rarukas-server.
+// It never creates or deletes the host.
+func NewStaticProvider(param *StaticProviderParam) Provider {
+	return &staticProvider{param: param}
+}
+
+func (p *staticProvider) Provision(ctx context.Context, spec *ServerSpec) (*Endpoint, error) {
+	log.Printf("[INFO] Using existing rarukas-server on %s...", p.param.Addr)
+
+	host, strPort, err := net.SplitHostPort(p.param.Addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(strPort)
+	if err != nil {
+		return nil, fmt.Errorf("Port of target %q is invalid: %s", p.param.Addr, err)
+	}
+
+	return &Endpoint{
+		Host:    host,
+		Port:    port,
+		WorkDir: p.param.WorkDir,
+		TmpDir:  p.param.TmpDir,
+	}, nil
+}
+
+func (p *staticProvider) Destroy() error {
+	// the host is not owned by rarukas
+	return nil
+}
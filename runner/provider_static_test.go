@@ -0,0 +1,150 @@
+// +build !windows
+
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rarukas/rarukas/server"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestStaticProvider(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	// generate key-pair for existing rarukas-server
+	keyRunner := &realRunner{cfg: &Config{}}
+	publicKey, privateKey, err := keyRunner.generateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostPublicKey, hostKey, err := generateHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	workDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workDir) // nolint
+
+	sshPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	go server.Start(ctx, &server.Config{ // nolint
+		PublicKey:       string(publicKey),
+		SSHServerAddr:   "127.0.0.1",
+		SSHServerPort:   sshPort,
+		HealthCheckAddr: "127.0.0.1",
+		HealthCheckPort: hcPort,
+		Command:         "/bin/sh",
+		WorkDir:         workDir,
+		HostKey:         string(hostKey),
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", sshPort)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// known_hosts has host key of existing rarukas-server
+	knownHosts := filepath.Join(workDir, "known_hosts")
+	key, _, _, _, err := ssh.ParseAuthorizedKey(hostPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	if err := ioutil.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Run command on existing server", func(t *testing.T) {
+		stdOut := &bytes.Buffer{}
+		cfg := &Config{
+			Provider: NewStaticProvider(&StaticProviderParam{
+				Addr:    addr,
+				WorkDir: workDir,
+				TmpDir:  workDir,
+			}),
+			ArukasClient: &testArukasClient{
+				deleteAppError: fmt.Errorf("DeleteApp should not be called"),
+			},
+			PrivateKey:     string(privateKey),
+			KnownHostsFile: knownHosts,
+			CommandFile:    "test/dir1/test1.bash",
+			ExecTimeout:    10 * time.Second,
+			out:            stdOut,
+			err:            ioutil.Discard,
+		}
+
+		err := Run(ctx, cfg)
+		assert.NoError(t, err)
+		assert.Equal(t, "dir1\ntest1\n", stdOut.String())
+	})
+
+	t.Run("Reject server not in known_hosts", func(t *testing.T) {
+		emptyKnownHosts := filepath.Join(workDir, "empty_known_hosts")
+		if err := ioutil.WriteFile(emptyKnownHosts, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		cfg := &Config{
+			Provider:       NewStaticProvider(&StaticProviderParam{Addr: addr, WorkDir: workDir, TmpDir: workDir}),
+			PrivateKey:     string(privateKey),
+			KnownHostsFile: emptyKnownHosts,
+			Commands:       []string{"echo", "should not run"},
+			ExecTimeout:    10 * time.Second,
+			out:            ioutil.Discard,
+			err:            ioutil.Discard,
+		}
+
+		err := Run(ctx, cfg)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "knownhosts: key is unknown")
+	})
+
+	t.Run("Server is still running after execution", func(t *testing.T) {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		assert.NoError(t, err)
+		if conn != nil {
+			conn.Close() // nolint
+		}
+	})
+
+	t.Run("Invalid target address", func(t *testing.T) {
+		p := NewStaticProvider(&StaticProviderParam{Addr: "127.0.0.1"})
+		endpoint, err := p.Provision(ctx, &ServerSpec{})
+		assert.Nil(t, endpoint)
+		assert.Error(t, err)
+	})
+}
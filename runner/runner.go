@@ -2,79 +2,177 @@ package runner
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"github.com/hnakamur/go-scp"
-	"github.com/rarukas/rarukas/server"
-	"github.com/yamamoto-febc/go-arukas"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/rarukas/rarukas/manifest"
 )
 
 // Run starts rarukas-cli
 func Run(ctx context.Context, cfg *Config) error {
-	r := &realRunner{cfg: cfg}
+	if cfg.DryRun {
+		// rarukas-server is not started in dry-run
+		r := &realRunner{cfg: cfg}
+		return r.dryRun(nil)
+	}
+	if cfg.matrix() != nil {
+		return runMatrix(ctx, cfg)
+	}
+	if cfg.Parallel > 1 {
+		return runParallel(ctx, cfg)
+	}
+	r := &realRunner{cfg: cfg, provider: cfg.provider()}
 	return r.run(ctx)
 }
 
 type realRunner struct {
-	currentArukasApp *arukas.AppData
-	cfg              *Config
+	cfg      *Config
+	provider Provider
+
+	// localBaselines are manifests of local download directories before the run. It is used by MergeFailOnConflict
+	localBaselines map[string]*manifest.Manifest
+	// remoteBaselines are manifests of uploaded remote directories. It is used by MergeFailOnConflict
+	remoteBaselines map[string]*manifest.Manifest
 }
 
 func (r *realRunner) run(ctx context.Context) error {
 
 	// setup key-pair
 	if err := r.setupKeyPair(); err != nil {
-		return nil
+		return err
 	}
 
-	log.Print("[INFO] Starting rarukas-server on Arukas...")
-
-	// start arukas container
-	host, port, err := r.startServer(ctx)
+	// start rarukas-server
+	endpoint, err := r.startServer(ctx)
 	if err != nil {
 		return err
 	}
-	// cleanup Arukas app after command execution
+	// cleanup rarukas-server after command execution
 	defer r.cleanupServer()
 
-	// sync (command-file + sync-dir)
+	return r.runOn(ctx, endpoint.Host, endpoint.Port)
+}
+
+// runOn runs upload/execute/download phases on running rarukas-server
+func (r *realRunner) runOn(ctx context.Context, host string, port int) error {
+	if err := r.takeLocalBaselines(); err != nil {
+		return err
+	}
+	if err := r.upload(ctx, host, port); err != nil {
+		return err
+	}
+
+	// forwarding is available while the command is running
+	stopForwards, err := r.startForwards(host, port)
+	if err != nil {
+		return err
+	}
+	err = r.execute(ctx, host, port)
+	stopForwards()
+	if err != nil {
+		if r.cfg.downloadPolicy() == DownloadAlways {
+			r.downloadAfterFailure(ctx, host, port)
+		}
+		return err
+	}
+	return r.download(ctx, host, port)
+}
+
+// upload uploads command-file and sync mappings to rarukas-server
+func (r *realRunner) upload(ctx context.Context, host string, port int) error {
 	if r.cfg.hasCommandFile() {
 		log.Print("[INFO] Uploading command-file to rarukas-server...")
 		if err := r.uploadCommandFile(ctx, host, port); err != nil {
-			return err
+			return transferError(ctx, "upload", err)
 		}
 	}
-	if r.cfg.hasSyncDir() && r.cfg.syncDirExists() && !r.cfg.DownloadOnly {
-		log.Print("[INFO] Uploading sync-dir to rarukas-server...")
-		if err := r.uploadSourceDir(ctx, host, port); err != nil {
-			return err
+	for _, m := range r.cfg.uploadMappings() {
+		if !m.localExists() {
+			continue
+		}
+		log.Printf("[INFO] Uploading %q to rarukas-server:%s...", m.LocalDir, m.remotePath(r.cfg))
+		if err := r.uploadSourceDir(ctx, host, port, m); err != nil {
+			return transferError(ctx, "upload", err)
 		}
 	}
+	return nil
+}
 
-	log.Print("[INFO] Executing command on rarukas-server...")
-	if err := r.execCommand(ctx, host, port); err != nil {
-		return err
+// execute executes the job or the command on rarukas-server
+func (r *realRunner) execute(ctx context.Context, host string, port int) error {
+	if r.cfg.hasJob() {
+		log.Printf("[INFO] Executing job(%d steps) on rarukas-server...", len(r.cfg.Job.Steps))
+		if err := r.runJob(ctx, host, port); err != nil {
+			return err
+		}
+	} else {
+		log.Print("[INFO] Executing command on rarukas-server...")
+		if err := r.execCommand(ctx, host, port); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if r.cfg.hasSyncDir() && !r.cfg.UploadOnly {
-		log.Print("[INFO] Downloading sync-dir from rarukas-server...")
-		if err := r.downloadRemoteDir(ctx, host, port); err != nil {
-			return err
+// download downloads sync mappings and artifacts from rarukas-server
+func (r *realRunner) download(ctx context.Context, host string, port int) error {
+	if r.cfg.downloadPolicy() == DownloadNever {
+		return nil
+	}
+	for _, m := range r.cfg.downloadMappings() {
+		log.Printf("[INFO] Downloading rarukas-server:%s to %q...", m.remotePath(r.cfg), m.localDownloadDir())
+		if err := r.downloadRemoteDir(ctx, host, port, m); err != nil {
+			return transferError(ctx, "download", err)
+		}
+	}
+	if r.cfg.hasArtifacts() {
+		log.Print("[INFO] Downloading artifacts from rarukas-server...")
+		if err := r.downloadArtifacts(ctx, host, port); err != nil {
+			if _, ok := err.(*MissingArtifactError); ok {
+				return err
+			}
+			return transferError(ctx, "download", err)
 		}
 	}
 	return nil
 }
 
+// downloadAfterFailure downloads sync-dir and artifacts on a best-effort basis after the command failed,
+// timed out or was interrupted, before rarukas-server is deleted. Errors are only logged
+func (r *realRunner) downloadAfterFailure(ctx context.Context, host string, port int) {
+	log.Print("[INFO] Downloading results of failed command(download-policy: always)...")
+	if ctx.Err() != nil {
+		// interrupted: ctx is already canceled
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), afterFailureDownloadTimeout)
+		defer cancel()
+	}
+	if err := r.download(ctx, host, port); err != nil {
+		log.Printf("[ERROR] Downloading results of failed command failed\n%s", err)
+	}
+}
+
+// transferError wraps err as TransferError unless ctx was canceled
+func transferError(ctx context.Context, op string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &TransferError{Op: op, Err: err}
+}
+
 func (r *realRunner) setupKeyPair() error {
 	if r.cfg.PublicKey == "" || r.cfg.PrivateKey == "" {
 		publicKey, privateKey, err := r.generateKeyPair()
@@ -88,116 +186,53 @@ func (r *realRunner) setupKeyPair() error {
 			r.cfg.PrivateKey = string(privateKey)
 		}
 	}
+	if r.cfg.hostKey == "" && r.cfg.KnownHostsFile == "" {
+		publicKey, privateKey, err := generateHostKey()
+		if err != nil {
+			return fmt.Errorf("[ERROR] generating host key failed: %s", err)
+		}
+		r.cfg.hostPublicKey = string(publicKey)
+		r.cfg.hostKey = string(privateKey)
+	}
 	return nil
 }
 
-func (r *realRunner) startServer(ctx context.Context) (string, int, error) {
-
-	client := r.cfg.ArukasClient
-
-	imageName := fmt.Sprintf("%s:%s", RarukasBaseImage, r.cfg.RarukasImageType)
-	if r.cfg.ArukasImageName != "" {
-		imageName = r.cfg.ArukasImageName
-	}
-
-	param := &arukas.RequestParam{
-		Name:  r.cfg.ArukasName,
-		Image: imageName,
-		Plan:  r.cfg.ArukasPlan,
-		Ports: []*arukas.Port{
-			{
-				Protocol: "tcp",
-				Number:   server.RarukasDefaultHTTPPort,
-			},
-			{
-				Protocol: "tcp",
-				Number:   server.RarukasDefaultSSHPort,
-			},
-		},
-		Environment: []*arukas.Env{
-			{
-				Key:   server.RarukasPublicKeyEnv,
-				Value: r.cfg.PublicKey,
-			},
-			{
-				Key:   server.RarukasCommandEnv,
-				Value: "/bin/bash", // TODO make configurable??
-			},
-		},
-		Instances: 1,
-	}
-
-	app, err := client.CreateApp(param)
-	if err != nil {
-		return "", 0, err
-	}
-
-	r.currentArukasApp = app
-	serviceID := app.ServiceID()
-
-	// power on
-	if err = client.PowerOn(serviceID); err != nil {
-		return "", 0, err
-	}
-
-	// Wait until container is running...
-	ctx, cancel := context.WithTimeout(ctx, r.cfg.BootTimeout)
-	defer cancel()
-
-	errChan := make(chan error)
-	go func() {
-		errChan <- client.WaitForState(ctx, serviceID, arukas.StatusRunning)
-	}()
-
-	select {
-	case err = <-errChan:
+func (r *realRunner) startServer(ctx context.Context) (*Endpoint, error) {
+	if r.cfg.TrustedUserCAKeys != "" && r.cfg.runID == "" {
+		runID, err := NewRunID()
 		if err != nil {
-			return "", 0, err
+			return nil, fmt.Errorf("generating run ID failed: %s", err)
 		}
-	case <-ctx.Done():
-		r.cleanupServer()
-		return "", 0, fmt.Errorf("Waiting for bootup of Arukas service timed out:\n\terror:%s", ctx.Err())
-	}
-
-	// get service port_mapping
-	service, err := client.ReadService(serviceID)
+		r.cfg.runID = runID
+		log.Printf("[INFO] Run ID: %s (issue certificates for it with 'rarukas ca --run-id %s')", runID, runID)
+	}
+
+	endpoint, err := r.provider.Provision(ctx, &ServerSpec{
+		PublicKey:         r.cfg.PublicKey,
+		AuthorizedKeys:    r.cfg.AuthorizedKeys,
+		TrustedUserCAKeys: r.cfg.TrustedUserCAKeys,
+		RunID:             r.cfg.runID,
+		Command:           "/bin/bash", // TODO make configurable??
+		AllowForwarding:   r.cfg.AllowForwarding || r.cfg.hasForwards(),
+		AcceptEnv:         r.cfg.serverAcceptEnv(),
+		HostKey:           r.cfg.hostKey,
+	})
 	if err != nil {
-		r.cleanupServer()
-		return "", 0, err
+		return nil, err
 	}
 
-	portMapping := service.PortMapping()
-	if len(portMapping) == 0 {
-		r.cleanupServer()
-		return "", 0, errors.New("Arukas service don't have port_mappings")
+	if r.cfg.serverWorkDir == "" {
+		r.cfg.serverWorkDir = endpoint.WorkDir
 	}
-
-	for _, pm := range portMapping {
-		if pm.ContainerPort == server.RarukasDefaultSSHPort {
-			return pm.Host, int(pm.ServicePort), nil
-		}
+	if r.cfg.serverTmpDir == "" {
+		r.cfg.serverTmpDir = endpoint.TmpDir
 	}
-
-	r.cleanupServer()
-	return "", 0, errors.New("Arukas service don't have SSH port_mapping")
+	return endpoint, nil
 }
 
 func (r *realRunner) cleanupServer() {
-
-	if r.currentArukasApp == nil {
-		return
-	}
-
-	client := r.cfg.ArukasClient
-	id := r.currentArukasApp.AppID()
-	_, err := client.ReadApp(id)
-	if err != nil {
+	if err := r.provider.Destroy(); err != nil {
 		log.Printf("[ERROR] Cleanup failed: %s\n", err)
-		return
-	}
-	if err := client.DeleteApp(id); err != nil {
-		log.Printf("[ERROR] Cleanup failed: %s\n", err)
-		return
 	}
 }
 
@@ -205,7 +240,14 @@ func (r *realRunner) execCommand(ctx context.Context, host string, port int) err
 
 	execCtx, cancel := context.WithTimeout(ctx, r.cfg.ExecTimeout)
 	defer cancel()
-	errChan := make(chan error)
+	errChan := make(chan error, 1)
+
+	var term *terminal
+	if r.cfg.TTY {
+		// restore local terminal even if the command timed out
+		term = newTerminal(os.Stdin, os.Stdout)
+		defer term.Restore()
+	}
 
 	go func() {
 		addr := fmt.Sprintf("%s:%d", host, port)
@@ -217,42 +259,40 @@ func (r *realRunner) execCommand(ctx context.Context, host string, port int) err
 		defer session.Close() // nolint -> return value not checked
 		defer client.Close()  // nolint -> return value not checked
 
-		cmd := strings.Join(r.cfg.Commands, " ")
-		if r.cfg.hasCommandFile() {
-			tmpDir := r.cfg.serverTmpDir
-			if tmpDir == "" {
-				tmpDir = RarukasServerTmpDir
-			}
-			if strings.HasSuffix(tmpDir, "/") {
-				tmpDir = strings.TrimRight(tmpDir, "/")
+		if term != nil {
+			if err := term.Attach(session); err != nil {
+				errChan <- err
+				return
 			}
-			cmd = fmt.Sprintf("/bin/bash %s/%s", tmpDir, r.cfg.commandFileBase())
 		}
 
-		out := r.cfg.out
-		if out == nil {
-			out = os.Stdout
-		}
-		errOut := r.cfg.err
-		if errOut == nil {
-			errOut = os.Stderr
+		cmd := strings.Join(r.cfg.Commands, " ")
+		if r.cfg.hasCommandFile() {
+			cmd = fmt.Sprintf("/bin/bash %s", shellQuote(r.cfg.remoteTmpDir()+"/"+r.cfg.commandFileBase()))
 		}
-		in := r.cfg.in
-		if in == nil {
-			in = os.Stdin
+		cmd, flush, err := r.prepareSession(session, cmd)
+		if err != nil {
+			errChan <- err
+			return
 		}
 
-		session.Stdout = out
-		session.Stderr = errOut
-		session.Stdin = in
-		errChan <- session.Run(cmd)
+		session.Stdin = r.cfg.stdin()
+		err = session.Run(cmd)
+		flush()
+		errChan <- err
 	}()
 
 	select {
 	case err := <-errChan:
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return &RemoteExitError{Status: exitErr.ExitStatus(), Signal: exitErr.Signal()}
+		}
 		return err
 	case <-execCtx.Done():
-		return fmt.Errorf("[ERROR] Waiting for completion of command execution on Arukas timed out:\n\terror:%s", execCtx.Err())
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &ExecTimeoutError{Err: execCtx.Err()}
 	}
 }
 
@@ -270,7 +310,7 @@ func (r *realRunner) uploadCommandFile(ctx context.Context, host string, port in
 	}
 
 	go func() {
-		errChan <- r.scpUpload(uploadCtx, host, port, r.cfg.CommandFile, tmpDir)
+		errChan <- r.uploadFiles(uploadCtx, host, port, r.cfg.CommandFile, tmpDir)
 	}()
 
 	select {
@@ -281,57 +321,43 @@ func (r *realRunner) uploadCommandFile(ctx context.Context, host string, port in
 	}
 }
 
-func (r *realRunner) uploadSourceDir(ctx context.Context, host string, port int) error {
+func (r *realRunner) uploadSourceDir(ctx context.Context, host string, port int, m *SyncMapping) error {
 	uploadCtx, cancel := context.WithTimeout(ctx, r.cfg.ExecTimeout)
 	defer cancel()
-	errChan := make(chan error)
-
-	workDir := r.cfg.serverWorkDir
-	if workDir == "" {
-		workDir = RarukasServerWorkDir
-	}
-	if !strings.HasSuffix(workDir, "/") {
-		workDir += "/"
-	}
 
-	go func() {
-		errChan <- r.scpUpload(uploadCtx, host, port, r.cfg.SyncDir, workDir)
-	}()
-
-	select {
-	case <-uploadCtx.Done():
-		return uploadCtx.Err()
-	case err := <-errChan:
+	rules, err := r.cfg.uploadRules(m.LocalDir)
+	if err != nil {
 		return err
 	}
+	return r.withSSHConn(uploadCtx, host, port, func(client *ssh.Client) error {
+		diff, err := r.syncUpload(client, m.LocalDir, m.remotePath(r.cfg), rules)
+		if err != nil {
+			return err
+		}
+		logSyncSummary("Uploaded", m.LocalDir, diff)
+		return nil
+	})
 }
 
-func (r *realRunner) downloadRemoteDir(ctx context.Context, host string, port int) error {
+func (r *realRunner) downloadRemoteDir(ctx context.Context, host string, port int, m *SyncMapping) error {
 	downloadCtx, cancel := context.WithTimeout(ctx, r.cfg.ExecTimeout)
 	defer cancel()
-	errChan := make(chan error)
-
-	workDir := r.cfg.serverWorkDir
-	if workDir == "" {
-		workDir = RarukasServerWorkDir
-	}
-	if !strings.HasSuffix(workDir, "/") {
-		workDir += "/"
-	}
 
-	go func() {
-		errChan <- r.scpDownload(downloadCtx, host, port, workDir, r.cfg.SyncDir)
-	}()
-
-	select {
-	case <-downloadCtx.Done():
-		return downloadCtx.Err()
-	case err := <-errChan:
+	rules, err := r.cfg.downloadRules(m.LocalDir)
+	if err != nil {
 		return err
 	}
+	return r.withSSHConn(downloadCtx, host, port, func(client *ssh.Client) error {
+		diff, err := r.syncDownload(client, m.remotePath(r.cfg), m.localDownloadDir(), rules)
+		if err != nil {
+			return err
+		}
+		logSyncSummary("Downloaded", m.localDownloadDir(), diff)
+		return nil
+	})
 }
 
-func (r *realRunner) scpUpload(ctx context.Context, host string, port int, path string, destDir string) error {
+func (r *realRunner) uploadFiles(ctx context.Context, host string, port int, path string, destDir string) error {
 
 	if !strings.HasSuffix(destDir, "/") {
 		destDir += "/"
@@ -347,7 +373,8 @@ func (r *realRunner) scpUpload(ctx context.Context, host string, port int, path
 		}
 		defer client.Close() // nolint -> return value not checked
 
-		scpClient := scp.NewSCP(client)
+		transfer := newFileTransfer(client)
+		defer transfer.Close() // nolint -> return value not checked
 
 		fi, err := os.Stat(path)
 		if err != nil {
@@ -368,12 +395,12 @@ func (r *realRunner) scpUpload(ctx context.Context, host string, port int, path
 			for _, fi := range entries {
 				switch {
 				case fi.IsDir():
-					if err := scpClient.SendDir(filepath.Join(path, fi.Name()), destDir, nil); err != nil {
+					if err := transfer.SendDir(filepath.Join(path, fi.Name()), destDir); err != nil {
 						errChan <- err
 						return
 					}
 				default:
-					if err := scpClient.SendFile(filepath.Join(path, fi.Name()), destDir); err != nil {
+					if err := transfer.SendFile(filepath.Join(path, fi.Name()), destDir); err != nil {
 						errChan <- err
 						return
 					}
@@ -384,7 +411,7 @@ func (r *realRunner) scpUpload(ctx context.Context, host string, port int, path
 		}
 
 		// upload single file
-		errChan <- scpClient.SendFile(path, destDir)
+		errChan <- transfer.SendFile(path, destDir)
 	}()
 
 	select {
@@ -395,93 +422,6 @@ func (r *realRunner) scpUpload(ctx context.Context, host string, port int, path
 	}
 }
 
-func (r *realRunner) scpDownload(ctx context.Context, host string, port int, remoteDir, destDir string) error {
-
-	if !strings.HasSuffix(remoteDir, "/") {
-		remoteDir = remoteDir + "/"
-	}
-
-	if !strings.HasSuffix(destDir, "/") {
-		destDir = destDir + "/"
-	}
-
-	errChan := make(chan error)
-	go func() {
-		var err error
-		addr := fmt.Sprintf("%s:%d", host, port)
-
-		client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
-		if err != nil {
-			errChan <- err
-			return
-		}
-		defer client.Close() // nolint -> return value not checked
-
-		scpClient := scp.NewSCP(client)
-
-		tmpDir, err := ioutil.TempDir("", "rarukas-download_")
-		if err != nil {
-			errChan <- err
-			return
-		}
-		defer os.RemoveAll(tmpDir) // nolint
-
-		// receive -> [destDir]/remoteDir.Base()
-		if err = scpClient.ReceiveDir(remoteDir, tmpDir, nil); err != nil {
-			errChan <- err
-			return
-		}
-		tmpWorkDir := filepath.Join(tmpDir, filepath.Base(remoteDir))
-		errChan <- r.mvDirFiles(tmpWorkDir, destDir)
-	}()
-
-	select {
-	case err := <-errChan:
-		if err != nil {
-			return err
-		}
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-	return nil
-}
-
-func (r *realRunner) mvDirFiles(srcDir, destDir string) error {
-	// remove destDir/*
-	if _, e := os.Stat(destDir); e == nil {
-
-		files, err := ioutil.ReadDir(destDir)
-		if err != nil {
-			return err
-		}
-
-		for _, fi := range files {
-			f := filepath.Join(destDir, fi.Name())
-			if err := os.RemoveAll(f); err != nil {
-				return err
-			}
-		}
-	} else {
-		if err := os.Mkdir(destDir, 0755); err != nil {
-			return err
-		}
-	}
-
-	// mv to under destDir/
-	files, err := ioutil.ReadDir(srcDir)
-	if err != nil {
-		return err
-	}
-	for _, fi := range files {
-		src := filepath.Join(srcDir, fi.Name())
-		dst := filepath.Join(destDir, fi.Name())
-		if err = os.Rename(src, dst); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
 func (r *realRunner) newSSHSession(user, host string, privateKey []byte) (*ssh.Client, *ssh.Session, error) {
 
 	client, err := r.openSSHConn(user, host, privateKey)
@@ -503,18 +443,42 @@ func (r *realRunner) openSSHConn(user, host string, privateKey []byte) (*ssh.Cli
 	if err != nil {
 		return nil, err
 	}
+	hostKeyCallback, err := r.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
 
 	sshConfig := &ssh.ClientConfig{
 		User: user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 	}
 
 	return ssh.Dial("tcp", host, sshConfig)
 }
 
+// hostKeyCallback verifies host key of rarukas-server. With KnownHostsFile, the host key is looked up from the file.
+// Otherwise only the ephemeral host key passed to rarukas-server is accepted
+func (r *realRunner) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if r.cfg.KnownHostsFile != "" {
+		callback, err := knownhosts.New(r.cfg.KnownHostsFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading known_hosts failed: %s", err)
+		}
+		return callback, nil
+	}
+	if r.cfg.hostPublicKey == "" {
+		return nil, errors.New("host key of rarukas-server is unknown")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.cfg.hostPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("host key of rarukas-server is invalid: %s", err)
+	}
+	return ssh.FixedHostKey(hostKey), nil
+}
+
 func (r *realRunner) generateKeyPair() ([]byte, []byte, error) {
 	reader := rand.Reader
 	bitSize := 2048
@@ -540,3 +504,23 @@ func (r *realRunner) generateKeyPair() ([]byte, []byte, error) {
 
 	return publicKey, privateKey, nil
 }
+
+// generateHostKey generates ECDSA key-pair used as ephemeral host key of rarukas-server
+func generateHostKey() ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ssh.MarshalAuthorizedKey(pub), privateKey, nil
+}
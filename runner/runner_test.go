@@ -107,6 +107,24 @@ func TestSetupKeyPair(t *testing.T) {
 		assert.NotEmpty(t, cfg.PrivateKey)
 	})
 
+	t.Run("Ephemeral host key", func(t *testing.T) {
+		cfg := &Config{}
+		r := &realRunner{cfg: cfg}
+		r.setupKeyPair()
+
+		signer, err := ssh.ParsePrivateKey([]byte(cfg.hostKey))
+		assert.NoError(t, err)
+		assert.Equal(t, cfg.hostPublicKey, string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	})
+
+	t.Run("Host key is verified with known_hosts", func(t *testing.T) {
+		cfg := &Config{KnownHostsFile: "known_hosts"}
+		r := &realRunner{cfg: cfg}
+		r.setupKeyPair()
+		assert.Empty(t, cfg.hostKey)
+		assert.Empty(t, cfg.hostPublicKey)
+	})
+
 }
 
 var testArukasApp = &arukas.AppData{
@@ -154,18 +172,15 @@ func TestStartArukas(t *testing.T) {
 
 	t.Run("Error when calling createApp API", func(t *testing.T) {
 		expect := errors.New("test")
-		r := &realRunner{
-			cfg: &Config{
-				ArukasClient: &testArukasClient{
-					createAppError: expect,
-				},
+		r := newTestRunner(&Config{
+			ArukasClient: &testArukasClient{
+				createAppError: expect,
 			},
-		}
+		})
 		r.setupKeyPair()
 
-		host, port, err := r.startServer(ctx)
-		assert.Empty(t, host)
-		assert.Empty(t, port)
+		endpoint, err := r.startServer(ctx)
+		assert.Nil(t, endpoint)
 		assert.Error(t, err)
 		assert.Equal(t, expect, err)
 	})
@@ -173,65 +188,63 @@ func TestStartArukas(t *testing.T) {
 	// powerOn
 	t.Run("Error when calling powerOn API", func(t *testing.T) {
 		expect := errors.New("test")
-		r := &realRunner{
-			cfg: &Config{
-				ArukasClient: &testArukasClient{
-					createAppResult: testArukasApp,
-					powerOnError:    expect,
-				},
+		r := newTestRunner(&Config{
+			ArukasClient: &testArukasClient{
+				createAppResult: testArukasApp,
+				powerOnError:    expect,
 			},
-		}
+		})
 		r.setupKeyPair()
 
-		host, port, err := r.startServer(ctx)
-		assert.Empty(t, host)
-		assert.Empty(t, port)
+		endpoint, err := r.startServer(ctx)
+		assert.Nil(t, endpoint)
 		assert.Error(t, err)
 		assert.Equal(t, expect, err)
 	})
 
 	// wait for running
 	t.Run("Timeout occure when booting", func(t *testing.T) {
-		r := &realRunner{
-			cfg: &Config{
-				ArukasClient: &testArukasClient{
-					createAppResult: testArukasApp,
-					waitForStateFunc: func(ctx context.Context, serviceID string, status string) error {
-						<-ctx.Done()
-						return ctx.Err()
-					},
+		r := newTestRunner(&Config{
+			ArukasClient: &testArukasClient{
+				createAppResult: testArukasApp,
+				waitForStateFunc: func(ctx context.Context, serviceID string, status string) error {
+					<-ctx.Done()
+					return ctx.Err()
 				},
-				BootTimeout: time.Second,
 			},
-		}
+			BootTimeout: time.Second,
+		})
 		r.setupKeyPair()
 
-		host, port, err := r.startServer(ctx)
-		assert.Empty(t, host)
-		assert.Empty(t, port)
+		endpoint, err := r.startServer(ctx)
+		assert.Nil(t, endpoint)
 		assert.Error(t, err)
+		assert.IsType(t, &BootTimeoutError{}, err)
 	})
 
-	t.Run("Should set AppData to current runner's field", func(t *testing.T) {
-		r := &realRunner{
-			cfg: &Config{
-				ArukasClient: &testArukasClient{
-					createAppResult:   testArukasApp,
-					readServiceResult: testArukasService,
-				},
-				BootTimeout: 10 * time.Second,
+	t.Run("Should set AppData to current provider's field", func(t *testing.T) {
+		r := newTestRunner(&Config{
+			ArukasClient: &testArukasClient{
+				createAppResult:   testArukasApp,
+				readServiceResult: testArukasService,
 			},
-		}
+			BootTimeout: 10 * time.Second,
+		})
 		r.setupKeyPair()
 
-		host, port, err := r.startServer(ctx)
+		endpoint, err := r.startServer(ctx)
 		assert.NoError(t, err)
-		assert.NotNil(t, r.currentArukasApp)
-		assert.Equal(t, "example.arukascloud.io", host)
-		assert.Equal(t, 22222, port)
+		assert.NotNil(t, r.provider.(*arukasProvider).currentArukasApp)
+		assert.Equal(t, "example.arukascloud.io", endpoint.Host)
+		assert.Equal(t, 22222, endpoint.Port)
+		assert.Equal(t, testArukasApp.AppID(), endpoint.ID)
 	})
 }
 
+func newTestRunner(cfg *Config) *realRunner {
+	return &realRunner{cfg: cfg, provider: cfg.provider()}
+}
+
 func TestConnectToHost(t *testing.T) {
 
 	stdOut := &bytes.Buffer{}
@@ -258,6 +271,7 @@ func TestConnectToHost(t *testing.T) {
 			HealthCheckAddr: "127.0.0.1",
 			HealthCheckPort: server.RarukasDefaultHTTPPort,
 			Command:         "/bin/sh",
+			HostKey:         r.cfg.hostKey,
 		})
 	}()
 
@@ -344,6 +358,48 @@ func TestConnectToHost(t *testing.T) {
 		}
 		assert.Equal(t, "foobar", stdErr.String())
 	})
+
+	t.Run("Execute command with non-zero exit status", func(t *testing.T) {
+		r.cfg.Commands = []string{"exit", "3"}
+		go func() {
+			errChan <- r.execCommand(ctx, "127.0.0.1", server.RarukasDefaultSSHPort)
+		}()
+
+		select {
+		case err := <-errChan:
+			assert.Equal(t, &RemoteExitError{Status: 3}, err)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	})
+
+	t.Run("Execute command terminated by signal", func(t *testing.T) {
+		r.cfg.Commands = []string{"kill", "-TERM", "$$"}
+		go func() {
+			errChan <- r.execCommand(ctx, "127.0.0.1", server.RarukasDefaultSSHPort)
+		}()
+
+		select {
+		case err := <-errChan:
+			assert.Equal(t, &RemoteExitError{Status: 143, Signal: "TERM"}, err)
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+	})
+
+	t.Run("Reject server with other host key", func(t *testing.T) {
+		otherHostKey, _, err := generateHostKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg := *r.cfg
+		cfg.hostPublicKey = string(otherHostKey)
+		other := &realRunner{cfg: &cfg}
+
+		_, err = other.openSSHConn("root", addr, []byte(cfg.PrivateKey))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "host key mismatch")
+	})
 }
 
 func TestSCP(t *testing.T) {
@@ -377,6 +433,7 @@ func TestSCP(t *testing.T) {
 			HealthCheckAddr: "127.0.0.1",
 			HealthCheckPort: server.RarukasDefaultHTTPPort + 1,
 			Command:         "/bin/sh",
+			HostKey:         r.cfg.hostKey,
 		})
 	}()
 
@@ -435,7 +492,7 @@ func TestSCP(t *testing.T) {
 		r.cfg.SyncDir = "test/dir1"
 		r.cfg.CommandFile = ""
 
-		err := r.uploadSourceDir(ctx, "127.0.0.1", server.RarukasDefaultSSHPort+1)
+		err := r.uploadSourceDir(ctx, "127.0.0.1", server.RarukasDefaultSSHPort+1, r.cfg.syncMappings()[0])
 		assert.NoError(t, err)
 
 		expects := []struct {
@@ -484,11 +541,11 @@ func TestSCP(t *testing.T) {
 		r.cfg.CommandFile = ""
 
 		// prepare workdir
-		err := r.uploadSourceDir(ctx, "127.0.0.1", server.RarukasDefaultSSHPort+1)
+		err := r.uploadSourceDir(ctx, "127.0.0.1", server.RarukasDefaultSSHPort+1, r.cfg.syncMappings()[0])
 		assert.NoError(t, err)
 
 		// download
-		err = r.downloadRemoteDir(ctx, "127.0.0.1", server.RarukasDefaultSSHPort+1)
+		err = r.downloadRemoteDir(ctx, "127.0.0.1", server.RarukasDefaultSSHPort+1, r.cfg.syncMappings()[0])
 		assert.NoError(t, err)
 
 		expects := []struct {
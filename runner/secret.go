@@ -0,0 +1,257 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/rarukas/rarukas/server"
+	"golang.org/x/crypto/ssh"
+)
+
+// SecretMask replaces secret values in output of the command and logs
+const SecretMask = "***"
+
+// SecretSources read secret values by scheme of Secret.Source("scheme:argument").
+// Other sources can be added by registering them
+var SecretSources = map[string]func(arg string) ([]byte, error){
+	// env reads local environment variable
+	"env": func(name string) ([]byte, error) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %q is not set", name)
+		}
+		return []byte(value), nil
+	},
+	// file reads local file
+	"file": func(path string) ([]byte, error) {
+		path, err := homedir.Expand(path)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadFile(path)
+	},
+	// cmd reads stdout of local command(e.g. "cmd:pass show sakuracloud/token")
+	"cmd": func(command string) ([]byte, error) {
+		cmd := exec.Command("sh", "-c", command)
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", command)
+		}
+		cmd.Stderr = os.Stderr
+		return cmd.Output()
+	},
+}
+
+// Secret is value passed to the command only over SSH session. It is never stored in the app definition
+// nor written in the command line, and it is masked in output of the command and logs
+type Secret struct {
+	// Name is name of environment variable of the command
+	Name string
+	// File writes the value into file on tmpfs of rarukas-server, and the environment variable has the path to the file.
+	// The file is wiped after the session
+	File bool
+	// Source is "scheme:argument" of SecretSources
+	Source string
+
+	value string
+}
+
+// ParseSecret parses "NAME" or "NAME=SOURCE". SOURCE is "scheme:argument" of SecretSources.
+// Without scheme, SOURCE is name of local environment variable, or path to local file if file is true.
+// "NAME" is same as "NAME=env:NAME"
+func ParseSecret(spec string, file bool) (*Secret, error) {
+	name, source := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		name, source = spec[:i], spec[i+1:]
+	} else if file {
+		return nil, fmt.Errorf("%q must be NAME=SOURCE", spec)
+	}
+	if !envNameRegexp.MatchString(name) {
+		return nil, fmt.Errorf("%q is invalid name", name)
+	}
+	if server.RefusesEnv(name) {
+		return nil, fmt.Errorf("%q is always refused by rarukas-server", name)
+	}
+
+	switch {
+	case source == "":
+		source = "env:" + name
+	case !strings.Contains(source, ":") || !isSecretScheme(source[:strings.Index(source, ":")]):
+		if file {
+			source = "file:" + source
+		} else {
+			source = "env:" + source
+		}
+	}
+	return &Secret{Name: name, File: file, Source: source}, nil
+}
+
+func isSecretScheme(scheme string) bool {
+	_, ok := SecretSources[scheme]
+	return ok
+}
+
+// Resolve reads the value from Source. Trailing newlines are removed unless File is true
+func (s *Secret) Resolve() error {
+	i := strings.Index(s.Source, ":")
+	if i < 0 || !isSecretScheme(s.Source[:i]) {
+		return fmt.Errorf("secret %q: unknown source %q", s.Name, s.Source)
+	}
+	value, err := SecretSources[s.Source[:i]](s.Source[i+1:])
+	if err != nil {
+		return fmt.Errorf("secret %q: reading from %s failed: %s", s.Name, s.Source[:i], err)
+	}
+	s.value = string(value)
+	if !s.File {
+		s.value = strings.TrimRight(s.value, "\r\n")
+	}
+	return nil
+}
+
+// setSessionSecrets sends secrets to rarukas-server as "env" requests.
+// Values of secret files are sent with server.RarukasSecretFileEnvPrefix, and written into files by rarukas-server
+func setSessionSecrets(session *ssh.Session, secrets []*Secret) error {
+	for _, secret := range secrets {
+		name := secret.Name
+		if secret.File {
+			name = server.RarukasSecretFileEnvPrefix + secret.Name
+		}
+		if err := session.Setenv(name, secret.value); err != nil {
+			return fmt.Errorf("rarukas-server refused secret %q: %s", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// prepareSession sends Env and Secrets to rarukas-server, and sets output of session masking Secrets.
+// It returns cmd exporting Env refused by the server, and func that flushes output held by masking
+func (r *realRunner) prepareSession(session *ssh.Session, cmd string) (string, func(), error) {
+	cmd = envExports(setSessionEnv(session, r.cfg.Env)) + cmd
+	// secrets are sent after Env to take precedence over it
+	if err := setSessionSecrets(session, r.cfg.Secrets); err != nil {
+		return "", nil, err
+	}
+
+	stdout := newSecretMasker(r.cfg.stdout(), r.cfg.Secrets)
+	stderr := newSecretMasker(r.cfg.stderr(), r.cfg.Secrets)
+	session.Stdout = stdout
+	session.Stderr = stderr
+	return cmd, func() {
+		stdout.Flush() // nolint -> return value not checked
+		stderr.Flush() // nolint -> return value not checked
+	}, nil
+}
+
+// MaskSecrets returns writer that replaces values of secrets with SecretMask. Each Write must have whole output
+// such as a log entry. Use it for log output
+func MaskSecrets(w io.Writer, secrets []*Secret) io.Writer {
+	return &flushingWriter{m: newSecretMasker(w, secrets)}
+}
+
+type flushingWriter struct {
+	m *secretMasker
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	if _, err := f.m.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), f.m.Flush()
+}
+
+// secretMasker replaces values of secrets in the stream with SecretMask.
+// The end of written data that may be the beginning of a secret is held until next Write or Flush
+type secretMasker struct {
+	mu      sync.Mutex
+	w       io.Writer
+	values  [][]byte
+	pending []byte
+}
+
+func newSecretMasker(w io.Writer, secrets []*Secret) *secretMasker {
+	m := &secretMasker{w: w}
+	for _, secret := range secrets {
+		// trailing newline of secret file is kept in output
+		value := strings.TrimRight(secret.value, "\r\n")
+		m.add(value)
+		// lines of multi-line secret(e.g. private key) are masked even if they are printed separately
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				m.add(strings.TrimSpace(line))
+			}
+		}
+	}
+	// longer values first so that a value containing another one is masked as a whole
+	sort.Slice(m.values, func(i, j int) bool {
+		return len(m.values[i]) > len(m.values[j])
+	})
+	return m
+}
+
+func (m *secretMasker) add(value string) {
+	if value == "" {
+		return
+	}
+	for _, v := range m.values {
+		if string(v) == value {
+			return
+		}
+	}
+	m.values = append(m.values, []byte(value))
+}
+
+func (m *secretMasker) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf := append(m.pending, p...)
+	for _, v := range m.values {
+		buf = bytes.Replace(buf, v, []byte(SecretMask), -1)
+	}
+	held := m.partialLen(buf)
+	m.pending = append([]byte{}, buf[len(buf)-held:]...)
+
+	if _, err := m.w.Write(buf[:len(buf)-held]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes held data
+func (m *secretMasker) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.pending) == 0 {
+		return nil
+	}
+	_, err := m.w.Write(m.pending)
+	m.pending = nil
+	return err
+}
+
+// partialLen returns length of the longest suffix of buf that is the beginning of a secret
+func (m *secretMasker) partialLen(buf []byte) int {
+	held := 0
+	for _, v := range m.values {
+		n := len(v) - 1
+		if n > len(buf) {
+			n = len(buf)
+		}
+		for ; n > held; n-- {
+			if bytes.HasSuffix(buf, v[:n]) {
+				held = n
+				break
+			}
+		}
+	}
+	return held
+}
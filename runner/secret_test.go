@@ -0,0 +1,118 @@
+package runner
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSecret(t *testing.T) {
+	expects := []struct {
+		spec   string
+		file   bool
+		name   string
+		source string
+		err    bool
+	}{
+		{spec: "TOKEN", name: "TOKEN", source: "env:TOKEN"},
+		{spec: "TOKEN=ARUKAS_TOKEN", name: "TOKEN", source: "env:ARUKAS_TOKEN"},
+		{spec: "TOKEN=cmd:pass show token", name: "TOKEN", source: "cmd:pass show token"},
+		{spec: "KUBECONFIG=~/.kube/config", file: true, name: "KUBECONFIG", source: "file:~/.kube/config"},
+		{spec: "KUBECONFIG=c:/kube/config", file: true, name: "KUBECONFIG", source: "file:c:/kube/config"},
+		{spec: "KUBECONFIG=env:KUBECONFIG_DATA", file: true, name: "KUBECONFIG", source: "env:KUBECONFIG_DATA"},
+		{spec: "KUBECONFIG", file: true, err: true},
+		{spec: "1TOKEN=FOO", err: true},
+		{spec: "LD_PRELOAD=FOO", err: true},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.spec, func(t *testing.T) {
+			secret, err := ParseSecret(expect.spec, expect.file)
+			if expect.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, &Secret{Name: expect.name, File: expect.file, Source: expect.source}, secret)
+		})
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	os.Setenv("RARUKAS_TEST_SECRET", "env-secret\n") // nolint
+	defer os.Unsetenv("RARUKAS_TEST_SECRET")         // nolint
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+	secretFile := filepath.Join(tmpDir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	expects := []struct {
+		secret *Secret
+		value  string
+		err    bool
+	}{
+		{secret: &Secret{Name: "A", Source: "env:RARUKAS_TEST_SECRET"}, value: "env-secret"},
+		{secret: &Secret{Name: "A", Source: "env:RARUKAS_TEST_NOT_SET"}, err: true},
+		{secret: &Secret{Name: "A", Source: "file:" + secretFile}, value: "file-secret"},
+		{secret: &Secret{Name: "A", File: true, Source: "file:" + secretFile}, value: "file-secret\n"},
+		{secret: &Secret{Name: "A", Source: "cmd:echo cmd-secret"}, value: "cmd-secret"},
+		{secret: &Secret{Name: "A", Source: "cmd:exit 1"}, err: true},
+		{secret: &Secret{Name: "A", Source: "vault:secret/token"}, err: true},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.secret.Source, func(t *testing.T) {
+			err := expect.secret.Resolve()
+			if expect.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, expect.value, expect.secret.value)
+		})
+	}
+}
+
+func TestSecretMasker(t *testing.T) {
+	secrets := []*Secret{
+		{Name: "TOKEN", value: "s3cr3t-token"},
+		{Name: "KEY", File: true, value: "-----BEGIN KEY-----\nAAAABBBBCCCC\n-----END KEY-----\n"},
+	}
+
+	t.Run("Mask secret split across writes", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		m := newSecretMasker(buf, secrets)
+		for _, s := range []string{"token: s3c", "r3t", "-token\n", "s3cr"} {
+			m.Write([]byte(s)) // nolint
+		}
+		assert.Equal(t, "token: ***\n", buf.String())
+		assert.NoError(t, m.Flush())
+		assert.Equal(t, "token: ***\ns3cr", buf.String())
+	})
+
+	t.Run("Mask lines of multi-line secret", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		m := newSecretMasker(buf, secrets)
+		m.Write([]byte("key is AAAABBBBCCCC\n")) // nolint
+		assert.NoError(t, m.Flush())
+		assert.Equal(t, "key is ***\n", buf.String())
+	})
+
+	t.Run("Mask log entries", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		w := MaskSecrets(buf, secrets)
+		w.Write([]byte("[ERROR] invalid token s3cr3t-token\n")) // nolint
+		w.Write([]byte("[INFO] s3cr"))                          // nolint
+		assert.Equal(t, "[ERROR] invalid token ***\n[INFO] s3cr", buf.String())
+	})
+}
@@ -0,0 +1,343 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yamamoto-febc/go-arukas"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrSessionNotFound is returned when the session is not found in SessionStore
+var ErrSessionNotFound = errors.New("Session is not found")
+
+// sessionNameRegexp is valid name of session. It is used as file name in SessionStore
+var sessionNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// PlanMonthlyPrices is estimated monthly price(JPY, excluding tax) of each Arukas plan.
+// It is used only for displaying estimated cost, and may differ from actual billing
+var PlanMonthlyPrices = map[string]int{
+	arukas.PlanFree:      0,
+	arukas.PlanHobby:     500,
+	arukas.PlanStandard1: 2000,
+	arukas.PlanStandard2: 4000,
+}
+
+// Session is rarukas-server kept running across rarukas invocations
+type Session struct {
+	Name       string    `json:"name"`
+	AppID      string    `json:"app_id"`
+	Host       string    `json:"host"`
+	Port       int       `json:"port"`
+	WorkDir    string    `json:"work_dir,omitempty"`
+	TmpDir     string    `json:"tmp_dir,omitempty"`
+	PrivateKey string    `json:"private_key"`
+	HostKey    string    `json:"host_key"`
+	RunID      string    `json:"run_id,omitempty"`
+	Plan       string    `json:"plan"`
+	ImageType  string    `json:"image_type,omitempty"`
+	ImageName  string    `json:"image_name,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Age returns elapsed time since the session was created
+func (s *Session) Age(now time.Time) time.Duration {
+	return now.Sub(s.CreatedAt)
+}
+
+// EstimatedCost returns estimated cost(JPY) of the session until now.
+// Monthly price is prorated per hour, and capped at the monthly price
+func (s *Session) EstimatedCost(now time.Time) float64 {
+	price, ok := PlanMonthlyPrices[s.Plan]
+	if !ok {
+		return 0
+	}
+	hours := math.Ceil(s.Age(now).Hours())
+	return math.Min(float64(price), float64(price)*hours/(30*24))
+}
+
+// remoteWorkDir returns working directory on rarukas-server without trailing slash
+func (s *Session) remoteWorkDir() string {
+	workDir := s.WorkDir
+	if workDir == "" {
+		workDir = RarukasServerWorkDir
+	}
+	return strings.TrimRight(workDir, "/")
+}
+
+// remotePath resolves p from working directory on rarukas-server
+func (s *Session) remotePath(p string) string {
+	if p == "" {
+		return s.remoteWorkDir()
+	}
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(s.remoteWorkDir(), p)
+}
+
+// SessionStore stores Sessions as JSON files under Dir
+type SessionStore struct {
+	Dir string
+}
+
+// NewSessionStore returns SessionStore
+func NewSessionStore(dir string) *SessionStore {
+	return &SessionStore{Dir: dir}
+}
+
+// path returns path to the file of the session. Names that could point outside of Dir are refused
+func (s *SessionStore) path(name string) (string, error) {
+	if !sessionNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("Session name %q is invalid", name)
+	}
+	return filepath.Join(s.Dir, name+".json"), nil
+}
+
+// Save writes the session. The file is readable only by owner because it has private key
+func (s *SessionStore) Save(session *Session) error {
+	p, err := s.path(session.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0600)
+}
+
+// Load reads the session. If not exists, returns ErrSessionNotFound
+func (s *SessionStore) Load(name string) (*Session, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("parsing session file %q failed: %s", p, err)
+	}
+	return session, nil
+}
+
+// Delete removes the session
+func (s *SessionStore) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns all sessions sorted by name
+func (s *SessionStore) List() ([]*Session, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var sessions []*Session
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".json")
+		if !sessionNameRegexp.MatchString(name) {
+			continue
+		}
+		session, err := s.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Up starts rarukas-server and returns it as Session. The server keeps running until Down is called
+func Up(ctx context.Context, cfg *Config) (*Session, error) {
+	r := &realRunner{cfg: cfg, provider: cfg.provider()}
+	if err := r.setupKeyPair(); err != nil {
+		return nil, err
+	}
+	// names of environment variables of later exec are unknown. Environment variables that change how commands run
+	// are still refused, and forced commands of authorized keys get no environment variables
+	cfg.acceptEnv = []string{"*"}
+
+	endpoint, err := r.startServer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.ID == "" {
+		r.cleanupServer()
+		return nil, errors.New("Provider doesn't support session")
+	}
+
+	return &Session{
+		Name:       cfg.ArukasName,
+		AppID:      endpoint.ID,
+		Host:       endpoint.Host,
+		Port:       endpoint.Port,
+		WorkDir:    cfg.serverWorkDir,
+		TmpDir:     cfg.serverTmpDir,
+		PrivateKey: cfg.PrivateKey,
+		HostKey:    cfg.hostPublicKey,
+		RunID:      cfg.runID,
+		Plan:       cfg.ArukasPlan,
+		ImageType:  cfg.RarukasImageType,
+		ImageName:  cfg.ArukasImageName,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// Exec runs the command or the job on the session. It uploads/downloads sync-dir like Run
+func Exec(ctx context.Context, cfg *Config, session *Session) error {
+	r := newSessionRunner(cfg, session)
+	if cfg.DryRun {
+		return r.withSSHConn(ctx, session.Host, session.Port, r.dryRun)
+	}
+	return r.runOn(ctx, session.Host, session.Port)
+}
+
+// CopyTo copies local file or directory into the directory on the session.
+// Relative remotePath is resolved from working directory on rarukas-server
+func CopyTo(ctx context.Context, cfg *Config, session *Session, localPath, remotePath string) error {
+	r := newSessionRunner(cfg, session)
+	remoteDir := session.remotePath(remotePath)
+	log.Printf("[INFO] Copying %q to %s:%s...", localPath, session.Name, remoteDir)
+
+	err := r.withSSHConn(ctx, session.Host, session.Port, func(client *ssh.Client) error {
+		transfer := newFileTransfer(client)
+		defer transfer.Close() // nolint -> return value not checked
+
+		fi, err := os.Stat(localPath)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return transfer.SendDir(localPath, remoteDir)
+		}
+		return transfer.SendFile(localPath, remoteDir+"/")
+	})
+	if err != nil {
+		return transferError(ctx, "upload", err)
+	}
+	return nil
+}
+
+// CopyFrom copies file or directory on the session into local directory.
+// Relative remotePath is resolved from working directory on rarukas-server
+func CopyFrom(ctx context.Context, cfg *Config, session *Session, remotePath, localDir string) error {
+	r := newSessionRunner(cfg, session)
+	remotePath = session.remotePath(remotePath)
+	log.Printf("[INFO] Copying %s:%s to %q...", session.Name, remotePath, localDir)
+
+	err := r.withSSHConn(ctx, session.Host, session.Port, func(client *ssh.Client) error {
+		if err := os.MkdirAll(localDir, 0755); err != nil {
+			return err
+		}
+
+		transfer := newFileTransfer(client)
+		defer transfer.Close() // nolint -> return value not checked
+
+		isDir, err := transfer.IsDir(remotePath)
+		if err != nil {
+			return err
+		}
+		if isDir {
+			return transfer.ReceiveDir(remotePath, localDir)
+		}
+		return transfer.ReceiveFile(remotePath, filepath.Join(localDir, path.Base(remotePath)))
+	})
+	if err != nil {
+		return transferError(ctx, "download", err)
+	}
+	return nil
+}
+
+// Down deletes rarukas-server of the session
+func Down(ctx context.Context, cfg *Config, session *Session) error {
+	provider := cfg.Provider
+	if provider == nil {
+		provider = NewArukasProvider(&ArukasProviderParam{
+			Client: cfg.ArukasClient,
+			AppID:  session.AppID,
+		})
+	}
+	log.Printf("[INFO] Deleting rarukas-server(app: %s)...", session.AppID)
+	return provider.Destroy()
+}
+
+func newSessionRunner(cfg *Config, session *Session) *realRunner {
+	cfg.PrivateKey = session.PrivateKey
+	cfg.hostPublicKey = session.HostKey
+	cfg.serverWorkDir = session.WorkDir
+	cfg.serverTmpDir = session.TmpDir
+	return &realRunner{cfg: cfg}
+}
+
+// withSSHConn calls fn with new SSH connection to rarukas-server
+func (r *realRunner) withSSHConn(ctx context.Context, host string, port int, fn func(client *ssh.Client) error) error {
+	execCtx, cancel := context.WithTimeout(ctx, r.cfg.ExecTimeout)
+	defer cancel()
+
+	errChan := make(chan error, 1)
+	go func() {
+		addr := fmt.Sprintf("%s:%d", host, port)
+		client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+		if err != nil {
+			errChan <- err
+			return
+		}
+		defer client.Close() // nolint -> return value not checked
+		errChan <- fn(client)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-execCtx.Done():
+		return execCtx.Err()
+	}
+}
+
+func remoteIsDir(client *ssh.Client, remotePath string) (bool, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return false, err
+	}
+	defer session.Close() // nolint -> return value not checked
+
+	err = session.Run(fmt.Sprintf("test -d %s", shellQuote(remotePath)))
+	if err == nil {
+		return true, nil
+	}
+	if _, ok := err.(*ssh.ExitError); ok {
+		return false, nil
+	}
+	return false, err
+}
@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yamamoto-febc/go-arukas"
+)
+
+func TestSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint
+
+	store := NewSessionStore(dir + "/sessions")
+
+	_, err = store.Load("not-exists")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	createdAt := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{"foo", "bar"} {
+		err := store.Save(&Session{Name: name, AppID: name + "-id", Host: "localhost", Port: 2222, CreatedAt: createdAt})
+		assert.NoError(t, err)
+	}
+
+	p, err := store.path("foo")
+	assert.NoError(t, err)
+	fi, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	session, err := store.Load("foo")
+	assert.NoError(t, err)
+	assert.Equal(t, "foo-id", session.AppID)
+	assert.True(t, createdAt.Equal(session.CreatedAt))
+
+	sessions, err := store.List()
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 2) {
+		assert.Equal(t, "bar", sessions[0].Name)
+		assert.Equal(t, "foo", sessions[1].Name)
+	}
+
+	assert.NoError(t, store.Delete("foo"))
+	assert.NoError(t, store.Delete("foo"))
+	_, err = store.Load("foo")
+	assert.Equal(t, ErrSessionNotFound, err)
+
+	// names that could point outside of the store are refused
+	for _, name := range []string{"", "../foo", "foo/bar", ".foo", "-foo", "foo bar"} {
+		assert.Error(t, store.Save(&Session{Name: name}), name)
+		_, err := store.Load(name)
+		assert.Error(t, err, name)
+		assert.NotEqual(t, ErrSessionNotFound, err, name)
+		assert.Error(t, store.Delete(name), name)
+	}
+}
+
+func TestSessionEstimatedCost(t *testing.T) {
+	createdAt := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		plan   string
+		age    time.Duration
+		expect float64
+	}{
+		{plan: arukas.PlanFree, age: 24 * time.Hour, expect: 0},
+		{plan: arukas.PlanHobby, age: 72 * time.Hour, expect: 50},
+		{plan: arukas.PlanHobby, age: 30 * time.Minute, expect: 500.0 / 720},
+		{plan: arukas.PlanHobby, age: 60 * 24 * time.Hour, expect: 500},
+		{plan: "unknown", age: time.Hour, expect: 0},
+	}
+	for _, c := range cases {
+		s := &Session{Plan: c.plan, CreatedAt: createdAt}
+		assert.InDelta(t, c.expect, s.EstimatedCost(createdAt.Add(c.age)), 0.001, "%s/%s", c.plan, c.age)
+	}
+}
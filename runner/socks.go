@@ -0,0 +1,121 @@
+package runner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5(RFC1928) constants
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyGeneralFailure     = 0x01
+	socksReplyCmdNotSupported    = 0x07
+	socksReplyAddrTypeNotSupport = 0x08
+)
+
+// handshakeSOCKS handles SOCKS5 handshake on conn, and connects to requested address with dial.
+// Only CONNECT command without authentication is supported
+func handshakeSOCKS(conn net.Conn, dial func(network, addr string) (net.Conn, error)) (net.Conn, error) {
+	// version identifier/method selection
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion5 {
+		return nil, fmt.Errorf("SOCKS version %d is not supported", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socksMethodNoAcceptable)
+	for _, m := range methods {
+		if m == socksMethodNoAuth {
+			method = socksMethodNoAuth
+			break
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion5, method}); err != nil {
+		return nil, err
+	}
+	if method == socksMethodNoAcceptable {
+		return nil, errors.New("client doesn't support no authentication method")
+	}
+
+	// request
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return nil, err
+	}
+	if request[0] != socksVersion5 {
+		return nil, fmt.Errorf("SOCKS version %d is not supported", request[0])
+	}
+	if request[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksReplyCmdNotSupported) // nolint -> return value not checked
+		return nil, fmt.Errorf("SOCKS command %d is not supported", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socksAddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		writeSOCKSReply(conn, socksReplyAddrTypeNotSupport) // nolint -> return value not checked
+		return nil, fmt.Errorf("SOCKS address type %d is not supported", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	remote, err := dial("tcp", addr)
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyGeneralFailure) // nolint -> return value not checked
+		return nil, fmt.Errorf("connecting to %s failed: %s", addr, err)
+	}
+	if err := writeSOCKSReply(conn, socksReplySucceeded); err != nil {
+		remote.Close() // nolint -> return value not checked
+		return nil, err
+	}
+	return remote, nil
+}
+
+// writeSOCKSReply writes reply with zero bound address because it is unknown over SSH
+func writeSOCKSReply(conn net.Conn, reply byte) error {
+	_, err := conn.Write([]byte{socksVersion5, reply, 0x00, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,197 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/rarukas/rarukas/manifest"
+	"github.com/rarukas/rarukas/server"
+	"github.com/rarukas/rarukas/tarstream"
+	"golang.org/x/crypto/ssh"
+)
+
+// errStreamNotSupported is returned when rarukas-server doesn't offer tar stream subsystem
+var errStreamNotSupported = errors.New("tar stream subsystem is not supported")
+
+// streamSession is session of tar stream subsystem
+type streamSession struct {
+	*ssh.Session
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
+}
+
+// openStream sends req to tar stream subsystem of rarukas-server.
+// If rarukas-server doesn't offer the subsystem, it returns errStreamNotSupported
+func openStream(client *ssh.Client, req *tarstream.Request) (*streamSession, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	s := &streamSession{Session: session}
+	if s.stdin, err = session.StdinPipe(); err == nil {
+		if s.stdout, err = session.StdoutPipe(); err == nil {
+			s.stderr, err = session.StderrPipe()
+		}
+	}
+	if err != nil {
+		session.Close() // nolint -> return value not checked
+		return nil, err
+	}
+	if err := session.RequestSubsystem(server.RarukasTarSubsystem); err != nil {
+		session.Close() // nolint -> return value not checked
+		return nil, errStreamNotSupported
+	}
+	// tar stream follows the request immediately, so the request must not end with newline like json.Encoder writes
+	data, err := json.Marshal(req)
+	if err == nil {
+		_, err = s.stdin.Write(data)
+	}
+	if err != nil {
+		session.Close() // nolint -> return value not checked
+		return nil, err
+	}
+	return s, nil
+}
+
+// wait waits for rarukas-server to finish the request. err is replaced by message from rarukas-server if exists
+func (s *streamSession) wait(err error) error {
+	io.Copy(ioutil.Discard, s.stdout) // nolint -> return value not checked
+	if msg, _ := ioutil.ReadAll(s.stderr); len(msg) > 0 {
+		return errors.New(string(msg))
+	}
+	return err
+}
+
+// streamUpload uploads entries under localDir to remoteDir as one tar stream
+func streamUpload(client *ssh.Client, localDir, remoteDir string, entries []*manifest.Entry, c tarstream.Compression) (*tarstream.Stats, error) {
+	s, err := openStream(client, &tarstream.Request{Dir: remoteDir, Extract: true, Compression: c})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close() // nolint -> return value not checked
+
+	stats, err := tarstream.Write(s.stdin, localDir, entryPaths(entries), c)
+	if closeErr := s.stdin.Close(); err == nil {
+		err = closeErr
+	}
+	if err := s.wait(err); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// streamDownload downloads entries under remoteDir into localDir as one tar stream
+func streamDownload(client *ssh.Client, remoteDir, localDir string, entries []*manifest.Entry, c tarstream.Compression) (*tarstream.Stats, error) {
+	s, err := openStream(client, &tarstream.Request{Dir: remoteDir, Paths: entryPaths(entries), Compression: c})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close() // nolint -> return value not checked
+
+	if err := s.stdin.Close(); err != nil {
+		return nil, err
+	}
+	stats, err := tarstream.Extract(s.stdout, localDir, c)
+	if err := s.wait(err); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// sendEntries uploads entries under localDir to remoteDir. With Stream, they are sent as one tar stream.
+// If rarukas-server doesn't support tar stream, they are sent one by one with transfer
+func (r *realRunner) sendEntries(client *ssh.Client, transfer fileTransfer, localDir, remoteDir string, entries []*manifest.Entry) error {
+	if r.cfg.Stream != "" {
+		start := time.Now()
+		stats, err := streamUpload(client, localDir, remoteDir, entries, r.cfg.Stream)
+		switch {
+		case err == errStreamNotSupported:
+			log.Print("[INFO] rarukas-server doesn't support tar stream, uploading files one by one...")
+		case err != nil:
+			return fmt.Errorf("uploading tar stream failed: %s", err)
+		default:
+			logStreamStats("Uploaded", r.cfg.Stream, stats, time.Since(start))
+			return nil
+		}
+	}
+
+	if err := transfer.MkdirAll(remoteDir); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Dir {
+			if err := transfer.MkdirAll(remotePath(remoteDir, e)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := transfer.SendFile(localPath(localDir, e), remotePath(remoteDir, e)); err != nil {
+			return fmt.Errorf("uploading %q failed: %s", e.Path, err)
+		}
+	}
+	return nil
+}
+
+// receiveEntries downloads entries under remoteDir into localDir. With Stream, they are received as one tar stream.
+// If rarukas-server doesn't support tar stream, they are received one by one with transfer
+func (r *realRunner) receiveEntries(client *ssh.Client, transfer fileTransfer, remoteDir, localDir string, entries []*manifest.Entry) error {
+	if r.cfg.Stream != "" {
+		start := time.Now()
+		stats, err := streamDownload(client, remoteDir, localDir, entries, r.cfg.Stream)
+		switch {
+		case err == errStreamNotSupported:
+			log.Print("[INFO] rarukas-server doesn't support tar stream, downloading files one by one...")
+		case err != nil:
+			return fmt.Errorf("downloading tar stream failed: %s", err)
+		default:
+			logStreamStats("Downloaded", r.cfg.Stream, stats, time.Since(start))
+			return nil
+		}
+	}
+
+	for _, e := range entries {
+		dir := localPath(localDir, e)
+		if !e.Dir {
+			dir = filepath.Dir(dir)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if e.Dir {
+			continue
+		}
+		if err := transfer.ReceiveFile(remotePath(remoteDir, e), localPath(localDir, e)); err != nil {
+			return fmt.Errorf("downloading %q failed: %s", e.Path, err)
+		}
+	}
+	return nil
+}
+
+func entryPaths(entries []*manifest.Entry) []string {
+	paths := make([]string, 0, len(entries))
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	return paths
+}
+
+func localPath(localDir string, e *manifest.Entry) string {
+	return filepath.Join(localDir, filepath.FromSlash(e.Path))
+}
+
+func remotePath(remoteDir string, e *manifest.Entry) string {
+	return path.Join(remoteDir, e.Path)
+}
+
+func logStreamStats(op string, c tarstream.Compression, stats *tarstream.Stats, elapsed time.Duration) {
+	log.Printf("[INFO] %s tar stream(%s): %s", op, c, stats.Summary(elapsed))
+}
@@ -0,0 +1,92 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rarukas/rarukas/tarstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncWithStream(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, addr := startTestServer(ctx, t, tmpDir)
+
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	for _, c := range []tarstream.Compression{tarstream.Gzip, tarstream.Zstd} {
+		t.Run(string(c), func(t *testing.T) {
+			r.cfg.Stream = c
+			localDir := filepath.Join(tmpDir, "local-"+string(c))
+			remoteDir := filepath.Join(tmpDir, "remote-"+string(c))
+			writeFiles(t, localDir, map[string]string{
+				"main.go":        "main",
+				"dir/nested.txt": "nested",
+			})
+			assert.NoError(t, os.MkdirAll(filepath.Join(localDir, "empty"), 0755))
+
+			diff, err := r.syncUpload(client, localDir, remoteDir, nil)
+			assert.NoError(t, err)
+			assert.Len(t, diff.Files, 2)
+			assertFileContent(t, filepath.Join(remoteDir, "dir/nested.txt"), "nested")
+			assert.True(t, fileExists(filepath.Join(remoteDir, "empty")))
+
+			writeFiles(t, remoteDir, map[string]string{"out/result.txt": "result"})
+
+			diff, err = r.syncDownload(client, remoteDir, localDir, nil)
+			assert.NoError(t, err)
+			assert.Len(t, diff.Files, 1)
+			assertFileContent(t, filepath.Join(localDir, "out/result.txt"), "result")
+		})
+	}
+}
+
+func TestStreamWithoutTarSubsystem(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &realRunner{cfg: &Config{}}
+	r.setupKeyPair()
+
+	sshServer := &ssh.Server{Handler: func(s ssh.Session) {}}
+	sshServer.SetOption(ssh.HostKeyPEM([]byte(r.cfg.hostKey))) // nolint
+	go sshServer.Serve(listener)                               // nolint
+	defer sshServer.Close()                                    // nolint
+	client, err := r.openSSHConn("root", listener.Addr().String(), []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	_, err = streamUpload(client, "test/dir1", "work", nil, tarstream.Gzip)
+	assert.Equal(t, errStreamNotSupported, err)
+	_, err = streamDownload(client, "work", "test/dir1", nil, tarstream.Gzip)
+	assert.Equal(t, errStreamNotSupported, err)
+}
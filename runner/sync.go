@@ -0,0 +1,290 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/rarukas/rarukas/manifest"
+	"github.com/rarukas/rarukas/server"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// IgnoreFileName is name of gitignore-syntax file in SyncDir. Matched files are neither uploaded nor downloaded
+	IgnoreFileName = ".rarukasignore"
+	// DownloadIgnoreFileName is name of gitignore-syntax file in SyncDir. Matched files are not downloaded
+	DownloadIgnoreFileName = ".rarukasignore-download"
+)
+
+// errManifestNotSupported is returned when rarukas-server doesn't offer manifest subsystem
+var errManifestNotSupported = errors.New("manifest subsystem is not supported")
+
+// uploadRules returns rules of files in localDir excluded from upload: IgnoreFileName, Excludes, then Includes
+func (c *Config) uploadRules(localDir string) (*manifest.Rules, error) {
+	rules, err := manifest.LoadRules(filepath.Join(localDir, IgnoreFileName))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %s", IgnoreFileName, err)
+	}
+	rules.Add(c.Excludes...)
+	rules.Include(c.Includes...)
+	return rules, nil
+}
+
+// downloadRules returns rules of files excluded from download into localDir.
+// Files excluded from upload are also excluded so that local-only files are not deleted by download
+func (c *Config) downloadRules(localDir string) (*manifest.Rules, error) {
+	rules, err := c.uploadRules(localDir)
+	if err != nil {
+		return nil, err
+	}
+	downloadRules, err := manifest.LoadRules(filepath.Join(localDir, DownloadIgnoreFileName))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %s", DownloadIgnoreFileName, err)
+	}
+	rules.Append(downloadRules)
+	rules.Add(c.DownloadExcludes...)
+	rules.Include(c.DownloadIncludes...)
+	return rules, nil
+}
+
+// remoteManifest requests manifest of remoteDir to rarukas-server
+func remoteManifest(client *ssh.Client, remoteDir string, rules *manifest.Rules) (*manifest.Manifest, error) {
+	req := &manifest.Request{Dir: remoteDir, Rules: rules.Patterns()}
+	return requestManifest(client, server.RarukasManifestSubsystem, req)
+}
+
+// requestManifest sends req to the subsystem of rarukas-server, and reads manifest.
+// If rarukas-server doesn't offer the subsystem, it returns errManifestNotSupported
+func requestManifest(client *ssh.Client, subsystem string, req *manifest.Request) (*manifest.Manifest, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close() // nolint -> return value not checked
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem(subsystem); err != nil {
+		return nil, errManifestNotSupported
+	}
+
+	if err := json.NewEncoder(stdin).Encode(req); err != nil {
+		return nil, err
+	}
+	m := &manifest.Manifest{}
+	if err := json.NewDecoder(stdout).Decode(m); err != nil {
+		if msg, _ := ioutil.ReadAll(stderr); len(msg) > 0 {
+			err = errors.New(string(msg))
+		}
+		return nil, fmt.Errorf("reading manifest of %q failed: %s", req.Dir, err)
+	}
+	return m, nil
+}
+
+// planUpload returns Diff to upload localDir to remoteDir, and manifest of localDir.
+// If client is nil or rarukas-server doesn't support manifest, all files are uploaded and nothing is deleted
+func planUpload(client *ssh.Client, localDir, remoteDir string, rules *manifest.Rules) (*manifest.Diff, *manifest.Manifest, error) {
+	rules = excludeBackupDir(rules)
+	local, err := manifest.Build(localDir, rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := &manifest.Manifest{Entries: map[string]*manifest.Entry{}}
+	if client != nil {
+		m, err := remoteManifest(client, remoteDir, rules)
+		switch {
+		case err == errManifestNotSupported:
+			log.Print("[INFO] rarukas-server doesn't support incremental sync, uploading all files...")
+		case err != nil:
+			return nil, nil, err
+		default:
+			remote = m
+		}
+	}
+	return manifest.Compare(local, remote), local, nil
+}
+
+// syncUpload uploads only added or changed files under localDir to remoteDir, and deletes remote files
+// that don't exist in localDir. Files excluded by rules are neither uploaded nor deleted
+func (r *realRunner) syncUpload(client *ssh.Client, localDir, remoteDir string, rules *manifest.Rules) (*manifest.Diff, error) {
+	diff, uploaded, err := planUpload(client, localDir, remoteDir, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	transfer := newFileTransfer(client)
+	defer transfer.Close() // nolint -> return value not checked
+
+	for _, e := range diff.Deleted {
+		if err := transfer.RemoveAll(path.Join(remoteDir, e.Path)); err != nil {
+			return nil, fmt.Errorf("deleting %q failed: %s", e.Path, err)
+		}
+	}
+	entries := append(append([]*manifest.Entry{}, diff.Dirs...), diff.Files...)
+	if err := r.sendEntries(client, transfer, localDir, remoteDir, entries); err != nil {
+		return nil, err
+	}
+	// remote is same as local at this point. It is used to detect changes on rarukas-server by MergeFailOnConflict
+	if r.remoteBaselines == nil {
+		r.remoteBaselines = map[string]*manifest.Manifest{}
+	}
+	r.remoteBaselines[remoteDir] = uploaded
+	return diff, nil
+}
+
+// syncDownload downloads only added or changed files under remoteDir to localDir, and merges them by MergeStrategy.
+// Files excluded by rules are neither downloaded nor deleted.
+// Local directory isn't changed until all files are downloaded into staging directory.
+// If rarukas-server doesn't support manifest, whole remoteDir is downloaded into staging directory at first
+func (r *realRunner) syncDownload(client *ssh.Client, remoteDir, localDir string, rules *manifest.Rules) (*manifest.Diff, error) {
+	transfer := newFileTransfer(client)
+	defer transfer.Close() // nolint -> return value not checked
+
+	merger, err := newLocalMerger(localDir, r.cfg.runID)
+	if err != nil {
+		return nil, err
+	}
+	defer merger.Close() // nolint -> return value not checked
+
+	rules = excludeBackupDir(rules)
+	var staged func(e *manifest.Entry) string
+	remote, err := remoteManifest(client, remoteDir, rules)
+	if err == errManifestNotSupported {
+		log.Print("[INFO] rarukas-server doesn't support incremental sync, downloading all files...")
+
+		// receive -> [stagingDir]/remoteDir.Base()
+		if err := transfer.ReceiveDir(remoteDir, merger.stagingDir); err != nil {
+			return nil, err
+		}
+		receivedDir := filepath.Join(merger.stagingDir, path.Base(path.Clean(remoteDir)))
+		if remote, err = manifest.Build(receivedDir, rules); err != nil {
+			return nil, err
+		}
+		staged = func(e *manifest.Entry) string {
+			return filepath.Join(receivedDir, filepath.FromSlash(e.Path))
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	local, err := manifest.Build(localDir, rules)
+	if err != nil {
+		return nil, err
+	}
+	diff := manifest.Compare(remote, local)
+	strategy := r.cfg.mergeStrategy()
+	applyMergeStrategy(strategy, diff, remote)
+	if localBaseline, ok := r.localBaselines[localDir]; ok && strategy == MergeFailOnConflict {
+		if err := resolveConflicts(diff, local, localBaseline, remote, r.remoteBaselines[remoteDir]); err != nil {
+			return nil, err
+		}
+	}
+
+	if staged == nil {
+		staged = func(e *manifest.Entry) string {
+			return merger.stagingPath(e.Path)
+		}
+		if err := r.receiveEntries(client, transfer, remoteDir, merger.stagingDir, diff.Files); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := merger.commit(diff, staged); err != nil {
+		return nil, fmt.Errorf("merging downloaded files into %q failed: %s", localDir, err)
+	}
+	return diff, nil
+}
+
+func logSyncSummary(op string, dir string, diff *manifest.Diff) {
+	log.Printf("[INFO] %s %q: %s", op, dir, diff.Summary())
+}
+
+// printSyncPlan prints entries to be transferred or deleted, and excluded paths
+func printSyncPlan(w io.Writer, title string, diff *manifest.Diff, excluded []string) {
+	fmt.Fprintf(w, "%s:\n", title) // nolint
+	for _, e := range diff.Deleted {
+		fmt.Fprintf(w, "  - %s\n", e.Path) // nolint
+	}
+	for _, e := range diff.Dirs {
+		fmt.Fprintf(w, "  + %s/\n", e.Path) // nolint
+	}
+	for _, e := range diff.Files {
+		fmt.Fprintf(w, "  + %s (%s)\n", e.Path, manifest.FormatBytes(e.Size)) // nolint
+	}
+	if len(excluded) > 0 {
+		fmt.Fprintf(w, "  excluded: %s\n", strings.Join(excluded, ", ")) // nolint
+	}
+	fmt.Fprintf(w, "  %s\n", diff.Summary()) // nolint
+}
+
+// dryRun prints files to be uploaded and downloaded instead of running the command.
+// If client is nil(rarukas-server isn't started yet), all files are listed as upload targets
+func (r *realRunner) dryRun(client *ssh.Client) error {
+	out := r.cfg.stdout()
+	if len(r.cfg.syncMappings()) == 0 {
+		fmt.Fprintln(out, "No files are transferred because neither --sync-dir nor --sync is specified") // nolint
+		return nil
+	}
+
+	for _, m := range r.cfg.uploadMappings() {
+		rules, err := r.cfg.uploadRules(m.LocalDir)
+		if err != nil {
+			return err
+		}
+		remoteDir := m.remotePath(r.cfg)
+		diff, local, err := planUpload(client, m.LocalDir, remoteDir, rules)
+		if err != nil {
+			return err
+		}
+		printSyncPlan(out, fmt.Sprintf("Upload %q to %s", m.LocalDir, remoteDir), diff, local.Excluded)
+	}
+
+	for _, m := range r.cfg.downloadMappings() {
+		rules, err := r.cfg.downloadRules(m.LocalDir)
+		if err != nil {
+			return err
+		}
+		rules = excludeBackupDir(rules)
+		remoteDir, localDir := m.remotePath(r.cfg), m.localDownloadDir()
+		title := fmt.Sprintf("Download %s to %q", remoteDir, localDir)
+		if client == nil {
+			msg := "files are determined after the command finished"
+			fmt.Fprintf(out, "%s:\n  %s(rules: %s)\n", title, msg, strings.Join(rules.Patterns(), ", ")) // nolint
+			continue
+		}
+		remote, err := remoteManifest(client, remoteDir, rules)
+		if err == errManifestNotSupported {
+			msg := "all files are downloaded because rarukas-server doesn't support incremental sync"
+			fmt.Fprintf(out, "%s:\n  %s\n", title, msg) // nolint
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		local, err := manifest.Build(localDir, rules)
+		if err != nil {
+			return err
+		}
+		diff := manifest.Compare(remote, local)
+		applyMergeStrategy(r.cfg.mergeStrategy(), diff, remote)
+		printSyncPlan(out, title, diff, remote.Excluded)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SyncMode is direction of synchronization of SyncMapping
+type SyncMode string
+
+const (
+	// SyncUpload uploads local directory before the command
+	SyncUpload SyncMode = "up"
+	// SyncDownload downloads remote directory after the command
+	SyncDownload SyncMode = "down"
+	// SyncBoth uploads before the command and downloads after the command
+	SyncBoth SyncMode = "both"
+)
+
+// syncModeAliases are accepted names of SyncMode
+var syncModeAliases = map[string]SyncMode{
+	"up":       SyncUpload,
+	"upload":   SyncUpload,
+	"down":     SyncDownload,
+	"download": SyncDownload,
+	"both":     SyncBoth,
+}
+
+// SyncMapping maps local directory to directory on rarukas-server
+type SyncMapping struct {
+	LocalDir string
+	// RemoteDir is directory on rarukas-server. Relative path is resolved from working directory of rarukas-server
+	RemoteDir string
+	Mode      SyncMode
+
+	// downloadDir is local directory to download. If empty, use LocalDir
+	downloadDir string
+}
+
+// ParseSyncMapping parses "local:remote[:mode]". mode is up(upload), down(download) or both(default).
+// Local path may contain ':'(e.g. "C:\work:/workdir")
+func ParseSyncMapping(spec string) (*SyncMapping, error) {
+	parts := strings.Split(spec, ":")
+	mode := SyncBoth
+	if len(parts) >= 3 {
+		if m, ok := syncModeAliases[parts[len(parts)-1]]; ok {
+			mode = m
+			parts = parts[:len(parts)-1]
+		}
+	}
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("%q must be local:remote[:mode]", spec)
+	}
+
+	local := strings.Join(parts[:len(parts)-1], ":")
+	remote := parts[len(parts)-1]
+	if local == "" {
+		return nil, fmt.Errorf("local directory of %q is empty", spec)
+	}
+	if remote == "" {
+		return nil, fmt.Errorf("remote directory of %q is empty", spec)
+	}
+	return &SyncMapping{LocalDir: local, RemoteDir: remote, Mode: mode}, nil
+}
+
+func (m *SyncMapping) String() string {
+	return fmt.Sprintf("%s:%s:%s", m.LocalDir, m.RemoteDir, m.Mode)
+}
+
+func (m *SyncMapping) uploads() bool {
+	return m.Mode == SyncUpload || m.Mode == SyncBoth
+}
+
+func (m *SyncMapping) downloads() bool {
+	return m.Mode == SyncDownload || m.Mode == SyncBoth
+}
+
+func (m *SyncMapping) localExists() bool {
+	_, err := os.Stat(m.LocalDir)
+	return err == nil
+}
+
+func (m *SyncMapping) localDownloadDir() string {
+	if m.downloadDir != "" {
+		return m.downloadDir
+	}
+	return m.LocalDir
+}
+
+// remotePath returns RemoteDir resolved from working directory of rarukas-server
+func (m *SyncMapping) remotePath(c *Config) string {
+	if m.RemoteDir == "" {
+		return c.remoteWorkDir()
+	}
+	if path.IsAbs(m.RemoteDir) {
+		return m.RemoteDir
+	}
+	return path.Join(c.remoteWorkDir(), m.RemoteDir)
+}
+
+// syncMappings returns SyncDir mapped to working directory of rarukas-server, and Syncs
+func (c *Config) syncMappings() []*SyncMapping {
+	var mappings []*SyncMapping
+	if c.hasSyncDir() && !(c.UploadOnly && c.DownloadOnly) {
+		mode := SyncBoth
+		switch {
+		case c.UploadOnly:
+			mode = SyncUpload
+		case c.DownloadOnly:
+			mode = SyncDownload
+		}
+		mappings = append(mappings, &SyncMapping{LocalDir: c.SyncDir, Mode: mode, downloadDir: c.downloadDir})
+	}
+	return append(mappings, c.Syncs...)
+}
+
+// uploadMappings returns mappings to be uploaded
+func (c *Config) uploadMappings() []*SyncMapping {
+	var mappings []*SyncMapping
+	for _, m := range c.syncMappings() {
+		if m.uploads() {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings
+}
+
+// downloadMappings returns mappings to be downloaded. It returns nothing if DownloadPolicy is DownloadNever
+func (c *Config) downloadMappings() []*SyncMapping {
+	if c.downloadPolicy() == DownloadNever {
+		return nil
+	}
+	var mappings []*SyncMapping
+	for _, m := range c.syncMappings() {
+		if m.downloads() {
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings
+}
+
+// setupInstanceSyncs makes the parallel instance download into [local directory]-results/[ArukasName].
+// Results are written outside of the local directory, so that they are not uploaded by following runs
+func (c *Config) setupInstanceSyncs() {
+	if c.hasSyncDir() {
+		c.downloadDir = instanceResultDir(c.SyncDir, c.ArukasName)
+	}
+	var syncs []*SyncMapping
+	for _, m := range c.Syncs {
+		instSync := *m
+		instSync.downloadDir = instanceResultDir(m.LocalDir, c.ArukasName)
+		syncs = append(syncs, &instSync)
+	}
+	c.Syncs = syncs
+}
+
+// instanceResultDir returns the directory to download results of the instance named name,
+// next to localDir(e.g. "work-results/rarukas-1" for "work")
+func instanceResultDir(localDir, name string) string {
+	dir := filepath.Clean(localDir)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	return filepath.Join(dir+"-results", name)
+}
@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSyncMapping(t *testing.T) {
+	expects := []struct {
+		spec    string
+		mapping *SyncMapping
+		err     bool
+	}{
+		{
+			spec:    "./src:/workdir/src:up",
+			mapping: &SyncMapping{LocalDir: "./src", RemoteDir: "/workdir/src", Mode: SyncUpload},
+		},
+		{
+			spec:    "./out:out:download",
+			mapping: &SyncMapping{LocalDir: "./out", RemoteDir: "out", Mode: SyncDownload},
+		},
+		{
+			spec:    "work:/workdir",
+			mapping: &SyncMapping{LocalDir: "work", RemoteDir: "/workdir", Mode: SyncBoth},
+		},
+		{
+			spec:    `C:\work:/workdir:both`,
+			mapping: &SyncMapping{LocalDir: `C:\work`, RemoteDir: "/workdir", Mode: SyncBoth},
+		},
+		{spec: "work", err: true},
+		{spec: ":/workdir", err: true},
+		{spec: "work::up", err: true},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.spec, func(t *testing.T) {
+			mapping, err := ParseSyncMapping(expect.spec)
+			if expect.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, expect.mapping, mapping)
+		})
+	}
+}
+
+func TestSyncMappings(t *testing.T) {
+	out := &SyncMapping{LocalDir: "out", RemoteDir: "out", Mode: SyncDownload}
+	plugins := &SyncMapping{LocalDir: "plugins", RemoteDir: "/root/plugins", Mode: SyncUpload}
+	cfg := &Config{SyncDir: "work", UploadOnly: true, Syncs: []*SyncMapping{out, plugins}}
+
+	assert.Equal(t, []*SyncMapping{{LocalDir: "work", Mode: SyncUpload}, plugins}, cfg.uploadMappings())
+	assert.Equal(t, []*SyncMapping{out}, cfg.downloadMappings())
+
+	assert.Equal(t, RarukasServerWorkDir+"/", cfg.syncMappings()[0].remotePath(cfg))
+	assert.Equal(t, RarukasServerWorkDir+"/out", out.remotePath(cfg))
+	assert.Equal(t, "/root/plugins", plugins.remotePath(cfg))
+
+	cfg.DownloadPolicy = DownloadNever
+	assert.Empty(t, cfg.downloadMappings())
+
+	t.Run("Parallel instance", func(t *testing.T) {
+		instCfg := *cfg
+		instCfg.ArukasName = "rarukas-1"
+		instCfg.setupInstanceSyncs()
+
+		workDir, err := filepath.Abs("work")
+		if err != nil {
+			t.Fatal(err)
+		}
+		outDir, err := filepath.Abs("out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// results are downloaded outside of the uploaded directories
+		assert.Equal(t, filepath.Join(workDir+"-results", "rarukas-1"), instCfg.syncMappings()[0].localDownloadDir())
+		assert.Equal(t, filepath.Join(outDir+"-results", "rarukas-1"), instCfg.Syncs[0].localDownloadDir())
+		// original mappings are not changed
+		assert.Equal(t, "out", out.localDownloadDir())
+	})
+}
@@ -0,0 +1,220 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	localDir := filepath.Join(tmpDir, "local")
+	remoteDir := filepath.Join(tmpDir, "remote")
+	writeFiles(t, localDir, map[string]string{
+		"keep.txt":        "keep",
+		"change.txt":      "before",
+		"delete.txt":      "delete",
+		"dir/nested.txt":  "nested",
+		"olddir/file.txt": "old",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, addr := startTestServer(ctx, t, tmpDir)
+
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	t.Run("Initial upload", func(t *testing.T) {
+		// relative path is resolved from workdir of rarukas-server
+		diff, err := r.syncUpload(client, localDir, "remote", nil)
+		assert.NoError(t, err)
+		assert.Len(t, diff.Files, 5)
+		assert.Len(t, diff.Unchanged, 0)
+		assertFileContent(t, filepath.Join(remoteDir, "dir/nested.txt"), "nested")
+	})
+
+	t.Run("Upload changes only", func(t *testing.T) {
+		writeFiles(t, localDir, map[string]string{
+			"change.txt": "after",
+			"new.txt":    "new",
+		})
+		assert.NoError(t, os.Remove(filepath.Join(localDir, "delete.txt")))
+		assert.NoError(t, os.RemoveAll(filepath.Join(localDir, "olddir")))
+
+		diff, err := r.syncUpload(client, localDir, remoteDir, nil)
+		assert.NoError(t, err)
+		assert.Len(t, diff.Files, 2)
+		assert.Len(t, diff.Deleted, 2) // delete.txt and olddir(olddir/file.txt is omitted)
+		assert.Len(t, diff.Unchanged, 2)
+		assert.Equal(t, int64(len("keep")+len("nested")), diff.SkippedSize())
+
+		assertFileContent(t, filepath.Join(remoteDir, "change.txt"), "after")
+		assertFileContent(t, filepath.Join(remoteDir, "new.txt"), "new")
+		assert.False(t, fileExists(filepath.Join(remoteDir, "delete.txt")))
+		assert.False(t, fileExists(filepath.Join(remoteDir, "olddir")))
+	})
+
+	t.Run("Download changes only", func(t *testing.T) {
+		writeFiles(t, remoteDir, map[string]string{
+			"dir/result.txt": "result",
+		})
+		assert.NoError(t, os.Remove(filepath.Join(remoteDir, "new.txt")))
+
+		diff, err := r.syncDownload(client, remoteDir, localDir, nil)
+		assert.NoError(t, err)
+		assert.Len(t, diff.Files, 1)
+		assert.Len(t, diff.Deleted, 1)
+		assert.Len(t, diff.Unchanged, 3)
+
+		assertFileContent(t, filepath.Join(localDir, "dir/result.txt"), "result")
+		assert.False(t, fileExists(filepath.Join(localDir, "new.txt")))
+	})
+}
+
+func TestSyncWithoutManifestSubsystem(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &realRunner{cfg: &Config{}}
+	r.setupKeyPair()
+
+	sshServer := &ssh.Server{Handler: func(s ssh.Session) {}}
+	sshServer.SetOption(ssh.HostKeyPEM([]byte(r.cfg.hostKey))) // nolint
+	go sshServer.Serve(listener)                               // nolint
+	defer sshServer.Close()                                    // nolint
+	client, err := r.openSSHConn("root", listener.Addr().String(), []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	_, err = remoteManifest(client, "work", nil)
+	assert.Equal(t, errManifestNotSupported, err)
+
+	// all files are uploaded
+	diff, _, err := planUpload(client, "test/dir1", "work", nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, diff.Files)
+	assert.Empty(t, diff.Deleted)
+}
+
+func TestSyncWithRules(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	localDir := filepath.Join(tmpDir, "local")
+	remoteDir := filepath.Join(tmpDir, "remote")
+	writeFiles(t, localDir, map[string]string{
+		IgnoreFileName:         ".git/\n*.log\n",
+		DownloadIgnoreFileName: "cache/\n",
+		".git/HEAD":            "ref",
+		"main.go":              "main",
+		"debug.log":            "log",
+		"keep.log":             "keep",
+	})
+	writeFiles(t, remoteDir, map[string]string{
+		"cache/data":  "cache",
+		"result.txt":  "result",
+		"remote.log":  "log",
+		"remote-only": "remote",
+	})
+
+	cfg := &Config{SyncDir: localDir, Includes: []string{"keep.log"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, addr := startTestServer(ctx, t, tmpDir)
+
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	t.Run("Upload", func(t *testing.T) {
+		rules, err := cfg.uploadRules(localDir)
+		assert.NoError(t, err)
+
+		_, err = r.syncUpload(client, localDir, remoteDir, rules)
+		assert.NoError(t, err)
+
+		assertFileContent(t, filepath.Join(remoteDir, "main.go"), "main")
+		assertFileContent(t, filepath.Join(remoteDir, "keep.log"), "keep")
+		assert.False(t, fileExists(filepath.Join(remoteDir, ".git")))
+		assert.False(t, fileExists(filepath.Join(remoteDir, "debug.log")))
+		assert.False(t, fileExists(filepath.Join(remoteDir, "remote-only")))
+		// excluded files are not deleted
+		assert.True(t, fileExists(filepath.Join(remoteDir, "remote.log")))
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		writeFiles(t, remoteDir, map[string]string{"result.txt": "result"})
+
+		rules, err := cfg.downloadRules(localDir)
+		assert.NoError(t, err)
+
+		_, err = r.syncDownload(client, remoteDir, localDir, rules)
+		assert.NoError(t, err)
+
+		assertFileContent(t, filepath.Join(localDir, "result.txt"), "result")
+		assert.False(t, fileExists(filepath.Join(localDir, "cache")))
+		// local-only files excluded from upload are not deleted
+		assertFileContent(t, filepath.Join(localDir, ".git/HEAD"), "ref")
+		assertFileContent(t, filepath.Join(localDir, "debug.log"), "log")
+	})
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertFileContent(t *testing.T, p string, expect string) {
+	content, err := ioutil.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, expect, string(content))
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,156 @@
+// +build !windows
+
+package runner
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/kr/pty"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultTerm = "xterm"
+	defaultRows = 24
+	defaultCols = 80
+)
+
+// terminal is local terminal attached to remote PTY
+type terminal struct {
+	in  *os.File
+	out *os.File
+
+	mu       sync.Mutex
+	oldState *syscall.Termios
+	stopCh   chan struct{}
+	restored bool
+}
+
+func newTerminal(in, out *os.File) *terminal {
+	return &terminal{in: in, out: out}
+}
+
+// IsTerminal returns true if f is terminal
+func IsTerminal(f *os.File) bool {
+	_, err := getTermios(f.Fd())
+	return err == nil
+}
+
+// Attach requests PTY with TERM and size of local terminal, puts local terminal in raw mode,
+// and forwards SIGWINCH as window-change request
+func (t *terminal) Attach(session *ssh.Session) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.restored {
+		return nil
+	}
+
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = defaultTerm
+	}
+	rows, cols := t.size()
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(term, rows, cols, modes); err != nil {
+		return err
+	}
+
+	oldState, err := makeRaw(t.in.Fd())
+	if err != nil {
+		return err
+	}
+	t.oldState = oldState
+
+	t.stopCh = make(chan struct{})
+	go t.forwardWindowChange(session, t.stopCh)
+	return nil
+}
+
+// Restore restores local terminal. It is safe to call multiple times
+func (t *terminal) Restore() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.restored {
+		return
+	}
+	t.restored = true
+
+	if t.stopCh != nil {
+		close(t.stopCh)
+	}
+	if t.oldState != nil {
+		setTermios(t.in.Fd(), t.oldState) // nolint -> return value not checked
+	}
+}
+
+func (t *terminal) forwardWindowChange(session *ssh.Session, stopCh chan struct{}) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGWINCH)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case <-sigChan:
+			rows, cols := t.size()
+			session.WindowChange(rows, cols) // nolint -> return value not checked
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (t *terminal) size() (int, int) {
+	rows, cols, err := pty.Getsize(t.out)
+	if err != nil || rows == 0 || cols == 0 {
+		return defaultRows, defaultCols
+	}
+	return rows, cols
+}
+
+// makeRaw puts the terminal in raw mode like cfmakeraw(3), and returns previous state
+func makeRaw(fd uintptr) (*syscall.Termios, error) {
+	oldState, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *oldState
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return oldState, nil
+}
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	termios := &syscall.Termios{}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlReadTermios, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return nil, errno
+	}
+	return termios, nil
+}
+
+func setTermios(fd uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, ioctlWriteTermios, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// +build !windows
+
+package runner
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/kr/pty"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeRaw(t *testing.T) {
+	master, slave, err := pty.Open()
+	if err != nil {
+		t.Skipf("opening pty failed: %s", err)
+	}
+	defer master.Close() // nolint
+	defer slave.Close()  // nolint
+
+	assert.True(t, IsTerminal(slave))
+
+	term := newTerminal(slave, slave)
+	oldState, err := makeRaw(slave.Fd())
+	if !assert.NoError(t, err) {
+		return
+	}
+	term.oldState = oldState
+
+	raw, err := getTermios(slave.Fd())
+	assert.NoError(t, err)
+	assert.Zero(t, raw.Lflag&(syscall.ECHO|syscall.ICANON|syscall.ISIG))
+	assert.Zero(t, raw.Oflag&syscall.OPOST)
+
+	term.Restore()
+	term.Restore() // can be called multiple times
+
+	restored, err := getTermios(slave.Fd())
+	assert.NoError(t, err)
+	assert.Equal(t, oldState.Lflag, restored.Lflag)
+	assert.Equal(t, oldState.Oflag, restored.Oflag)
+}
@@ -0,0 +1,25 @@
+package runner
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type terminal struct{}
+
+func newTerminal(in, out *os.File) *terminal {
+	return &terminal{}
+}
+
+// IsTerminal returns true if f is terminal. It always returns false on Windows
+func IsTerminal(f *os.File) bool {
+	return false
+}
+
+func (t *terminal) Attach(session *ssh.Session) error {
+	return errors.New("TTY is not supported on Windows")
+}
+
+func (t *terminal) Restore() {}
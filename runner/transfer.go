@@ -0,0 +1,324 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hnakamur/go-scp"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// fileTransfer transfers files between local and rarukas-server.
+// Remote paths are always slash separated
+type fileTransfer interface {
+	// SendFile copies local file to dest. If dest ends with "/", the file is copied into dest directory
+	SendFile(srcFile, dest string) error
+	// SendDir copies local directory recursively as destDir/[base name of srcDir]
+	SendDir(srcDir, destDir string) error
+	// WriteFile writes data to remote file
+	WriteFile(destFile string, data []byte, perm os.FileMode) error
+	// ReceiveFile copies remote file to local destFile
+	ReceiveFile(srcFile, destFile string) error
+	// ReceiveDir copies remote directory recursively as destDir/[base name of srcDir]
+	ReceiveDir(srcDir, destDir string) error
+	// IsDir returns true if remotePath is directory
+	IsDir(remotePath string) (bool, error)
+	// MkdirAll creates remote directory and its parents
+	MkdirAll(remoteDir string) error
+	// RemoveAll removes remote file or directory recursively
+	RemoveAll(remotePath string) error
+	Close() error
+}
+
+// newFileTransfer returns SFTP based fileTransfer if rarukas-server offers SFTP subsystem, otherwise scp based one
+func newFileTransfer(client *ssh.Client) fileTransfer {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		log.Printf("[INFO] SFTP is not available on rarukas-server, using scp instead: %s", err)
+		return &scpTransfer{client: client, scp: scp.NewSCP(client)}
+	}
+	return &sftpTransfer{client: sftpClient}
+}
+
+// sftpTransfer is fileTransfer using SFTP subsystem
+type sftpTransfer struct {
+	client *sftp.Client
+}
+
+func (t *sftpTransfer) SendFile(srcFile, dest string) error {
+	if strings.HasSuffix(dest, "/") {
+		dest = path.Join(dest, filepath.Base(srcFile))
+	}
+	fi, err := os.Stat(srcFile)
+	if err != nil {
+		return err
+	}
+	return t.sendFile(srcFile, dest, fi)
+}
+
+func (t *sftpTransfer) SendDir(srcDir, destDir string) error {
+	srcDir = filepath.Clean(srcDir)
+	destDir = path.Join(destDir, filepath.Base(srcDir))
+
+	var dirs []string
+	var dirInfos []os.FileInfo
+	err := filepath.Walk(srcDir, func(localPath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, localPath)
+		if err != nil {
+			return err
+		}
+		dest := path.Join(destDir, filepath.ToSlash(rel))
+
+		// follow symbolic links like scp
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(localPath); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				log.Printf("[INFO] Skipping symbolic link to directory %q", localPath)
+				return nil
+			}
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := t.client.MkdirAll(dest); err != nil {
+				return err
+			}
+			dirs = append(dirs, dest)
+			dirInfos = append(dirInfos, fi)
+			return nil
+		case fi.Mode().IsRegular():
+			return t.sendFile(localPath, dest, fi)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// set attributes of directories after their contents are written
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := t.setAttrs(dirs[i], dirInfos[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sftpTransfer) WriteFile(destFile string, data []byte, perm os.FileMode) error {
+	f, err := t.client.Create(destFile)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(bytes.NewReader(data)); err != nil {
+		f.Close() // nolint -> return value not checked
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return t.client.Chmod(destFile, perm)
+}
+
+func (t *sftpTransfer) ReceiveFile(srcFile, destFile string) error {
+	fi, err := t.client.Stat(srcFile)
+	if err != nil {
+		return err
+	}
+	return t.receiveFile(srcFile, destFile, fi)
+}
+
+func (t *sftpTransfer) ReceiveDir(srcDir, destDir string) error {
+	srcDir = path.Clean(srcDir)
+	destDir = filepath.Join(destDir, path.Base(srcDir))
+
+	var dirs []string
+	var dirInfos []os.FileInfo
+	walker := t.client.Walk(srcDir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), srcDir), "/")
+		dest := filepath.Join(destDir, filepath.FromSlash(rel))
+
+		fi := walker.Stat()
+		if fi.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if fi, err = t.client.Stat(walker.Path()); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				log.Printf("[INFO] Skipping symbolic link to directory %q", walker.Path())
+				continue
+			}
+		}
+
+		switch {
+		case fi.IsDir():
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+			dirs = append(dirs, dest)
+			dirInfos = append(dirInfos, fi)
+		case fi.Mode().IsRegular():
+			if err := t.receiveFile(walker.Path(), dest, fi); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], dirInfos[i].Mode().Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i], dirInfos[i].ModTime(), dirInfos[i].ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sftpTransfer) IsDir(remotePath string) (bool, error) {
+	fi, err := t.client.Stat(remotePath)
+	if err != nil {
+		return false, err
+	}
+	return fi.IsDir(), nil
+}
+
+func (t *sftpTransfer) MkdirAll(remoteDir string) error {
+	return t.client.MkdirAll(remoteDir)
+}
+
+func (t *sftpTransfer) RemoveAll(remotePath string) error {
+	return t.client.RemoveAll(remotePath)
+}
+
+func (t *sftpTransfer) Close() error {
+	return t.client.Close()
+}
+
+func (t *sftpTransfer) sendFile(srcFile, destFile string, fi os.FileInfo) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close() // nolint -> return value not checked
+
+	dest, err := t.client.Create(destFile)
+	if err != nil {
+		return fmt.Errorf("creating %q failed: %s", destFile, err)
+	}
+	if _, err := dest.ReadFrom(src); err != nil {
+		dest.Close() // nolint -> return value not checked
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	return t.setAttrs(destFile, fi)
+}
+
+func (t *sftpTransfer) receiveFile(srcFile, destFile string, fi os.FileInfo) error {
+	src, err := t.client.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close() // nolint -> return value not checked
+
+	dest, err := os.OpenFile(destFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := src.WriteTo(dest); err != nil {
+		dest.Close() // nolint -> return value not checked
+		return err
+	}
+	if err := dest.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(destFile, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(destFile, fi.ModTime(), fi.ModTime())
+}
+
+// setAttrs sets mode and modification time of remote file like scp -p
+func (t *sftpTransfer) setAttrs(remotePath string, fi os.FileInfo) error {
+	if err := t.client.Chmod(remotePath, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return t.client.Chtimes(remotePath, fi.ModTime(), fi.ModTime())
+}
+
+// scpTransfer is fileTransfer using scp command on rarukas-server.
+// It is used for rarukas-server that doesn't offer SFTP subsystem
+type scpTransfer struct {
+	client *ssh.Client
+	scp    *scp.SCP
+}
+
+func (t *scpTransfer) SendFile(srcFile, dest string) error {
+	return t.scp.SendFile(srcFile, dest)
+}
+
+func (t *scpTransfer) SendDir(srcDir, destDir string) error {
+	return t.scp.SendDir(srcDir, destDir, nil)
+}
+
+func (t *scpTransfer) WriteFile(destFile string, data []byte, perm os.FileMode) error {
+	now := time.Now()
+	info := scp.NewFileInfo(path.Base(destFile), int64(len(data)), perm, now, now)
+	return t.scp.Send(info, ioutil.NopCloser(bytes.NewReader(data)), destFile)
+}
+
+func (t *scpTransfer) ReceiveFile(srcFile, destFile string) error {
+	return t.scp.ReceiveFile(srcFile, destFile)
+}
+
+func (t *scpTransfer) ReceiveDir(srcDir, destDir string) error {
+	// scp.ReceiveDir copies into destDir itself if destDir doesn't exist
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	return t.scp.ReceiveDir(srcDir, destDir, nil)
+}
+
+func (t *scpTransfer) IsDir(remotePath string) (bool, error) {
+	return remoteIsDir(t.client, remotePath)
+}
+
+func (t *scpTransfer) MkdirAll(remoteDir string) error {
+	return t.run(fmt.Sprintf("mkdir -p %s", shellQuote(remoteDir)))
+}
+
+func (t *scpTransfer) RemoveAll(remotePath string) error {
+	return t.run(fmt.Sprintf("rm -rf %s", shellQuote(remotePath)))
+}
+
+func (t *scpTransfer) run(cmd string) error {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close() // nolint -> return value not checked
+	return session.Run(cmd)
+}
+
+func (t *scpTransfer) Close() error {
+	return nil
+}
@@ -0,0 +1,178 @@
+// +build !windows
+
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/hnakamur/go-scp"
+	"github.com/rarukas/rarukas/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTransfer(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	r, addr := startTestServer(ctx, t, tmpDir)
+
+	client, err := r.openSSHConn("root", addr, []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	transfer := newFileTransfer(client)
+	defer transfer.Close() // nolint
+	assert.IsType(t, &sftpTransfer{}, transfer)
+
+	transfers := map[string]fileTransfer{
+		"sftp": transfer,
+		"scp":  &scpTransfer{client: client, scp: scp.NewSCP(client)},
+	}
+	for name, transfer := range transfers {
+		t.Run(name, func(t *testing.T) {
+			remoteDir := filepath.Join(tmpDir, name, "remote")
+			localDir := filepath.Join(tmpDir, name, "local")
+			if err := os.MkdirAll(remoteDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			// test/dir1 -> [remoteDir]/dir1
+			assert.NoError(t, transfer.SendDir("test/dir1", remoteDir))
+			assert.NoError(t, transfer.SendFile("test/dir1/test1.bash", remoteDir+"/"))
+			assert.NoError(t, transfer.WriteFile(remoteDir+"/script.sh", []byte("echo foo"), 0755))
+
+			for _, file := range []string{"test1.bash", "dir2/test3.bash"} {
+				src, _ := ioutil.ReadFile(filepath.Join("test/dir1", file))
+				dest, err := ioutil.ReadFile(filepath.Join(remoteDir, "dir1", file))
+				assert.NoError(t, err)
+				assert.Equal(t, src, dest)
+			}
+			assert.FileExists(t, filepath.Join(remoteDir, "test1.bash"))
+			fi, err := os.Stat(filepath.Join(remoteDir, "script.sh"))
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+			isDir, err := transfer.IsDir(remoteDir + "/dir1")
+			assert.NoError(t, err)
+			assert.True(t, isDir)
+			isDir, err = transfer.IsDir(remoteDir + "/script.sh")
+			assert.NoError(t, err)
+			assert.False(t, isDir)
+
+			// [remoteDir]/dir1 -> [localDir]/dir1
+			assert.NoError(t, transfer.ReceiveDir(remoteDir+"/dir1", localDir))
+			assert.NoError(t, transfer.ReceiveFile(remoteDir+"/script.sh", filepath.Join(localDir, "script.sh")))
+
+			src, _ := ioutil.ReadFile("test/dir1/dir2/test4.bash")
+			dest, err := ioutil.ReadFile(filepath.Join(localDir, "dir1/dir2/test4.bash"))
+			assert.NoError(t, err)
+			assert.Equal(t, src, dest)
+
+			srcInfo, _ := os.Stat("test/dir1/dir2/test4.bash")
+			destInfo, err := os.Stat(filepath.Join(localDir, "dir1/dir2/test4.bash"))
+			assert.NoError(t, err)
+			assert.Equal(t, srcInfo.ModTime().Unix(), destInfo.ModTime().Unix())
+
+			fi, err = os.Stat(filepath.Join(localDir, "script.sh"))
+			assert.NoError(t, err)
+			assert.Equal(t, os.FileMode(0755), fi.Mode().Perm())
+
+			assert.NoError(t, transfer.MkdirAll(remoteDir+"/foo/bar"))
+			assert.DirExists(t, filepath.Join(remoteDir, "foo/bar"))
+			assert.NoError(t, transfer.RemoveAll(remoteDir+"/dir1"))
+			_, err = os.Stat(filepath.Join(remoteDir, "dir1"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestFileTransferFallback(t *testing.T) {
+
+	log.SetOutput(ioutil.Discard)
+
+	// SSH server without SFTP subsystem, like rarukas-server of older version
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &realRunner{cfg: &Config{}}
+	r.setupKeyPair()
+
+	sshServer := &ssh.Server{Handler: func(s ssh.Session) {}}
+	sshServer.SetOption(ssh.HostKeyPEM([]byte(r.cfg.hostKey))) // nolint
+	go sshServer.Serve(listener)                               // nolint
+	defer sshServer.Close()                                    // nolint
+	client, err := r.openSSHConn("root", listener.Addr().String(), []byte(r.cfg.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close() // nolint
+
+	transfer := newFileTransfer(client)
+	defer transfer.Close() // nolint
+	assert.IsType(t, &scpTransfer{}, transfer)
+}
+
+// startTestServer starts rarukas-server with workDir, and returns realRunner that has the key-pair and address of the server
+func startTestServer(ctx context.Context, t *testing.T, workDir string) (*realRunner, string) {
+	r := &realRunner{cfg: &Config{ExecTimeout: 10 * time.Second}}
+	r.setupKeyPair()
+
+	port, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hcPort, err := freePort()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go server.Start(ctx, &server.Config{ // nolint
+		PublicKey:       r.cfg.PublicKey,
+		SSHServerAddr:   "127.0.0.1",
+		SSHServerPort:   port,
+		HealthCheckAddr: "127.0.0.1",
+		HealthCheckPort: hcPort,
+		Command:         "/bin/sh",
+		WorkDir:         workDir,
+		HostKey:         r.cfg.hostKey,
+	})
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	if err := waitForListen(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+	return r, addr
+}
+
+func waitForListen(ctx context.Context, addr string) error {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			return conn.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// account is local account that runs commands of SSH user
+type account struct {
+	name   string
+	home   string
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	// switchUser is true if commands run with credential of the account instead of rarukas-server's
+	switchUser bool
+}
+
+// lookupAccount maps SSH user to local account of the same name.
+// If rarukas-server isn't running as root, "root" and the user running rarukas-server are mapped to the current user
+func lookupAccount(name string) (*account, error) {
+	if os.Getuid() != 0 {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		if name != "root" && name != current.Username {
+			return nil, fmt.Errorf("rarukas-server running as %q can't switch to user %q", current.Username, name)
+		}
+		return newAccount(current, false)
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return newAccount(u, u.Uid != "0")
+}
+
+func newAccount(u *user.User, switchUser bool) (*account, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	a := &account{name: u.Username, home: u.HomeDir, uid: uint32(uid), gid: uint32(gid), switchUser: switchUser}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range groupIDs {
+		if gid, err := strconv.ParseUint(id, 10, 32); err == nil {
+			a.groups = append(a.groups, uint32(gid))
+		}
+	}
+	return a, nil
+}
+
+// setCredential makes cmd run as the account
+func (a *account) setCredential(cmd *exec.Cmd) {
+	if !a.switchUser {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: a.uid, Gid: a.gid, Groups: a.groups}
+	if cmd.Dir == "" {
+		// like sshd, start in "/" if home directory doesn't exist
+		cmd.Dir = "/"
+		if fi, err := os.Stat(a.home); err == nil && fi.IsDir() {
+			cmd.Dir = a.home
+		}
+	}
+}
+
+// environ returns environment variables of the account
+func (a *account) environ() []string {
+	if !a.switchUser {
+		return nil
+	}
+	return []string{"HOME=" + a.home, "USER=" + a.name, "LOGNAME=" + a.name}
+}
+
+// chown changes owner of dir and files in it to the account
+func (a *account) chown(dir string) error {
+	if !a.switchUser {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chown(path, int(a.uid), int(a.gid))
+	})
+}
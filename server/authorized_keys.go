@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey is a key allowed to connect to rarukas-server with options of authorized_keys
+type authorizedKey struct {
+	key ssh.PublicKey
+	// command is forced command run instead of the command requested by the client
+	command string
+	// from are patterns of client IP addresses(wildcard or CIDR). Addresses matching patterns starting with "!" are refused
+	from []string
+	// environment are "NAME=value" added to environment of the command
+	environment      []string
+	noPty            bool
+	noPortForwarding bool
+}
+
+// parseAuthorizedKeys parses keys in authorized_keys format. Empty lines and lines starting with "#" are ignored
+func parseAuthorizedKeys(data []byte) ([]*authorizedKey, error) {
+	var keys []*authorizedKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		k := &authorizedKey{key: key}
+		if err := k.setOptions(options); err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, scanner.Err()
+}
+
+// setOptions applies options of authorized_keys. Unknown options are refused so that restrictions are never ignored silently
+func (k *authorizedKey) setOptions(options []string) error {
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name, value = option[:i], unquoteOption(option[i+1:])
+		}
+		switch strings.ToLower(name) {
+		case "command":
+			k.command = value
+		case "from":
+			k.from = strings.Split(value, ",")
+		case "environment":
+			if !strings.Contains(value, "=") || !envNameRegexp.MatchString(value[:strings.Index(value, "=")]) {
+				return fmt.Errorf("environment option %q is invalid", value)
+			}
+			k.environment = append(k.environment, value)
+		case "no-pty":
+			k.noPty = true
+		case "no-port-forwarding":
+			k.noPortForwarding = true
+		case "restrict":
+			k.noPty = true
+			k.noPortForwarding = true
+		case "no-agent-forwarding", "no-x11-forwarding", "no-user-rc":
+			// rarukas-server doesn't offer them
+		default:
+			return fmt.Errorf("option %q is not supported", name)
+		}
+	}
+	return nil
+}
+
+func unquoteOption(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	return strings.Replace(value, `\"`, `"`, -1)
+}
+
+// allowsFrom returns true if the client address matches from option. The last matching pattern doesn't win:
+// any matching pattern starting with "!" refuses the address like sshd
+func (k *authorizedKey) allowsFrom(addr net.Addr) bool {
+	if len(k.from) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	allowed := false
+	for _, pattern := range k.from {
+		refuse := strings.HasPrefix(pattern, "!")
+		if matchAddr(strings.TrimPrefix(pattern, "!"), tcpAddr.IP) {
+			if refuse {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func matchAddr(pattern string, ip net.IP) bool {
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		return err == nil && ipNet.Contains(ip)
+	}
+	ok, _ := path.Match(pattern, ip.String())
+	return ok
+}
+
+// keyStore holds authorized keys given by configuration and authorized_keys files.
+// Keys of files are cached until reload is called
+type keyStore struct {
+	keys []*authorizedKey
+	// file is path to authorized_keys file. "%u" and "%h" are replaced with SSH user name and home directory of the account
+	file string
+
+	mu    sync.RWMutex
+	files map[string][]*authorizedKey
+}
+
+func newKeyStore(authorizedKeys, file string) (*keyStore, error) {
+	keys, err := parseAuthorizedKeys([]byte(authorizedKeys))
+	if err != nil {
+		return nil, fmt.Errorf("authorized keys are invalid: %s", err)
+	}
+	s := &keyStore{keys: keys, file: file, files: map[string][]*authorizedKey{}}
+
+	// file without tokens is read on start to report errors early
+	if file != "" && !strings.Contains(file, "%") {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if s.files[file], err = parseAuthorizedKeys(data); err != nil {
+			return nil, fmt.Errorf("authorized keys file %q is invalid: %s", file, err)
+		}
+	}
+	return s, nil
+}
+
+// empty returns true if no keys can be authorized
+func (s *keyStore) empty() bool {
+	return len(s.keys) == 0 && s.file == ""
+}
+
+// find returns authorized key of the user that equals key, or nil
+func (s *keyStore) find(user, home string, key ssh.PublicKey) *authorizedKey {
+	keys := s.keys
+	if s.file != "" {
+		keys = append(keys[:len(keys):len(keys)], s.fileKeys(strings.NewReplacer("%u", user, "%h", home).Replace(s.file))...)
+	}
+	for _, k := range keys {
+		if bytes.Equal(k.key.Marshal(), key.Marshal()) {
+			return k
+		}
+	}
+	return nil
+}
+
+func (s *keyStore) fileKeys(path string) []*authorizedKey {
+	s.mu.RLock()
+	keys, ok := s.files[path]
+	s.mu.RUnlock()
+	if ok {
+		return keys
+	}
+
+	keys = readAuthorizedKeysFile(path)
+	s.mu.Lock()
+	s.files[path] = keys
+	s.mu.Unlock()
+	return keys
+}
+
+// reload reads authorized_keys files again. Keys of files which can't be read are revoked
+func (s *keyStore) reload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for path := range s.files {
+		s.files[path] = readAuthorizedKeysFile(path)
+	}
+	log.Printf("[INFO] Reloaded authorized keys files\n")
+}
+
+func readAuthorizedKeysFile(path string) []*authorizedKey {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[WARN] Reading authorized keys file %q failed: %s\n", path, err)
+		}
+		return nil
+	}
+	keys, err := parseAuthorizedKeys(data)
+	if err != nil {
+		log.Printf("[WARN] Authorized keys file %q is invalid: %s\n", path, err)
+		return nil
+	}
+	return keys
+}
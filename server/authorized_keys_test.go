@@ -0,0 +1,118 @@
+// +build !windows
+
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	t.Run("Options", func(t *testing.T) {
+		data := "# comment\n\n" +
+			`command="echo \"hello\"",from="10.0.0.0/8,!10.0.0.1",environment="APP_ENV=test",no-pty ` + string(allowPublicKey) + "\n" +
+			"restrict,no-agent-forwarding " + string(denyPublicKey) + "\n"
+		keys, err := parseAuthorizedKeys([]byte(data))
+		assert.NoError(t, err)
+		if !assert.Len(t, keys, 2) {
+			return
+		}
+
+		assert.Equal(t, `echo "hello"`, keys[0].command)
+		assert.Equal(t, []string{"10.0.0.0/8", "!10.0.0.1"}, keys[0].from)
+		assert.Equal(t, []string{"APP_ENV=test"}, keys[0].environment)
+		assert.True(t, keys[0].noPty)
+		assert.False(t, keys[0].noPortForwarding)
+
+		assert.True(t, keys[1].noPty)
+		assert.True(t, keys[1].noPortForwarding)
+	})
+
+	expects := []struct {
+		name string
+		data string
+	}{
+		{name: "Invalid key", data: "ssh-rsa invalid"},
+		{name: "Unknown option", data: "permitopen=\"localhost:80\" " + string(allowPublicKey)},
+		{name: "Invalid environment", data: "environment=\"1FOO=bar\" " + string(allowPublicKey)},
+	}
+	for _, expect := range expects {
+		t.Run(expect.name, func(t *testing.T) {
+			_, err := parseAuthorizedKeys([]byte("\n" + expect.data))
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "line 2")
+		})
+	}
+}
+
+func TestAuthorizedKeyAllowsFrom(t *testing.T) {
+	key := &authorizedKey{from: []string{"192.168.0.0/16", "10.0.0.*", "!192.168.1.1"}}
+
+	expects := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, allowed: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.5")}, allowed: true},
+		{addr: &net.TCPAddr{IP: net.ParseIP("192.168.1.1")}, allowed: false},
+		{addr: &net.TCPAddr{IP: net.ParseIP("172.16.0.1")}, allowed: false},
+		{addr: nil, allowed: false},
+	}
+	for _, expect := range expects {
+		assert.Equal(t, expect.allowed, key.allowsFrom(expect.addr), "addr: %v", expect.addr)
+	}
+
+	assert.True(t, (&authorizedKey{}).allowsFrom(nil))
+}
+
+func TestKeyStore(t *testing.T) {
+	allowedKey, deniedKey := parseTestKeys(t)
+
+	t.Run("No keys", func(t *testing.T) {
+		keys, err := newKeyStore("\n", "")
+		assert.NoError(t, err)
+		assert.True(t, keys.empty())
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := newKeyStore("", "/not/exists/authorized_keys")
+		assert.Error(t, err)
+	})
+
+	t.Run("Reload file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rarukas-authorized-keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir) // nolint
+
+		file := filepath.Join(dir, "root", "authorized_keys")
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, allowPublicKey, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := newKeyStore("", filepath.Join(dir, "%u", "authorized_keys"))
+		assert.NoError(t, err)
+		assert.NotNil(t, keys.find("root", "/root", allowedKey))
+		assert.Nil(t, keys.find("root", "/root", deniedKey))
+		assert.Nil(t, keys.find("foobar", "/home/foobar", allowedKey))
+
+		// cached until reload
+		if err := ioutil.WriteFile(file, denyPublicKey, 0600); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotNil(t, keys.find("root", "/root", allowedKey))
+
+		keys.reload()
+		assert.Nil(t, keys.find("root", "/root", allowedKey))
+		assert.NotNil(t, keys.find("root", "/root", deniedKey))
+	})
+}
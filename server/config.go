@@ -0,0 +1,34 @@
+package server
+
+// Config is configuration of rarukas-server
+type Config struct {
+	// PublicKey is public key allowed to connect to rarukas-server
+	PublicKey string
+	// AuthorizedKeys are additional keys in authorized_keys format. Options such as command=, from= and environment= are supported
+	AuthorizedKeys string
+	// AuthorizedKeysFile is path to authorized_keys file reloaded on SIGHUP.
+	// "%u" and "%h" are replaced with SSH user name and home directory of the user(e.g. "%h/.ssh/authorized_keys")
+	AuthorizedKeysFile string
+	// AllowUsers are SSH user names allowed to connect. Commands run as local account of the same name.
+	// If empty, only "root" is allowed
+	AllowUsers []string
+	// TrustedUserCAKeys are public keys of SSH user CA in authorized_keys format. Certificates signed by them are accepted
+	TrustedUserCAKeys string
+	// RunID is ID of the run of rarukas. If set, only certificates issued for the run are accepted
+	RunID           string
+	Command         string
+	HealthCheckAddr string
+	HealthCheckPort int
+	SSHServerAddr   string
+	SSHServerPort   int
+	// WorkDir is working directory of the commands. If empty, use current directory
+	WorkDir string
+	// AllowForwarding enables local port forwarding(direct-tcpip) for the allowed key
+	AllowForwarding bool
+	// AcceptEnv are glob patterns of environment variable names accepted from SSH clients.
+	// They are added to LANG, LC_*, TERM and RARUKAS_*, and names matching patterns starting with "!" are refused.
+	// LD_*, BASH_ENV, ENV, PATH and IFS are always refused, and no names are accepted for forced commands
+	AcceptEnv []string
+	// HostKey is PEM encoded private host key. If empty, a random key is generated on each start
+	HostKey string
+}
@@ -5,8 +5,39 @@ const (
 	RarukasDefaultHTTPPort = 8080
 	// RarukasDefaultSSHPort is number of default ssh server port
 	RarukasDefaultSSHPort = 2222
+	// RarukasEnvPrefix is the prefix of environment variables used to configure rarukas-server.
+	// They aren't passed to commands because they have secrets such as the host key
+	RarukasEnvPrefix = "RARUKAS_"
 	// RarukasPublicKeyEnv is the key name of the environment variable used to pass ssh-public-keys
 	RarukasPublicKeyEnv = "RARUKAS_PUBLIC_KEY"
+	// RarukasAuthorizedKeysEnv is the key name of the environment variable used to pass additional keys in authorized_keys format
+	RarukasAuthorizedKeysEnv = "RARUKAS_AUTHORIZED_KEYS"
+	// RarukasAuthorizedKeysFileEnv is the key name of the environment variable used to pass path to authorized_keys file
+	RarukasAuthorizedKeysFileEnv = "RARUKAS_AUTHORIZED_KEYS_FILE"
+	// RarukasAllowUsersEnv is the key name of the environment variable used to pass comma separated SSH user names allowed to connect
+	RarukasAllowUsersEnv = "RARUKAS_ALLOW_USERS"
+	// RarukasTrustedUserCAKeysEnv is the key name of the environment variable used to pass public keys of SSH user CA
+	RarukasTrustedUserCAKeysEnv = "RARUKAS_TRUSTED_USER_CA_KEYS"
+	// RarukasRunIDEnv is the key name of the environment variable used to pass ID of the run. Certificates must be issued for it
+	RarukasRunIDEnv = "RARUKAS_RUN_ID"
+	// RarukasRunIDCriticalOption is the critical option of certificates that has ID of the run they are issued for
+	RarukasRunIDCriticalOption = "run-id@rarukas"
 	// RarukasCommandEnv is the key name of the environment variable used to pass container command
 	RarukasCommandEnv = "RARUKAS_COMMAND"
+	// RarukasAllowForwardingEnv is the key name of the environment variable used to enable port forwarding
+	RarukasAllowForwardingEnv = "RARUKAS_ALLOW_FORWARDING"
+	// RarukasHostKeyEnv is the key name of the environment variable used to pass PEM encoded private host key
+	RarukasHostKeyEnv = "RARUKAS_HOST_KEY"
+	// RarukasAcceptEnvEnv is the key name of the environment variable used to pass comma separated patterns of
+	// environment variable names accepted from SSH clients
+	RarukasAcceptEnvEnv = "RARUKAS_ACCEPT_ENV"
+	// RarukasSecretFileEnvPrefix is the prefix of "env" requests whose values are written into secret files on tmpfs.
+	// The command gets environment variable without the prefix that has the path to the file
+	RarukasSecretFileEnvPrefix = "RARUKAS_SECRET_FILE_"
+	// RarukasManifestSubsystem is the name of SSH subsystem that reports manifest of directory on rarukas-server
+	RarukasManifestSubsystem = "rarukas-manifest"
+	// RarukasGlobSubsystem is the name of SSH subsystem that reports manifest of files matching globs on rarukas-server
+	RarukasGlobSubsystem = "rarukas-glob"
+	// RarukasTarSubsystem is the name of SSH subsystem that extracts or sends compressed tar stream on rarukas-server
+	RarukasTarSubsystem = "rarukas-tar"
 )
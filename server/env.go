@@ -0,0 +1,78 @@
+package server
+
+import (
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var envNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// defaultAcceptEnv are patterns of environment variable names always accepted from SSH clients unless refused
+// by patterns. RARUKAS_* are variables set by rarukas such as secret files and remote forwards
+var defaultAcceptEnv = []string{"LANG", "LC_*", "TERM", RarukasEnvPrefix + "*"}
+
+// refusedEnv are patterns of environment variable names always refused, because they change
+// how the shell and programs run regardless of the command
+var refusedEnv = []string{"LD_*", "BASH_ENV", "ENV", "PATH", "IFS"}
+
+// RefusesEnv returns true if rarukas-server never accepts environment variable from SSH clients
+func RefusesEnv(name string) bool {
+	for _, pattern := range refusedEnv {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEnv returns true if environment variable requested by SSH client is passed to the command.
+// patterns are globs of names added to defaultAcceptEnv, and names matching patterns starting with "!" are refused.
+// The last matching pattern wins. Names matching refusedEnv are refused by any patterns
+func acceptsEnv(patterns []string, name string) bool {
+	if !envNameRegexp.MatchString(name) || RefusesEnv(name) {
+		return false
+	}
+	accepted := false
+	for _, pattern := range append(defaultAcceptEnv, patterns...) {
+		refuse := strings.HasPrefix(pattern, "!")
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), name); ok {
+			accepted = !refuse
+		}
+	}
+	return accepted
+}
+
+// acceptedEnv returns environment variables of the session accepted by patterns.
+// Secret files must not be written into refused names
+func acceptedEnv(sessionEnv []string, patterns []string) []string {
+	env := []string{}
+	for _, kv := range sessionEnv {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !acceptsEnv(patterns, name) || RefusesEnv(strings.TrimPrefix(name, RarukasSecretFileEnvPrefix)) {
+			log.Printf("Environment variable %q is not accepted\n", name)
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// serverEnv returns environment of rarukas-server without variables with RarukasEnvPrefix
+func serverEnv() []string {
+	env := []string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, RarukasEnvPrefix) {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// commandEnv returns environment variables of the command: environment of rarukas-server
+// without its settings, and then accepted environment variables of the session
+func commandEnv(sessionEnv []string) []string {
+	return append(serverEnv(), sessionEnv...)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsEnv(t *testing.T) {
+	expects := []struct {
+		patterns []string
+		name     string
+		accepted bool
+	}{
+		{patterns: nil, name: "LANG", accepted: true},
+		{patterns: nil, name: "LC_ALL", accepted: true},
+		{patterns: nil, name: "TERM", accepted: true},
+		{patterns: nil, name: "RARUKAS_REMOTE_FORWARDS", accepted: true},
+		{patterns: nil, name: "FOO", accepted: false},
+		{patterns: nil, name: "1FOO", accepted: false},
+		{patterns: nil, name: "LD_PRELOAD", accepted: false},
+		{patterns: nil, name: "BASH_ENV", accepted: false},
+		{patterns: nil, name: "PATH", accepted: false},
+		{patterns: []string{"APP_*"}, name: "APP_TOKEN", accepted: true},
+		{patterns: []string{"APP_*"}, name: "FOO", accepted: false},
+		{patterns: []string{"APP_*"}, name: "LANG", accepted: true},
+		{patterns: []string{"!LANG"}, name: "LANG", accepted: false},
+		{patterns: []string{"*", "!FOO"}, name: "FOO", accepted: false},
+		{patterns: []string{"!FOO", "*"}, name: "FOO", accepted: true},
+		// always refused
+		{patterns: []string{"*"}, name: "LD_PRELOAD", accepted: false},
+		{patterns: []string{"*"}, name: "BASH_ENV", accepted: false},
+		{patterns: []string{"*"}, name: "ENV", accepted: false},
+		{patterns: []string{"*"}, name: "PATH", accepted: false},
+		{patterns: []string{"PATH"}, name: "PATH", accepted: false},
+		{patterns: []string{"*"}, name: "IFS", accepted: false},
+	}
+	for _, expect := range expects {
+		assert.Equal(t, expect.accepted, acceptsEnv(expect.patterns, expect.name), "patterns: %v, name: %s", expect.patterns, expect.name)
+	}
+}
+
+func TestAcceptedEnv(t *testing.T) {
+	sessionEnv := []string{
+		"LANG=C.UTF-8",
+		"FOO=bar=baz",
+		"LD_PRELOAD=evil.so",
+		"BASH_ENV=/tmp/evil.sh",
+		RarukasSecretFileEnvPrefix + "KUBECONFIG=xxx",
+		RarukasSecretFileEnvPrefix + "PATH=xxx",
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		env := acceptedEnv(sessionEnv, nil)
+		assert.Equal(t, []string{"LANG=C.UTF-8", RarukasSecretFileEnvPrefix + "KUBECONFIG=xxx"}, env)
+	})
+	t.Run("Patterns", func(t *testing.T) {
+		env := acceptedEnv(sessionEnv, []string{"FOO", "!LANG"})
+		assert.Equal(t, []string{"FOO=bar=baz", RarukasSecretFileEnvPrefix + "KUBECONFIG=xxx"}, env)
+	})
+	t.Run("All", func(t *testing.T) {
+		env := acceptedEnv(sessionEnv, []string{"*"})
+		assert.Equal(t, []string{"LANG=C.UTF-8", "FOO=bar=baz", RarukasSecretFileEnvPrefix + "KUBECONFIG=xxx"}, env)
+	})
+}
+
+func TestCommandEnv(t *testing.T) {
+	os.Setenv(RarukasHostKeyEnv, "secret-host-key") // nolint
+	defer os.Unsetenv(RarukasHostKeyEnv)            // nolint
+
+	env := commandEnv([]string{"FOO=bar=baz"})
+
+	// environment of rarukas-server such as PATH is kept
+	assert.Contains(t, env, "PATH="+os.Getenv("PATH"))
+	assert.Contains(t, env, "FOO=bar=baz")
+	// settings of rarukas-server are removed
+	assert.NotContains(t, env, RarukasHostKeyEnv+"=secret-host-key")
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// secretDirBase is the directory on tmpfs where secret files are written. os.TempDir() is used if it doesn't exist
+var secretDirBase = "/dev/shm"
+
+// writeSecretFiles writes values of session environment variables with RarukasSecretFileEnvPrefix into files
+// in a new directory, and replaces them with variables that have the path to the files.
+// If dir isn't empty, it must be removed by wipeSecretFiles after the session
+func writeSecretFiles(sessionEnv []string) (env []string, dir string, err error) {
+	for _, kv := range sessionEnv {
+		if !strings.HasPrefix(kv, RarukasSecretFileEnvPrefix) {
+			env = append(env, kv)
+			continue
+		}
+		kv = strings.TrimPrefix(kv, RarukasSecretFileEnvPrefix)
+		name, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		if !envNameRegexp.MatchString(name) {
+			log.Printf("Secret file %q is invalid name\n", name)
+			continue
+		}
+
+		if dir == "" {
+			base := secretDirBase
+			if _, err := os.Stat(base); err != nil {
+				base = os.TempDir()
+			}
+			if dir, err = ioutil.TempDir(base, "rarukas-secret_"); err != nil {
+				return nil, "", err
+			}
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(value), 0600); err != nil {
+			wipeSecretFiles(dir)
+			return nil, "", err
+		}
+		env = append(env, name+"="+path)
+	}
+	return env, dir, nil
+}
+
+// wipeSecretFiles overwrites secret files in dir with zeros and removes dir
+func wipeSecretFiles(dir string) {
+	files, _ := ioutil.ReadDir(dir) // nolint -> removed anyway
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if err := ioutil.WriteFile(path, make([]byte, f.Size()), 0600); err != nil {
+			log.Printf("Wiping secret file %q failed: %s\n", f.Name(), err)
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("Removing secret files failed: %s\n", err)
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecretFiles(t *testing.T) {
+	env, dir, err := writeSecretFiles([]string{
+		"FOO=bar",
+		RarukasSecretFileEnvPrefix + "KUBECONFIG=apiVersion: v1\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, dir)
+	assert.Len(t, env, 2)
+	assert.Equal(t, "FOO=bar", env[0])
+
+	path := filepath.Join(dir, "KUBECONFIG")
+	assert.Equal(t, "KUBECONFIG="+path, env[1])
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1\n", string(data))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	wipeSecretFiles(dir)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWithoutSecretFiles(t *testing.T) {
+	env, dir, err := writeSecretFiles([]string{"FOO=bar"})
+	assert.NoError(t, err)
+	assert.Empty(t, dir)
+	assert.Equal(t, []string{"FOO=bar"}, env)
+}
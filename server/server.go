@@ -6,49 +6,53 @@ import (
 	"context"
 	"net/http"
 
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/gliderlabs/ssh"
 	"github.com/kr/pty"
+	gossh "golang.org/x/crypto/ssh"
 	"io"
 	"log"
+	"net"
 	"os"
 	"os/exec"
-	"strings"
-	"sync"
+	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 	"unsafe"
 )
 
-// Config is configuration of rarukas-server
-type Config struct {
-	PublicKey       string
-	Command         string
-	HealthCheckAddr string
-	HealthCheckPort int
-	SSHServerAddr   string
-	SSHServerPort   int
-}
-
 // Start rarukas-server
 func Start(ctx context.Context, cfg *Config) error {
 
 	// prepare for ssh server
-	allowedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.PublicKey))
+	keys, err := newKeyStore(cfg.PublicKey+"\n"+cfg.AuthorizedKeys, cfg.AuthorizedKeysFile)
+	if err != nil {
+		return err
+	}
+	ca, err := newUserCA(cfg.TrustedUserCAKeys, cfg.RunID)
 	if err != nil {
 		return err
 	}
-	publicKeyOption := ssh.PublicKeyAuth(sshAuthHandler(allowedKey))
-	ssh.Handle(sessionHandler(cfg.Command))
+	if keys.empty() && ca == nil {
+		return errors.New("no authorized keys")
+	}
+	allowUsers := cfg.AllowUsers
+	if len(allowUsers) == 0 {
+		allowUsers = []string{"root"}
+	}
+	publicKeyOption := ssh.PublicKeyAuth(sshAuthHandler(keys, ca, allowUsers))
 
 	// start
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	errChan := make(chan error)
 
+	if cfg.AuthorizedKeysFile != "" {
+		go reloadOnSIGHUP(ctx, keys)
+	}
+
 	// start health check
 	hcAddr := fmt.Sprintf("%s:%d", cfg.HealthCheckAddr, cfg.HealthCheckPort)
 	hcServer := &http.Server{
@@ -69,8 +73,24 @@ func Start(ctx context.Context, cfg *Config) error {
 
 	// start ssh server
 	sshAddr := fmt.Sprintf("%s:%d", cfg.SSHServerAddr, cfg.SSHServerPort)
-	sshServer := &ssh.Server{Addr: sshAddr}
+	subsystemHandlers := map[string]ssh.SubsystemHandler{}
+	for name := range subsystems {
+		subsystemHandlers[name] = subsystemHandler(name, cfg.WorkDir)
+	}
+	sshServer := &ssh.Server{
+		Addr:              sshAddr,
+		Handler:           sessionHandler(cfg.Command, cfg.WorkDir, cfg.AcceptEnv),
+		SubsystemHandlers: subsystemHandlers,
+	}
 	sshServer.SetOption(publicKeyOption) // nolint return value not checked
+	if cfg.HostKey != "" {
+		if err := sshServer.SetOption(ssh.HostKeyPEM([]byte(cfg.HostKey))); err != nil {
+			return fmt.Errorf("host key is invalid: %s", err)
+		}
+	}
+	if cfg.AllowForwarding {
+		enableForwarding(sshServer)
+	}
 	go func() {
 		select {
 		case errChan <- sshServer.ListenAndServe():
@@ -96,7 +116,7 @@ func setWinsize(f *os.File, w, h int) {
 		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
 }
 
-func sessionHandler(strCmd string) ssh.Handler {
+func sessionHandler(strCmd, workDir string, acceptEnv []string) ssh.Handler {
 	return func(s ssh.Session) {
 
 		log.SetPrefix("[SSH]")
@@ -108,124 +128,308 @@ func sessionHandler(strCmd string) ssh.Handler {
 			log.SetPrefix("")
 			log.SetFlags(0)
 		}()
+
+		auth := authorizationOf(s.Context())
+		if auth == nil {
+			log.Printf("Authorization of user %q is not found\n", s.User())
+			s.Exit(1) // nolint
+			return
+		}
+
 		args := []string{}
-		if len(s.Command()) > 0 {
-			args = []string{"-c", strings.Join(s.Command(), " ")}
+		if auth.key.command != "" {
+			args = []string{"-c", auth.key.command}
+		} else if s.RawCommand() != "" {
+			// the command is passed to the shell as is to keep quoting by the client
+			args = []string{"-c", s.RawCommand()}
+		}
+
+		sessionEnv := []string{}
+		if auth.key.command != "" {
+			// environment variables could change how the forced command runs
+			if len(s.Environ()) > 0 {
+				log.Printf("Environment variables of user %q are ignored for the forced command\n", s.User())
+			}
+		} else {
+			sessionEnv = acceptedEnv(s.Environ(), acceptEnv)
+		}
+
+		sessionEnv, secretDir, err := writeSecretFiles(sessionEnv)
+		if err != nil {
+			log.Printf("Writing secret files failed: %s\n", err)
+			s.Exit(1) // nolint
+			return
+		}
+		if secretDir != "" {
+			defer wipeSecretFiles(secretDir)
+			if err := auth.account.chown(secretDir); err != nil {
+				log.Printf("Changing owner of secret files failed: %s\n", err)
+				s.Exit(1) // nolint
+				return
+			}
 		}
 
 		cmd := exec.Command(strCmd, args...)
+		cmd.Dir = workDir
+		cmd.Env = append(commandEnv(sessionEnv), auth.environ(s)...)
+		auth.account.setCredential(cmd)
 
 		ptyReq, winCh, isPty := s.Pty()
+		if isPty && auth.key.noPty {
+			log.Printf("PTY is not allowed for the key of user %q\n", s.User())
+			isPty = false
+		}
 		if isPty {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
-			f, err := pty.Start(cmd)
-			if err != nil {
-				panic(err)
-			}
-			go func() {
-				for win := range winCh {
-					setWinsize(f, win.Width, win.Height)
-				}
-			}()
+			err = runWithPty(s, cmd, ptyReq, winCh)
+		} else {
+			err = runWithPipes(s, cmd)
+		}
+		sendExitStatus(s, err)
+	}
+}
 
-			go func() {
-				// stdin
-				io.Copy(f, s) // nolint return value not checked
-			}()
+func runWithPty(s ssh.Session, cmd *exec.Cmd, ptyReq ssh.Pty, winCh <-chan ssh.Window) error {
+	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+	f, err := pty.Start(cmd)
+	if err != nil {
+		fmt.Fprint(s.Stderr(), err) // nolint
+		return err
+	}
+	defer f.Close() // nolint
+	go func() {
+		for win := range winCh {
+			setWinsize(f, win.Width, win.Height)
+		}
+	}()
+	go forwardSignals(s, cmd)
 
-			// stdout
-			io.Copy(s, f) // nolint return value not checked
-		} else {
+	go func() {
+		// stdin
+		io.Copy(f, s) // nolint return value not checked
+	}()
 
-			var err error
-			var in io.WriteCloser
-			var out io.ReadCloser
-			var errOut io.ReadCloser
-
-			// Prepare teardown function
-			close := func() {
-				in.Close() // nolint
-
-				e1 := cmd.Wait()
-				var exitStatus int32
-				if e1 != nil {
-					if e2, ok := e1.(*exec.ExitError); ok {
-						if s, ok := e2.Sys().(syscall.WaitStatus); ok {
-							exitStatus = int32(s.ExitStatus())
-						} else {
-							panic(errors.New("Unimplemented for system where exec.ExitError.Sys() is not syscall.WaitStatus"))
-						}
-					}
-				}
-				var b bytes.Buffer
-				binary.Write(&b, binary.BigEndian, exitStatus) // nolint
-				s.SendRequest("exit-status", false, b.Bytes()) // nolint
-				s.Close()                                      // nolint
-			}
+	// stdout
+	io.Copy(s, f) // nolint return value not checked
+	return cmd.Wait()
+}
 
-			in, err = cmd.StdinPipe()
-			if err != nil {
-				fmt.Fprint(s.Stderr(), err) // nolint
-				close()
-				return
-			}
+func runWithPipes(s ssh.Session, cmd *exec.Cmd) error {
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprint(s.Stderr(), err) // nolint
+		return err
+	}
+	// cmd.Wait() waits for copying stdout/stderr to the session
+	cmd.Stdout = s
+	cmd.Stderr = s.Stderr()
 
-			out, err = cmd.StdoutPipe()
-			if err != nil {
-				fmt.Fprint(s.Stderr(), err) // nolint
-				close()
-				return
-			}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprint(s.Stderr(), err) // nolint
+		return err
+	}
+	go forwardSignals(s, cmd)
 
-			errOut, err = cmd.StderrPipe()
-			if err != nil {
-				fmt.Fprint(s.Stderr(), err) // nolint
-				close()
-				return
-			}
+	go func() {
+		io.Copy(in, s) // nolint
+		in.Close()     // nolint
+	}()
 
-			sigChan := make(chan ssh.Signal)
-			s.Signals(sigChan)
-			err = cmd.Start()
-			if err != nil {
-				fmt.Fprint(s.Stderr(), err) // nolint
-				close()
-				return
-			}
+	return cmd.Wait()
+}
 
-			//pipe session to shell and visa-versa
-			var once sync.Once
-			go func() {
-				io.Copy(s, out) // nolint
-				once.Do(close)
-			}()
-			go func() {
-				io.Copy(s.Stderr(), errOut) // nolint
-				once.Do(close)
-			}()
-			go func() {
-				io.Copy(in, s) // nolint
-				once.Do(close)
-			}()
-
-			sig := <-sigChan
+func forwardSignals(s ssh.Session, cmd *exec.Cmd) {
+	sigChan := make(chan ssh.Signal, 1)
+	s.Signals(sigChan)
+	defer s.Signals(nil)
+
+	for {
+		select {
+		case sig := <-sigChan:
 			log.Printf("session received signal[%s]", sig)
-			once.Do(close)
+			if sysSig, ok := sshToSysSignals[sig]; ok && cmd.Process != nil {
+				cmd.Process.Signal(sysSig) // nolint
+			}
+		case <-s.Context().Done():
+			return
 		}
 	}
 }
 
+// sendExitStatus sends "exit-status" or "exit-signal" request to client, then closes the session
+func sendExitStatus(s ssh.Session, err error) {
+	exitStatus := 0
+	if err != nil {
+		exitStatus = 255
+		if e1, ok := err.(*exec.ExitError); ok {
+			ws, ok := e1.Sys().(syscall.WaitStatus)
+			if !ok {
+				panic(errors.New("Unimplemented for system where exec.ExitError.Sys() is not syscall.WaitStatus"))
+			}
+			if ws.Signaled() {
+				if name, ok := sysToSSHSignals[ws.Signal()]; ok {
+					s.SendRequest("exit-signal", false, gossh.Marshal(&exitSignalMsg{ // nolint
+						Signal: string(name),
+						Error:  ws.Signal().String(),
+					}))
+					s.Close() // nolint
+					return
+				}
+				exitStatus = 128 + int(ws.Signal())
+			} else {
+				exitStatus = ws.ExitStatus()
+			}
+		}
+	}
+	s.Exit(exitStatus) // nolint
+}
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK")) // nolint return value not checked
 }
 
-func sshAuthHandler(allowed ssh.PublicKey) ssh.PublicKeyHandler {
+// enableForwarding enables local(direct-tcpip) and remote(tcpip-forward) port forwarding
+func enableForwarding(sshServer *ssh.Server) {
+	forwardHandler := &ssh.ForwardedTCPHandler{}
+	sshServer.ChannelHandlers = map[string]ssh.ChannelHandler{
+		"session":      ssh.DefaultSessionHandler,
+		"direct-tcpip": ssh.DirectTCPIPHandler,
+	}
+	sshServer.RequestHandlers = map[string]ssh.RequestHandler{
+		"tcpip-forward":        forwardHandler.HandleSSHRequest,
+		"cancel-tcpip-forward": forwardHandler.HandleSSHRequest,
+	}
+	sshServer.LocalPortForwardingCallback = localForwardingHandler()
+	sshServer.ReversePortForwardingCallback = reverseForwardingHandler()
+}
+
+// allowsForwarding returns true if the key used to authenticate the connection is allowed port forwarding
+func allowsForwarding(ctx ssh.Context) bool {
+	auth := authorizationOf(ctx)
+	return auth != nil && !auth.key.noPortForwarding
+}
+
+func localForwardingHandler() ssh.LocalPortForwardingCallback {
+	return func(ctx ssh.Context, host string, port uint32) bool {
+		if !allowsForwarding(ctx) {
+			return false
+		}
+		log.Printf("Forwarding to %s:%d\n", host, port)
+		return true
+	}
+}
+
+// reverseForwardingHandler allows remote port forwarding only on loopback address and unprivileged port,
+// so that forwarded ports are reachable only from inside of the container
+func reverseForwardingHandler() ssh.ReversePortForwardingCallback {
+	return func(ctx ssh.Context, host string, port uint32) bool {
+		if !allowsForwarding(ctx) {
+			return false
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			log.Printf("Remote forwarding on %s:%d is denied: bind address must be loopback\n", host, port)
+			return false
+		}
+		if port != 0 && port < 1024 {
+			log.Printf("Remote forwarding on %s:%d is denied: privileged port is not allowed\n", host, port)
+			return false
+		}
+		log.Printf("Remote forwarding on %s:%d\n", host, port)
+		return true
+	}
+}
+
+// reloadOnSIGHUP reloads authorized_keys files on SIGHUP until ctx is done
+func reloadOnSIGHUP(ctx context.Context, keys *keyStore) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			keys.reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// authorization is the result of public key authentication
+type authorization struct {
+	key     *authorizedKey
+	account *account
+}
+
+// environ returns environment variables of the command given by the account and options of the key
+func (a *authorization) environ(s ssh.Session) []string {
+	env := a.account.environ()
+	if a.key.command != "" && s.RawCommand() != "" {
+		env = append(env, "SSH_ORIGINAL_COMMAND="+s.RawCommand())
+	}
+	return append(env, a.key.environment...)
+}
+
+type contextKey string
+
+// contextKeyAuthorizations is context key of authorizations of keys accepted in the connection
+const contextKeyAuthorizations = contextKey("authorizations")
+
+// authorizationExtension is the extension of ssh.Permissions that has ID of authorization
+const authorizationExtension = "rarukas-authorization"
+
+// sshAuthHandler accepts keys in keys and certificates signed by ca for users in allowUsers. A client may query several keys before signing with one of them,
+// so each accepted key gets own Permissions that identifies its authorization, and x/crypto keeps Permissions of the key actually used
+func sshAuthHandler(keys *keyStore, ca *userCA, allowUsers []string) ssh.PublicKeyHandler {
 	return func(ctx ssh.Context, key ssh.PublicKey) bool {
-		if ctx.User() != "root" {
+		if !containsString(allowUsers, ctx.User()) {
 			return false
 		}
-		return ssh.KeysEqual(key, allowed)
+		acc, err := lookupAccount(ctx.User())
+		if err != nil {
+			log.Printf("User %q is not mapped to local account: %s\n", ctx.User(), err)
+			return false
+		}
+		k := keys.find(ctx.User(), acc.home, key)
+		if cert, ok := key.(*gossh.Certificate); ok && k == nil && ca != nil {
+			if k, err = ca.authorize(ctx.User(), cert); err != nil {
+				log.Printf("Certificate of user %q is refused: %s\n", ctx.User(), err)
+				return false
+			}
+		}
+		if k == nil || !k.allowsFrom(ctx.RemoteAddr()) {
+			return false
+		}
+
+		auths, _ := ctx.Value(contextKeyAuthorizations).(map[string]*authorization)
+		if auths == nil {
+			auths = map[string]*authorization{}
+			ctx.SetValue(contextKeyAuthorizations, auths)
+		}
+		id := strconv.Itoa(len(auths))
+		auths[id] = &authorization{key: k, account: acc}
+		ctx.SetValue(ssh.ContextKeyPermissions, &ssh.Permissions{
+			Permissions: &gossh.Permissions{Extensions: map[string]string{authorizationExtension: id}},
+		})
+		return true
+	}
+}
+
+// authorizationOf returns authorization of the key used to authenticate the connection
+func authorizationOf(ctx ssh.Context) *authorization {
+	conn, ok := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
+	if !ok || conn.Permissions == nil {
+		return nil
+	}
+	auths, _ := ctx.Value(contextKeyAuthorizations).(map[string]*authorization)
+	return auths[conn.Permissions.Extensions[authorizationExtension]]
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
 	}
+	return false
 }
@@ -4,12 +4,21 @@ package server
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
 	"github.com/gliderlabs/ssh"
 	"github.com/stretchr/testify/assert"
+	gossh "golang.org/x/crypto/ssh"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
@@ -19,17 +28,56 @@ var (
 
 type testSSHContext struct {
 	context.Context
-	userName string
+	sync.Mutex
+	userName   string
+	remoteAddr net.Addr
+	values     map[interface{}]interface{}
 }
 
-func (c *testSSHContext) User() string                    { return c.userName }
-func (c *testSSHContext) SessionID() string               { return "" }
-func (c *testSSHContext) ClientVersion() string           { return "" }
-func (c *testSSHContext) ServerVersion() string           { return "" }
-func (c *testSSHContext) RemoteAddr() net.Addr            { return nil }
-func (c *testSSHContext) LocalAddr() net.Addr             { return nil }
-func (c *testSSHContext) Permissions() *ssh.Permissions   { return nil }
-func (c *testSSHContext) SetValue(key, value interface{}) {}
+func (c *testSSHContext) User() string                  { return c.userName }
+func (c *testSSHContext) SessionID() string             { return "" }
+func (c *testSSHContext) ClientVersion() string         { return "" }
+func (c *testSSHContext) ServerVersion() string         { return "" }
+func (c *testSSHContext) RemoteAddr() net.Addr          { return c.remoteAddr }
+func (c *testSSHContext) LocalAddr() net.Addr           { return nil }
+func (c *testSSHContext) Permissions() *ssh.Permissions { return nil }
+func (c *testSSHContext) SetValue(key, value interface{}) {
+	if c.values == nil {
+		c.values = map[interface{}]interface{}{}
+	}
+	c.values[key] = value
+}
+func (c *testSSHContext) Value(key interface{}) interface{} {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	if c.Context == nil {
+		return nil
+	}
+	return c.Context.Value(key)
+}
+
+// authenticate runs sshAuthHandler, and then sets the connection with Permissions of the accepted key like gliderlabs/ssh
+func authenticate(keys *keyStore, ctx *testSSHContext, key ssh.PublicKey) bool {
+	if !sshAuthHandler(keys, nil, []string{"root"})(ctx, key) {
+		return false
+	}
+	permissions := ctx.Value(ssh.ContextKeyPermissions).(*ssh.Permissions)
+	ctx.SetValue(ssh.ContextKeyConn, &gossh.ServerConn{Permissions: permissions.Permissions})
+	return true
+}
+
+func parseTestKeys(t *testing.T) (ssh.PublicKey, ssh.PublicKey) {
+	allowedKey, _, _, _, err := ssh.ParseAuthorizedKey(allowPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deniedKey, _, _, _, err := ssh.ParseAuthorizedKey(denyPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return allowedKey, deniedKey
+}
 
 func TestHealthCheckServer(t *testing.T) {
 
@@ -42,19 +90,19 @@ func TestHealthCheckServer(t *testing.T) {
 	assert.Equal(t, []byte("OK"), w.Body.Bytes())
 }
 
+func TestStartWithoutKeys(t *testing.T) {
+	err := Start(context.Background(), &Config{})
+	assert.EqualError(t, err, "no authorized keys")
+}
+
 func TestSSHAuthHandler(t *testing.T) {
 
-	// prepare ssh server
-	allowedKey, _, _, _, err := ssh.ParseAuthorizedKey(allowPublicKey)
+	allowedKey, deniedKey := parseTestKeys(t)
+	keys, err := newKeyStore(string(allowPublicKey), "")
 	if err != nil {
 		t.Fatal(err)
 	}
-	deniedKey, _, _, _, err := ssh.ParseAuthorizedKey(denyPublicKey)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	handler := sshAuthHandler(allowedKey)
+	handler := sshAuthHandler(keys, nil, []string{"root"})
 
 	t.Run("Invalid UserName", func(t *testing.T) {
 		ctx := &testSSHContext{userName: "foobar"}
@@ -72,5 +120,221 @@ func TestSSHAuthHandler(t *testing.T) {
 		ctx := &testSSHContext{userName: "root"}
 		assert.False(t, handler(ctx, deniedKey))
 	})
+	t.Run("Refused address", func(t *testing.T) {
+		keys, err := newKeyStore(`from="10.0.0.0/8" `+string(allowPublicKey), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := sshAuthHandler(keys, nil, []string{"root"})
 
+		ctx := &testSSHContext{userName: "root", remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}}
+		assert.False(t, handler(ctx, allowedKey))
+		ctx = &testSSHContext{userName: "root", remoteAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}}
+		assert.True(t, handler(ctx, allowedKey))
+	})
+	t.Run("Certificate", func(t *testing.T) {
+		caSigner := newTestSigner(t)
+		ca, err := newUserCA(string(gossh.MarshalAuthorizedKey(caSigner.PublicKey())), "run1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := newTestCert(t, caSigner, func(cert *gossh.Certificate) {
+			cert.CriticalOptions[sourceAddressCriticalOption] = "10.0.0.0/8"
+		})
+		allowedAddr := &net.TCPAddr{IP: net.ParseIP("10.1.2.3")}
+
+		ctx := &testSSHContext{userName: "root", remoteAddr: allowedAddr}
+		assert.True(t, sshAuthHandler(keys, ca, []string{"root"})(ctx, cert))
+		ctx = &testSSHContext{userName: "root", remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}}
+		assert.False(t, sshAuthHandler(keys, ca, []string{"root"})(ctx, cert))
+		ctx = &testSSHContext{userName: "root", remoteAddr: allowedAddr}
+		assert.False(t, sshAuthHandler(keys, nil, []string{"root"})(ctx, cert))
+	})
+	t.Run("Authorization of the key used", func(t *testing.T) {
+		// the client queries the restricted key first, and then signs with the other
+		keys, err := newKeyStore("restrict,command=\"true\" "+string(denyPublicKey)+"\n"+string(allowPublicKey), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &testSSHContext{userName: "root"}
+		assert.True(t, authenticate(keys, ctx, deniedKey))
+		assert.Equal(t, "true", authorizationOf(ctx).key.command)
+
+		assert.True(t, authenticate(keys, ctx, allowedKey))
+		auth := authorizationOf(ctx)
+		assert.Equal(t, "", auth.key.command)
+		assert.False(t, auth.key.noPortForwarding)
+	})
+}
+
+func TestLocalForwardingHandler(t *testing.T) {
+
+	allowedKey, deniedKey := parseTestKeys(t)
+	keys, err := newKeyStore(string(allowPublicKey)+"\nno-port-forwarding "+string(denyPublicKey), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := localForwardingHandler()
+
+	t.Run("Allowed key", func(t *testing.T) {
+		ctx := &testSSHContext{userName: "root"}
+		assert.True(t, authenticate(keys, ctx, allowedKey))
+		assert.True(t, handler(ctx, "localhost", 8080))
+	})
+	t.Run("Key with no-port-forwarding", func(t *testing.T) {
+		ctx := &testSSHContext{userName: "root"}
+		assert.True(t, authenticate(keys, ctx, deniedKey))
+		assert.False(t, handler(ctx, "localhost", 8080))
+	})
+	t.Run("No key", func(t *testing.T) {
+		ctx := &testSSHContext{Context: context.Background(), userName: "root"}
+		assert.False(t, handler(ctx, "localhost", 8080))
+	})
+}
+
+func TestReverseForwardingHandler(t *testing.T) {
+
+	allowedKey, deniedKey := parseTestKeys(t)
+	keys, err := newKeyStore(string(allowPublicKey)+"\nrestrict "+string(denyPublicKey), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := reverseForwardingHandler()
+	newContext := func(key ssh.PublicKey) ssh.Context {
+		ctx := &testSSHContext{userName: "root"}
+		if !authenticate(keys, ctx, key) {
+			t.Fatal("authentication failed")
+		}
+		return ctx
+	}
+
+	expects := []struct {
+		name    string
+		key     ssh.PublicKey
+		host    string
+		port    uint32
+		allowed bool
+	}{
+		{name: "loopback", key: allowedKey, host: "127.0.0.1", port: 5432, allowed: true},
+		{name: "localhost", key: allowedKey, host: "localhost", port: 5432, allowed: true},
+		{name: "IPv6 loopback", key: allowedKey, host: "::1", port: 5432, allowed: true},
+		{name: "dynamic port", key: allowedKey, host: "127.0.0.1", port: 0, allowed: true},
+		{name: "all interfaces", key: allowedKey, host: "", port: 5432, allowed: false},
+		{name: "0.0.0.0", key: allowedKey, host: "0.0.0.0", port: 5432, allowed: false},
+		{name: "privileged port", key: allowedKey, host: "127.0.0.1", port: 80, allowed: false},
+		{name: "restricted key", key: deniedKey, host: "127.0.0.1", port: 5432, allowed: false},
+	}
+
+	for _, expect := range expects {
+		t.Run(expect.name, func(t *testing.T) {
+			assert.Equal(t, expect.allowed, handler(newContext(expect.key), expect.host, expect.port))
+		})
+	}
+}
+
+func TestCommandEnvOfSwitchedUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("switching user requires root")
+	}
+	a, err := lookupAccount("nobody")
+	if err != nil {
+		t.Skip(err)
+	}
+	os.Setenv(RarukasHostKeyEnv, "secret-host-key") // nolint
+	defer os.Unsetenv(RarukasHostKeyEnv)            // nolint
+
+	cmd := exec.Command("/bin/sh", "-c", "env")
+	cmd.Env = append(commandEnv(nil), a.environ()...)
+	a.setCredential(cmd)
+	out, err := cmd.Output()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(out), "USER=nobody")
+	assert.NotContains(t, string(out), RarukasHostKeyEnv)
+	assert.NotContains(t, string(out), "secret-host-key")
+}
+
+func TestSessionEnv(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(gossh.MarshalAuthorizedKey(signer.PublicKey()))
+
+	run := func(t *testing.T, authorizedKeys string, acceptEnv []string) string {
+		ports := make([]int, 2)
+		for i := range ports {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ports[i] = l.Addr().(*net.TCPAddr).Port
+			l.Close() // nolint
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go Start(ctx, &Config{ // nolint
+			AuthorizedKeys:  authorizedKeys,
+			Command:         "/bin/sh",
+			HealthCheckAddr: "127.0.0.1",
+			HealthCheckPort: ports[0],
+			SSHServerAddr:   "127.0.0.1",
+			SSHServerPort:   ports[1],
+			AcceptEnv:       acceptEnv,
+		})
+
+		var client *gossh.Client
+		for i := 0; ; i++ {
+			client, err = gossh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", ports[1]), &gossh.ClientConfig{
+				User:            "root",
+				Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+				HostKeyCallback: gossh.InsecureIgnoreHostKey(), // nolint
+			})
+			if err == nil {
+				break
+			}
+			if i > 50 {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		defer client.Close() // nolint
+
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer session.Close() // nolint
+		for _, name := range []string{"LANG", "APP_STAGE", "BASH_ENV"} {
+			session.Setenv(name, "from-client") // nolint
+		}
+		out, err := session.Output("env")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		out := run(t, publicKey, nil)
+		assert.Contains(t, out, "LANG=from-client")
+		assert.NotContains(t, out, "APP_STAGE=from-client")
+		assert.NotContains(t, out, "BASH_ENV=from-client")
+	})
+	t.Run("Accept all", func(t *testing.T) {
+		out := run(t, publicKey, []string{"*"})
+		assert.Contains(t, out, "APP_STAGE=from-client")
+		assert.NotContains(t, out, "BASH_ENV=from-client")
+	})
+	t.Run("Forced command", func(t *testing.T) {
+		out := run(t, `command="env" `+publicKey, []string{"*"})
+		assert.NotContains(t, out, "from-client")
+	})
 }
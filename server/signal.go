@@ -0,0 +1,40 @@
+// +build !windows
+
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	"syscall"
+)
+
+// exitSignalMsg is payload of "exit-signal" request(RFC4254 6.10)
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+var sshToSysSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+var sysToSSHSignals = func() map[syscall.Signal]ssh.Signal {
+	m := make(map[syscall.Signal]ssh.Signal, len(sshToSysSignals))
+	for k, v := range sshToSysSignals {
+		m[v] = k
+	}
+	return m
+}()
@@ -0,0 +1,163 @@
+// +build !windows
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/pkg/sftp"
+	"github.com/rarukas/rarukas/manifest"
+	"github.com/rarukas/rarukas/tarstream"
+)
+
+// ServeSubsystemFlag is the flag of rarukas-server to serve a subsystem over stdin/stdout.
+// rarukas-server runs itself with it to serve subsystems as the account of SSH user
+const ServeSubsystemFlag = "serve-subsystem"
+
+// subsystem serves SSH subsystem over rw. Relative paths are resolved from workDir.
+// The returned error is reported to the client
+type subsystem func(workDir string, rw io.ReadWriteCloser) error
+
+var subsystems = map[string]subsystem{
+	"sftp":                   serveSFTP,
+	RarukasManifestSubsystem: serveManifest(buildManifest),
+	RarukasGlobSubsystem:     serveManifest(globManifest),
+	RarukasTarSubsystem:      serveTar,
+}
+
+// subsystemHandler serves subsystem in rarukas-server, or in a subprocess running as the account of SSH user
+func subsystemHandler(name, workDir string) ssh.SubsystemHandler {
+	return func(s ssh.Session) {
+		auth := authorizationOf(s.Context())
+		if auth == nil || auth.key.command != "" {
+			// keys with forced command can run only the command
+			fmt.Fprintf(s.Stderr(), "subsystem %q is not allowed", name) // nolint
+			s.Exit(1)                                                    // nolint
+			return
+		}
+
+		if auth.account.switchUser {
+			sendExitStatus(s, runSubsystemAs(s, auth.account, name, workDir))
+			return
+		}
+		if err := subsystems[name](workDir, s); err != nil {
+			log.Printf("Subsystem %q failed: %s\n", name, err)
+			fmt.Fprint(s.Stderr(), err) // nolint
+			s.Exit(1)                   // nolint
+			return
+		}
+		s.Exit(0) // nolint
+	}
+}
+
+// runSubsystemAs runs rarukas-server with ServeSubsystemFlag as the account
+func runSubsystemAs(s ssh.Session, a *account, name, workDir string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "--"+ServeSubsystemFlag, name, "--work-dir", workDir)
+	cmd.Env = a.environ()
+	a.setCredential(cmd)
+	return runWithPipes(s, cmd)
+}
+
+// ServeSubsystem serves subsystem over stdin/stdout of the process
+func ServeSubsystem(name, workDir string) error {
+	serve, ok := subsystems[name]
+	if !ok {
+		return fmt.Errorf("subsystem %q is not supported", name)
+	}
+	return serve(workDir, stdio{})
+}
+
+// stdio is stdin/stdout of the process
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error)  { return os.Stdin.Read(p) }
+func (stdio) Write(p []byte) (int, error) { return os.Stdout.Write(p) }
+func (stdio) Close() error                { return os.Stdout.Close() }
+
+// serveSFTP serves SFTP subsystem
+func serveSFTP(workDir string, rw io.ReadWriteCloser) error {
+	var options []sftp.ServerOption
+	if workDir != "" {
+		options = append(options, sftp.WithServerWorkingDirectory(workDir))
+	}
+	server, err := sftp.NewServer(rw, options...)
+	if err != nil {
+		return fmt.Errorf("starting SFTP server failed: %s", err)
+	}
+	defer server.Close() // nolint
+
+	if err := server.Serve(); err != nil && err != io.EOF {
+		return fmt.Errorf("SFTP session failed: %s", err)
+	}
+	return nil
+}
+
+// buildManifest returns manifest of whole dir except files excluded by req.Rules
+func buildManifest(dir string, req *manifest.Request) (*manifest.Manifest, error) {
+	return manifest.Build(dir, manifest.NewRules(req.Rules...))
+}
+
+// globManifest returns manifest of files in dir matching req.Globs
+func globManifest(dir string, req *manifest.Request) (*manifest.Manifest, error) {
+	return manifest.Glob(dir, req.Globs)
+}
+
+// serveManifest serves manifest subsystems. It reads manifest.Request, and writes manifest.Manifest built by build
+func serveManifest(build func(dir string, req *manifest.Request) (*manifest.Manifest, error)) subsystem {
+	return func(workDir string, rw io.ReadWriteCloser) error {
+		req := &manifest.Request{}
+		if err := json.NewDecoder(rw).Decode(req); err != nil {
+			return fmt.Errorf("reading manifest request failed: %s", err)
+		}
+
+		dir := req.Dir
+		if !filepath.IsAbs(dir) && workDir != "" {
+			dir = filepath.Join(workDir, dir)
+		}
+		m, err := build(dir, req)
+		if err != nil {
+			return fmt.Errorf("building manifest of %q failed: %s", dir, err)
+		}
+		if err := json.NewEncoder(rw).Encode(m); err != nil {
+			return fmt.Errorf("sending manifest failed: %s", err)
+		}
+		return nil
+	}
+}
+
+// serveTar serves tar stream subsystem. It reads tarstream.Request,
+// and then extracts tar stream read after the request, or writes tar stream of requested paths
+func serveTar(workDir string, rw io.ReadWriteCloser) error {
+	req := &tarstream.Request{}
+	decoder := json.NewDecoder(rw)
+	if err := decoder.Decode(req); err != nil {
+		return fmt.Errorf("reading tar stream request failed: %s", err)
+	}
+
+	dir := req.Dir
+	if !filepath.IsAbs(dir) && workDir != "" {
+		dir = filepath.Join(workDir, dir)
+	}
+	if req.Extract {
+		// tar stream follows the request
+		if _, err := tarstream.Extract(io.MultiReader(decoder.Buffered(), rw), dir, req.Compression); err != nil {
+			return fmt.Errorf("extracting tar stream into %q failed: %s", dir, err)
+		}
+		return nil
+	}
+	if _, err := tarstream.Write(rw, dir, req.Paths, req.Compression); err != nil {
+		return fmt.Errorf("writing tar stream of %q failed: %s", dir, err)
+	}
+	return nil
+}
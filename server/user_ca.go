@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// forceCommandCriticalOption is critical option of certificate to force the command like command= of authorized_keys
+	forceCommandCriticalOption = "force-command"
+	// sourceAddressCriticalOption is critical option of certificate to restrict client addresses like from= of authorized_keys
+	sourceAddressCriticalOption = "source-address"
+
+	permitPtyExtension            = "permit-pty"
+	permitPortForwardingExtension = "permit-port-forwarding"
+)
+
+// userCA authenticates users with certificates signed by trusted SSH user CA keys
+type userCA struct {
+	keys [][]byte
+	// runID is ID of the run of rarukas. If set, only certificates issued for the run are accepted
+	runID   string
+	checker *ssh.CertChecker
+}
+
+// newUserCA parses trusted CA keys in authorized_keys format. It returns nil if there are no keys
+func newUserCA(trustedKeys, runID string) (*userCA, error) {
+	ca := &userCA{runID: runID}
+	scanner := bufio.NewScanner(strings.NewReader(trustedKeys))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("trusted user CA keys are invalid: line %d: %s", n, err)
+		}
+		ca.keys = append(ca.keys, key.Marshal())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(ca.keys) == 0 {
+		if runID != "" {
+			return nil, errors.New("run ID requires trusted user CA keys")
+		}
+		return nil, nil
+	}
+	ca.checker = &ssh.CertChecker{
+		SupportedCriticalOptions: []string{forceCommandCriticalOption, sourceAddressCriticalOption, RarukasRunIDCriticalOption},
+		IsUserAuthority:          ca.isAuthority,
+	}
+	return ca, nil
+}
+
+func (ca *userCA) isAuthority(key ssh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, k := range ca.keys {
+		if bytes.Equal(k, marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks cert of the user, and returns authorized key with restrictions given by the certificate.
+// Like sshd, the user must be listed in principals, and permit-* extensions are required for PTY and port forwarding
+func (ca *userCA) authorize(user string, cert *ssh.Certificate) (*authorizedKey, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate has type %d", cert.CertType)
+	}
+	if !ca.isAuthority(cert.SignatureKey) {
+		return nil, errors.New("certificate is signed by unknown authority")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, errors.New("certificate has no principals")
+	}
+	if err := ca.checker.CheckCert(user, cert); err != nil {
+		return nil, err
+	}
+
+	runID, ok := cert.CriticalOptions[RarukasRunIDCriticalOption]
+	if ca.runID != "" && runID != ca.runID {
+		return nil, fmt.Errorf("certificate is not issued for run %q", ca.runID)
+	}
+	if ca.runID == "" && ok {
+		return nil, fmt.Errorf("certificate is issued only for run %q", runID)
+	}
+
+	k := &authorizedKey{
+		key:              cert,
+		command:          cert.CriticalOptions[forceCommandCriticalOption],
+		noPty:            !hasExtension(cert, permitPtyExtension),
+		noPortForwarding: !hasExtension(cert, permitPortForwardingExtension),
+	}
+	if addrs, ok := cert.CriticalOptions[sourceAddressCriticalOption]; ok {
+		for _, addr := range strings.Split(addrs, ",") {
+			addr = strings.TrimSpace(addr)
+			if _, _, err := net.ParseCIDR(addr); err != nil && net.ParseIP(addr) == nil {
+				return nil, fmt.Errorf("source-address %q is invalid", addr)
+			}
+			k.from = append(k.from, addr)
+		}
+	}
+	return k, nil
+}
+
+func hasExtension(cert *ssh.Certificate, name string) bool {
+	_, ok := cert.Extensions[name]
+	return ok
+}
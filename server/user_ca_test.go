@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestCert returns user certificate valid for an hour, signed by ca. modify changes the certificate before signing
+func newTestCert(t *testing.T, ca ssh.Signer, modify func(cert *ssh.Certificate)) *ssh.Certificate {
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             newTestSigner(t).PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "test",
+		ValidPrincipals: []string{"root"},
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{RarukasRunIDCriticalOption: "run1"},
+			Extensions:      map[string]string{permitPtyExtension: "", permitPortForwardingExtension: ""},
+		},
+	}
+	if modify != nil {
+		modify(cert)
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestNewUserCA(t *testing.T) {
+	t.Run("No keys", func(t *testing.T) {
+		ca, err := newUserCA("# no keys\n", "")
+		assert.NoError(t, err)
+		assert.Nil(t, ca)
+	})
+	t.Run("Run ID without keys", func(t *testing.T) {
+		_, err := newUserCA("", "run1")
+		assert.Error(t, err)
+	})
+	t.Run("Invalid key", func(t *testing.T) {
+		_, err := newUserCA("\nssh-rsa invalid", "")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "line 2")
+	})
+}
+
+func TestUserCAAuthorize(t *testing.T) {
+	caSigner := newTestSigner(t)
+	ca, err := newUserCA(string(ssh.MarshalAuthorizedKey(caSigner.PublicKey())), "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Valid certificate", func(t *testing.T) {
+		k, err := ca.authorize("root", newTestCert(t, caSigner, nil))
+		assert.NoError(t, err)
+		assert.Equal(t, "", k.command)
+		assert.False(t, k.noPty)
+		assert.False(t, k.noPortForwarding)
+	})
+
+	t.Run("Restrictions", func(t *testing.T) {
+		cert := newTestCert(t, caSigner, func(cert *ssh.Certificate) {
+			cert.CriticalOptions[forceCommandCriticalOption] = "make test"
+			cert.CriticalOptions[sourceAddressCriticalOption] = "10.0.0.0/8, 192.168.0.1"
+			cert.Extensions = nil
+		})
+		k, err := ca.authorize("root", cert)
+		assert.NoError(t, err)
+		assert.Equal(t, "make test", k.command)
+		assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.1"}, k.from)
+		assert.True(t, k.noPty)
+		assert.True(t, k.noPortForwarding)
+	})
+
+	expects := []struct {
+		name   string
+		signer ssh.Signer
+		modify func(cert *ssh.Certificate)
+	}{
+		{name: "Unknown authority", signer: newTestSigner(t)},
+		{name: "Host certificate", modify: func(cert *ssh.Certificate) { cert.CertType = ssh.HostCert }},
+		{name: "No principals", modify: func(cert *ssh.Certificate) { cert.ValidPrincipals = nil }},
+		{name: "Other principal", modify: func(cert *ssh.Certificate) { cert.ValidPrincipals = []string{"alice"} }},
+		{name: "Expired", modify: func(cert *ssh.Certificate) { cert.ValidBefore = uint64(time.Now().Add(-time.Second).Unix()) }},
+		{name: "Not yet valid", modify: func(cert *ssh.Certificate) { cert.ValidAfter = uint64(time.Now().Add(time.Hour).Unix()) }},
+		{name: "Other run", modify: func(cert *ssh.Certificate) { cert.CriticalOptions[RarukasRunIDCriticalOption] = "run2" }},
+		{name: "No run", modify: func(cert *ssh.Certificate) { delete(cert.CriticalOptions, RarukasRunIDCriticalOption) }},
+		{name: "Unknown critical option", modify: func(cert *ssh.Certificate) { cert.CriticalOptions["verify-required"] = "" }},
+		{name: "Invalid source-address", modify: func(cert *ssh.Certificate) { cert.CriticalOptions[sourceAddressCriticalOption] = "example.com" }},
+	}
+	for _, expect := range expects {
+		t.Run(expect.name, func(t *testing.T) {
+			signer := expect.signer
+			if signer == nil {
+				signer = caSigner
+			}
+			_, err := ca.authorize("root", newTestCert(t, signer, expect.modify))
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("Certificate for run on server without run ID", func(t *testing.T) {
+		ca, err := newUserCA(string(ssh.MarshalAuthorizedKey(caSigner.PublicKey())), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ca.authorize("root", newTestCert(t, caSigner, nil))
+		assert.Error(t, err)
+
+		_, err = ca.authorize("root", newTestCert(t, caSigner, func(cert *ssh.Certificate) {
+			delete(cert.CriticalOptions, RarukasRunIDCriticalOption)
+		}))
+		assert.NoError(t, err)
+	})
+}
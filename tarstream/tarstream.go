@@ -0,0 +1,296 @@
+// Package tarstream provides compressed tar stream of files, used to transfer many files over one SSH channel
+// between rarukas and rarukas-server without tar command
+package tarstream
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/rarukas/rarukas/manifest"
+)
+
+// Compression is compression algorithm of tar stream
+type Compression string
+
+const (
+	// None sends tar stream without compression
+	None Compression = "none"
+	// Gzip compresses tar stream with gzip
+	Gzip Compression = "gzip"
+	// Zstd compresses tar stream with zstd
+	Zstd Compression = "zstd"
+)
+
+// Compressions are names of available Compression
+var Compressions = []string{string(None), string(Gzip), string(Zstd)}
+
+// Request is request of tar stream to rarukas-server
+type Request struct {
+	// Dir is directory on rarukas-server. Relative path is resolved from working directory of rarukas-server
+	Dir string `json:"dir"`
+	// Extract is true when rarukas sends tar stream to be extracted into Dir.
+	// Otherwise rarukas-server sends tar stream of Paths under Dir
+	Extract bool `json:"extract,omitempty"`
+	// Paths are slash separated paths relative to Dir. Parents must come before children
+	Paths       []string    `json:"paths,omitempty"`
+	Compression Compression `json:"compression"`
+}
+
+// Stats is statistics of tar stream
+type Stats struct {
+	Files int
+	// Size is bytes of tar stream before compression
+	Size int64
+	// CompressedSize is bytes of tar stream actually transferred
+	CompressedSize int64
+}
+
+// Ratio returns CompressedSize / Size
+func (s *Stats) Ratio() float64 {
+	if s.Size == 0 {
+		return 1
+	}
+	return float64(s.CompressedSize) / float64(s.Size)
+}
+
+// Summary returns human readable statistics with throughput in elapsed
+func (s *Stats) Summary(elapsed time.Duration) string {
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		seconds = 1
+	}
+	return fmt.Sprintf("%d files, %s compressed to %s(%.1f%%) in %s, %s/s(%s/s on wire)",
+		s.Files, manifest.FormatBytes(s.Size), manifest.FormatBytes(s.CompressedSize), s.Ratio()*100,
+		elapsed.Round(time.Millisecond),
+		manifest.FormatBytes(int64(float64(s.Size)/seconds)), manifest.FormatBytes(int64(float64(s.CompressedSize)/seconds)),
+	)
+}
+
+// Write writes tar stream of paths under root compressed by c.
+// Symbolic links to files are followed, and symbolic links to directories are skipped like file transfer does
+func Write(w io.Writer, root string, paths []string, c Compression) (*Stats, error) {
+	compressed := &countingWriter{w: w}
+	zw, err := newWriter(compressed, c)
+	if err != nil {
+		return nil, err
+	}
+	raw := &countingWriter{w: zw}
+	tw := tar.NewWriter(raw)
+
+	stats := &Stats{}
+	for _, p := range paths {
+		written, err := writeEntry(tw, root, p)
+		if err != nil {
+			return nil, fmt.Errorf("archiving %q failed: %s", p, err)
+		}
+		if written {
+			stats.Files++
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	stats.Size = raw.n
+	stats.CompressedSize = compressed.n
+	return stats, nil
+}
+
+// writeEntry writes header and content of p. It returns true if p is regular file
+func writeEntry(tw *tar.Writer, root, p string) (bool, error) {
+	localPath := filepath.Join(root, filepath.FromSlash(p))
+	fi, err := os.Stat(localPath)
+	if err != nil {
+		return false, err
+	}
+	if !fi.IsDir() && !fi.Mode().IsRegular() {
+		return false, nil
+	}
+
+	header, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return false, err
+	}
+	header.Name = p
+	if fi.IsDir() {
+		header.Name += "/"
+		return false, tw.WriteHeader(header)
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return false, err
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() // nolint -> return value not checked
+	_, err = io.CopyN(tw, f, header.Size)
+	return true, err
+}
+
+// Extract extracts tar stream compressed by c into root. Entries whose path points outside of root are rejected
+func Extract(r io.Reader, root string, c Compression) (*Stats, error) {
+	compressed := &countingReader{r: r}
+	zr, err := newReader(compressed, c)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close() // nolint -> return value not checked
+	raw := &countingReader{r: zr}
+	tr := tar.NewReader(raw)
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	var dirs []*tar.Header
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		dest, err := extractPath(root, header.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return nil, err
+			}
+			dirs = append(dirs, header)
+		case tar.TypeReg:
+			if err := extractFile(tr, dest, header); err != nil {
+				return nil, fmt.Errorf("extracting %q failed: %s", header.Name, err)
+			}
+			stats.Files++
+		}
+	}
+
+	// set attributes of directories after their contents are written
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dest, _ := extractPath(root, dirs[i].Name)
+		if err := os.Chmod(dest, dirs[i].FileInfo().Mode().Perm()); err != nil {
+			return nil, err
+		}
+		if err := os.Chtimes(dest, dirs[i].ModTime, dirs[i].ModTime); err != nil {
+			return nil, err
+		}
+	}
+
+	// read padding of tar and end of compressed stream
+	if _, err := io.Copy(ioutil.Discard, raw); err != nil {
+		return nil, err
+	}
+	stats.Size = raw.n
+	stats.CompressedSize = compressed.n
+	return stats, nil
+}
+
+// extractPath returns local path of name in root
+func extractPath(root, name string) (string, error) {
+	p := path.Clean(strings.TrimSuffix(name, "/"))
+	if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("%q points outside of %q", name, root)
+	}
+	return filepath.Join(root, filepath.FromSlash(p)), nil
+}
+
+func extractFile(r io.Reader, dest string, header *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	mode := header.FileInfo().Mode().Perm()
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close() // nolint -> return value not checked
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(dest, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, header.ModTime, header.ModTime)
+}
+
+func newWriter(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+func newReader(r io.Reader, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case None:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,95 @@
+package tarstream
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteAndExtract(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rarukas-test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir) // nolint
+
+	srcDir := filepath.Join(tmpDir, "src")
+	files := map[string]string{
+		"a.txt":         "a",
+		"dir/b.txt":     string(bytes.Repeat([]byte("b"), 10000)),
+		"dir/sub/c.txt": "c",
+	}
+	for name, content := range files {
+		p := filepath.Join(srcDir, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, ioutil.WriteFile(p, []byte(content), 0600))
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(srcDir, "empty"), 0700))
+	modTime := time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(filepath.Join(srcDir, "a.txt"), modTime, modTime))
+
+	paths := []string{"a.txt", "dir", "dir/b.txt", "dir/sub", "dir/sub/c.txt", "empty"}
+
+	for _, c := range []Compression{None, Gzip, Zstd} {
+		t.Run(string(c), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			written, err := Write(buf, srcDir, paths, c)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, written.Files)
+			assert.Equal(t, int64(buf.Len()), written.CompressedSize)
+			if c != None {
+				assert.True(t, written.Ratio() < 1)
+			}
+
+			destDir := filepath.Join(tmpDir, "dest-"+string(c))
+			extracted, err := Extract(buf, destDir, c)
+			assert.NoError(t, err)
+			assert.Equal(t, written, extracted)
+
+			for name, content := range files {
+				data, err := ioutil.ReadFile(filepath.Join(destDir, filepath.FromSlash(name)))
+				assert.NoError(t, err)
+				assert.Equal(t, content, string(data))
+			}
+			fi, err := os.Stat(filepath.Join(destDir, "a.txt"))
+			if assert.NoError(t, err) {
+				assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+				assert.True(t, modTime.Equal(fi.ModTime()))
+			}
+			fi, err = os.Stat(filepath.Join(destDir, "empty"))
+			if assert.NoError(t, err) {
+				assert.True(t, fi.IsDir())
+				assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+			}
+		})
+	}
+
+	t.Run("Unsafe path", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		assert.NoError(t, tw.WriteHeader(&tar.Header{Name: "../evil.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte("evil"))
+		assert.NoError(t, err)
+		assert.NoError(t, tw.Close())
+
+		_, err = Extract(buf, filepath.Join(tmpDir, "unsafe"), None)
+		assert.Error(t, err)
+		assert.False(t, fileExists(filepath.Join(tmpDir, "evil.txt")))
+	})
+
+	t.Run("Unknown compression", func(t *testing.T) {
+		_, err := Write(&bytes.Buffer{}, srcDir, paths, "lz4")
+		assert.Error(t, err)
+	})
+}
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}